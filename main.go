@@ -6,17 +6,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jacobweinstock/waitdaemon/runtime"
+	"github.com/jacobweinstock/waitdaemon/runtime/containerd"
+	"github.com/jacobweinstock/waitdaemon/runtime/cri"
 	"github.com/jacobweinstock/waitdaemon/runtime/docker"
 	"github.com/jacobweinstock/waitdaemon/runtime/nerdctl"
+	"github.com/jacobweinstock/waitdaemon/runtime/podman"
+	"github.com/jacobweinstock/waitdaemon/schedule"
+	"github.com/jacobweinstock/waitdaemon/waitfor"
 )
 
 const (
@@ -26,10 +41,115 @@ const (
 	imageEnv = "IMAGE"
 	// waitTimeEnv is the amount of time to wait before running the user image. This is set by the user. Default is 10 seconds.
 	waitTimeEnv = "WAIT_SECONDS"
-	// runtimeEnv is the container runtime to use. Valid values: "docker", "nerdctl", "auto". Default is "auto".
+	// waitForEnv is a condition expression to wait on before running the user image, e.g. "all(file(/run/done), tcp-closed(127.0.0.1:42113, 2m))".
+	// See the waitfor package for the syntax. This is set by the user. When it is not set, waitTimeEnv is used.
+	waitForEnv = "WAIT_FOR"
+	// waitModeEnv selects what the second fork waits on before running the user image. This is set by the user.
+	// Valid values: "sleep" (WAIT_FOR or WAIT_SECONDS) and "parent-exit" (the first fork container exiting). Default is "sleep".
+	waitModeEnv = "WAIT_MODE"
+	// waitGraceEnv is the number of seconds to wait after the first fork container exits when waitModeEnv is "parent-exit".
+	// This is set by the user. Default is 0.
+	waitGraceEnv = "WAIT_GRACE_SECONDS"
+	// runAtEnv is the earliest time, in RFC3339 format, to run the user image. This is set by the user.
+	runAtEnv = "RUN_AT"
+	// windowStartEnv and windowEndEnv are the start and end, in HH:MM UTC, of a daily maintenance window
+	// the user image must run in. These are set by the user.
+	windowStartEnv = "WINDOW_START"
+	windowEndEnv   = "WINDOW_END"
+	// windowDaysEnv is a comma separated list of weekdays (e.g. "sat,sun") the maintenance window starts on.
+	// This is set by the user. Default is every day.
+	windowDaysEnv = "WINDOW_DAYS"
+	// jitterEnv is the maximum number of seconds of random delay added to the scheduled run time. This is set by the user.
+	jitterEnv = "JITTER_SECONDS"
+	// retriesEnv is the number of times to rerun the user container after it fails. This is set by the user. Default is 0.
+	retriesEnv = "RETRIES"
+	// retryBackoffEnv is the delay, as a Go duration (e.g. "10s"), before the first retry. It doubles after
+	// every retry, up to maxRetryBackoff. This is set by the user. Default is 5 seconds.
+	retryBackoffEnv = "RETRY_BACKOFF"
+	// retryOnExitCodesEnv is a comma separated list of the user container exit codes to retry on.
+	// This is set by the user. Default is any non-zero exit code.
+	retryOnExitCodesEnv = "RETRY_ON_EXIT_CODES"
+	// onFailureImageEnv is an image to run when the user container fails and all retries are used up,
+	// e.g. to reboot or upload diagnostics. It runs with the same settings as the user container.
+	// This is set by the user. Default is IMAGE when onFailureCommandEnv is set.
+	onFailureImageEnv = "ON_FAILURE_IMAGE"
+	// onFailureCommandEnv is the whitespace separated command of the fallback container. This is set by the user.
+	// Default is the command of the user container.
+	onFailureCommandEnv = "ON_FAILURE_COMMAND"
+	// userTimeoutEnv is the longest the user container may run, as a Go duration (e.g. "30m"). When it expires,
+	// the container is sent userStopSignalEnv and killed after userKillGraceEnv. This is set by the user. Default is no limit.
+	userTimeoutEnv = "USER_TIMEOUT"
+	// userStopSignalEnv is the signal sent to the user container when userTimeoutEnv expires, e.g. "SIGTERM" or "15".
+	// This is set by the user. Default is "SIGTERM".
+	userStopSignalEnv = "USER_STOP_SIGNAL"
+	// userKillGraceEnv is how long, as a Go duration, to wait after the stop signal before killing the user container.
+	// This is set by the user. Default is 10 seconds.
+	userKillGraceEnv = "USER_KILL_GRACE"
+	// userEntrypointEnv replaces the entrypoint of the user image. It is either whitespace separated, e.g. "/bin/sh -c",
+	// or a JSON array, e.g. ["/bin/sh", "-c"]. This is set by the user. Default is the entrypoint of the user image;
+	// the entrypoint of the waitdaemon container is never passed on.
+	userEntrypointEnv = "USER_ENTRYPOINT"
+	// userWorkdirEnv is the working directory of the user container. This is set by the user.
+	// Default is the working directory of the waitdaemon container, if any, otherwise that of the user image.
+	userWorkdirEnv = "USER_WORKDIR"
+	// userUserEnv is the user, in "user[:group]" form, the user container runs as. This is set by the user.
+	// Default is the user of the waitdaemon container, if any, otherwise that of the user image.
+	userUserEnv = "USER_USER"
+	// envAllowEnv is a comma separated list of variable names, or path.Match patterns such as "NERDCTL_*",
+	// of waitdaemon variables to pass on to the user container anyway. This is set by the user.
+	envAllowEnv = "ENV_ALLOW"
+	// envDenyEnv is a comma separated list of variable names, or path.Match patterns, to remove from the
+	// environment of the user container in addition to the waitdaemon variables. This is set by the user.
+	envDenyEnv = "ENV_DENY"
+	// waitdaemonEnvPrefix is the prefix of variables meant for waitdaemon only. Every setting can also be given
+	// with it, e.g. WAITDAEMON_IMAGE, which takes precedence over the unprefixed name. Variables with the prefix
+	// are not passed on to the user container unless envAllowEnv lets them through.
+	waitdaemonEnvPrefix = "WAITDAEMON_"
+	// userEnvPrefix is the prefix of variables meant for the user container only. The prefix is removed,
+	// e.g. USER_ENV_IMAGE=x is passed on as IMAGE=x, replacing any variable of the same name.
+	userEnvPrefix = "USER_ENV_"
+	// registryConfigEnv is the path of a docker config.json, or of the directory holding it, with the credentials
+	// for pulling IMAGE and ON_FAILURE_IMAGE. Credential helpers are not supported. This is set by the user.
+	registryConfigEnv = "REGISTRY_CONFIG"
+	// registryAuthEnv is the base64 encoded "username:password" for the registry of IMAGE, the "auth" form of
+	// a docker config.json. It takes precedence over registryConfigEnv for that registry. This is set by the user.
+	registryAuthEnv = "REGISTRY_AUTH"
+	// registryAuthFileEnv is the path of a file, e.g. a mounted secret, holding the registryAuthEnv value.
+	// It is used when registryAuthEnv is not set. This is set by the user.
+	registryAuthFileEnv = "REGISTRY_AUTH_FILE"
+	// pullPolicyEnv is when IMAGE and ON_FAILURE_IMAGE are pulled. Valid values: "Always", "IfNotPresent" and "Never".
+	// This is set by the user. Default is "IfNotPresent".
+	pullPolicyEnv = "PULL_POLICY"
+	// autoRemoveEnv, when "true" or "1", removes the second fork and user containers once they exit, and removes
+	// exited containers of previous waitdaemon runs when the action starts. Second forks with an idempotency key
+	// are kept. This is set by the user. Default is false.
+	autoRemoveEnv = "AUTO_REMOVE"
+	// idempotencyKeyEnv identifies a run so that a re-run of the action is detected. This is set by the user.
+	// Default is derived from the waitdaemon image, IMAGE and the command, when idempotencyPolicyEnv is set.
+	idempotencyKeyEnv = "IDEMPOTENCY_KEY"
+	// idempotencyPolicyEnv is what the action does when a run with the same key is in flight or has completed.
+	// Valid values: "skip", "replace" and "fail". This is set by the user. Default is "skip" when idempotencyKeyEnv is set,
+	// otherwise no check is done.
+	idempotencyPolicyEnv = "IDEMPOTENCY_POLICY"
+	// parentIDEnv is the container ID of the first fork. This is used internally and should be not set by the user.
+	parentIDEnv = "PARENT_CONTAINER_ID"
+	// nonceEnv is the per-run nonce the first fork also stamps on the second fork container as labelNonce.
+	// This is used internally and should be not set by the user.
+	nonceEnv = "FORK_NONCE"
+	// runtimeEnv is the container runtime to use. Valid values: "docker", "docker-cli", "nerdctl", "containerd", "podman", "cri", "auto". Default is "auto".
 	runtimeEnv = "CONTAINER_RUNTIME"
 	// nerdctlNamespaceEnv is the nerdctl namespace nerdctl should operate in. Default is "tinkerbell".
+	// It is also the containerd namespace used by the containerd runtime.
 	nerdctlNamespaceEnv = "NERDCTL_NAMESPACE"
+	// containerdAddressEnv is the containerd socket the containerd runtime connects to. Default is "/run/containerd/containerd.sock".
+	containerdAddressEnv = "CONTAINERD_ADDRESS"
+	// containerdSnapshotterEnv is the snapshotter the containerd runtime pulls images with, and creates containers
+	// with when the inspected container reports none. Default is containerd's default snapshotter.
+	containerdSnapshotterEnv = "CONTAINERD_SNAPSHOTTER"
+	// podmanSocketEnv is the Podman API socket the podman runtime connects to. Default is "/run/podman/podman.sock".
+	podmanSocketEnv = "PODMAN_SOCKET"
+	// criEndpointEnv is the CRI socket the cri runtime connects to. Default is "/run/containerd/containerd.sock".
+	criEndpointEnv = "CRI_ENDPOINT"
 	// nerdctlHostEnv enables nsenter mode. When set to "true" or "1", all nerdctl
 	// CLI calls are prefixed with nsenter to enter host namespaces (mount, UTS, IPC,
 	// net, PID). This eliminates the need for volume mounts in the Tinkerbell template
@@ -45,50 +165,265 @@ const (
 	// firstForkErrorCode is the exit code that should be used when the first fork was not run successfully.
 	firstForkErrorCode = 1
 	// secondForkErrorCode is the exit code that should be used when the second fork was not run successfully.
+	// When the user container runs and exits non-zero, the second fork exits with the user container's exit code instead.
 	secondForkErrorCode = 2
+	// labelPhase, labelParent and labelImage are the labels stamped on the containers waitdaemon creates.
+	// labelPhase is one of the phase* values below, labelParent is the ID of the action (first fork)
+	// container and labelImage is the user image.
+	labelPhase  = "waitdaemon.phase"
+	labelParent = "waitdaemon.parent"
+	labelImage  = "waitdaemon.image"
+	// labelKey is the label holding the idempotency key of the run.
+	labelKey = "waitdaemon.key"
+	// labelNonce is the label holding the nonce of the run on the second fork container. The second fork
+	// only runs when its own container has the nonce and parent labels matching nonceEnv and parentIDEnv.
+	labelNonce = "waitdaemon.nonce"
+	// nonceLength is the number of random bytes in a nonce.
+	nonceLength = 16
+	// phaseLabelSecondFork, phaseLabelUser and phaseLabelFallback are the values of labelPhase.
+	phaseLabelSecondFork = "second-fork"
+	phaseLabelUser       = "user"
+	phaseLabelFallback   = "fallback"
+	// shortIDLength is the length of the container ID prefix used in container names.
+	shortIDLength = 12
+	// idempotencySkip, idempotencyReplace and idempotencyFail are the values of idempotencyPolicyEnv.
+	idempotencySkip    = "skip"
+	idempotencyReplace = "replace"
+	idempotencyFail    = "fail"
+	// pullAlways, pullIfNotPresent and pullNever are the values of pullPolicyEnv.
+	pullAlways       = "Always"
+	pullIfNotPresent = "IfNotPresent"
+	pullNever        = "Never"
+	// waitModeSleep is the value of waitModeEnv that waits on WAIT_FOR or WAIT_SECONDS.
+	waitModeSleep = "sleep"
+	// waitModeParentExit is the value of waitModeEnv that waits for the first fork container to exit.
+	waitModeParentExit = "parent-exit"
 	// defaultWaitTime is the amount of time to wait before running the user image.
 	defaultWaitTime = time.Duration(10) * time.Second
+	// defaultRetryBackoff is the delay before the first retry of the user container.
+	defaultRetryBackoff = time.Duration(5) * time.Second
+	// maxRetryBackoff is the longest delay between retries of the user container.
+	maxRetryBackoff = time.Duration(5) * time.Minute
+	// defaultKillGrace is how long to wait after the stop signal before killing a timed out user container.
+	defaultKillGrace = time.Duration(10) * time.Second
+	// logDrainTimeout is how long to wait for the user container's log stream to finish after the container exits.
+	logDrainTimeout = time.Duration(5) * time.Second
 )
 
 func main() {
 	nsenter := nsenterEnabled()
 
 	phase := os.Getenv(phaseEnv)
-	img := os.Getenv(imageEnv)
-	waitTime := os.Getenv(waitTimeEnv)
-	runtimePref := os.Getenv(runtimeEnv)
-	nerdctlNS := os.Getenv(nerdctlNamespaceEnv)
+	cfg := configFromEnv()
+	runtimePref := getenv(runtimeEnv)
+	nerdctlNS := getenv(nerdctlNamespaceEnv)
 	if nerdctlNS == "" {
 		nerdctlNS = defaultNerdctlNamespace
 	}
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	logger.Info("starting waitdaemon", "phase", phase, "image", img, "waitTime", waitTime, "runtime", runtimePref, "nerdctlNamespace", nerdctlNS)
+	logger.Info("starting waitdaemon", "phase", phase, "image", cfg.img, "waitTime", cfg.wait.seconds, "waitFor", cfg.wait.waitFor, "waitMode", cfg.wait.mode, "runAt", cfg.wait.runAt, "retries", cfg.retry.retries, "runtime", runtimePref, "nerdctlNamespace", nerdctlNS)
 
-	rt, err := runtime.Detect(runtimePref, dockerRuntime, nerdctlRuntime, nerdctlNS, nsenter)
+	factories := runtime.Factories{
+		Docker:     dockerRuntime,
+		Nerdctl:    nerdctlRuntime,
+		Containerd: containerdRuntime,
+		Podman:     podmanRuntime,
+		CRI:        criRuntime,
+	}
+	rt, err := runtime.Detect(runtimePref, factories, nerdctlNS, nsenter)
 	if err != nil {
 		logger.Info("unable to create container runtime client", "error", err)
 		os.Exit(runtimeClientErrorCode)
 	}
 
-	statusCode := 0
-	switch phase {
-	case phaseSecondFork:
-		logger.Info("running second fork")
-		if err := secondFork(logger, rt, waitTime, img); err != nil {
-			logger.Info("unable to run second fork image", "error", err)
-			statusCode = secondForkErrorCode
-		}
-	default:
+	statusCode := runPhase(logger, rt, cfg, phase, os.Getenv(nonceEnv))
+	_ = rt.Close()
+	os.Exit(statusCode)
+}
+
+// runPhase runs the first or second fork, as selected by phase, and returns the exit status of the process.
+// nonce is the second fork's NONCE env var.
+func runPhase(logger *slog.Logger, rt runtime.Runtime, cfg config, phase, nonce string) int {
+	if phase != phaseSecondFork {
 		logger.Info("running first fork")
-		if err := firstFork(logger, rt, img); err != nil {
+		if err := firstFork(logger, rt, cfg); err != nil {
 			logger.Info("unable to run first fork image", "error", err)
-			statusCode = firstForkErrorCode
+			return firstForkErrorCode
 		}
+		return 0
 	}
 
-	_ = rt.Close()
-	os.Exit(statusCode)
+	logger.Info("running second fork")
+	// PHASE alone is not trusted: a user setting it must not skip the first fork.
+	if err := verifySecondFork(context.Background(), rt, cfg.wait.parentID, nonce); err != nil {
+		logger.Info("refusing to run second fork", "error", err)
+		return secondForkErrorCode
+	}
+	if err := secondFork(logger, rt, cfg); err != nil {
+		logger.Info("unable to run second fork image", "error", err)
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			return exitErr.code
+		}
+		return secondForkErrorCode
+	}
+	return 0
+}
+
+// config holds the user settings read from the environment.
+type config struct {
+	img   string
+	wait  waitConfig
+	retry retryConfig
+	stop  stopConfig
+	// onFailureImg and onFailureCmd are the fallback container run when the user container fails.
+	onFailureImg string
+	onFailureCmd []string
+	// entrypoint, workdir and user override the process settings of the user container.
+	entrypoint string
+	workdir    string
+	user       string
+	// env controls which variables are passed on to the user container.
+	env envConfig
+	// registry holds the credentials for pulling images.
+	registry registryConfig
+	// pullPolicy is when images are pulled.
+	pullPolicy string
+	// autoRemove removes the containers waitdaemon creates once they exit.
+	autoRemove bool
+	// idemKey and idemPolicy guard against duplicate runs.
+	idemKey    string
+	idemPolicy string
+}
+
+// fallbackImage returns the image of the fallback container, or "" when no fallback is configured.
+func (c config) fallbackImage() string {
+	if c.onFailureImg == "" && len(c.onFailureCmd) > 0 {
+		return c.img
+	}
+	return c.onFailureImg
+}
+
+// configFromEnv reads the user settings from the environment.
+func configFromEnv() config {
+	return config{
+		img: getenv(imageEnv),
+		wait: waitConfig{
+			seconds:  getenv(waitTimeEnv),
+			waitFor:  getenv(waitForEnv),
+			mode:     getenv(waitModeEnv),
+			grace:    getenv(waitGraceEnv),
+			parentID: os.Getenv(parentIDEnv),
+			runAt:    getenv(runAtEnv),
+			winStart: getenv(windowStartEnv),
+			winEnd:   getenv(windowEndEnv),
+			winDays:  getenv(windowDaysEnv),
+			jitter:   getenv(jitterEnv),
+			clock:    schedule.SystemClock{},
+		},
+		retry: retryConfig{
+			retries:   getenv(retriesEnv),
+			backoff:   getenv(retryBackoffEnv),
+			exitCodes: getenv(retryOnExitCodesEnv),
+		},
+		stop: stopConfig{
+			timeout: getenv(userTimeoutEnv),
+			signal:  getenv(userStopSignalEnv),
+			grace:   getenv(userKillGraceEnv),
+		},
+		onFailureImg: getenv(onFailureImageEnv),
+		onFailureCmd: strings.Fields(getenv(onFailureCommandEnv)),
+		entrypoint:   getenv(userEntrypointEnv),
+		workdir:      getenv(userWorkdirEnv),
+		user:         getenv(userUserEnv),
+		autoRemove:   slices.Contains([]string{"true", "1"}, strings.ToLower(getenv(autoRemoveEnv))),
+		idemKey:      getenv(idempotencyKeyEnv),
+		idemPolicy:   getenv(idempotencyPolicyEnv),
+		pullPolicy:   getenv(pullPolicyEnv),
+		env: envConfig{
+			allow: getenv(envAllowEnv),
+			deny:  getenv(envDenyEnv),
+		},
+		registry: registryConfig{
+			config:   getenv(registryConfigEnv),
+			auth:     getenv(registryAuthEnv),
+			authFile: getenv(registryAuthFileEnv),
+		},
+	}
+}
+
+// validate reports whether the user settings are valid.
+func (c config) validate() error {
+	if err := c.wait.validate(); err != nil {
+		return err
+	}
+	if _, err := c.retry.parse(); err != nil {
+		return err
+	}
+	if _, err := c.stop.parse(); err != nil {
+		return err
+	}
+	if _, err := parseEntrypoint(c.entrypoint); err != nil {
+		return err
+	}
+	if _, err := c.env.parse(); err != nil {
+		return err
+	}
+	switch c.idemPolicy {
+	case "", idempotencySkip, idempotencyReplace, idempotencyFail:
+	default:
+		return fmt.Errorf("invalid %s %q, must be %q, %q or %q", idempotencyPolicyEnv, c.idemPolicy, idempotencySkip, idempotencyReplace, idempotencyFail)
+	}
+	switch c.pullPolicy {
+	case "", pullAlways, pullIfNotPresent, pullNever:
+	default:
+		return fmt.Errorf("invalid %s %q, must be %q, %q or %q", pullPolicyEnv, c.pullPolicy, pullAlways, pullIfNotPresent, pullNever)
+	}
+	return nil
+}
+
+// parseEntrypoint parses userEntrypointEnv. A value starting with "[" is a JSON array,
+// otherwise the value is split on whitespace. It returns nil for an empty value.
+func parseEntrypoint(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") {
+		return strings.Fields(s), nil
+	}
+	var ep []string
+	if err := json.Unmarshal([]byte(s), &ep); err != nil {
+		return nil, fmt.Errorf("invalid %s %q, must be whitespace separated or a JSON array of strings: %w", userEntrypointEnv, s, err)
+	}
+	return ep, nil
+}
+
+// userRunFor returns the userRun of the user image containers, with the process settings
+// of cfg applied. The entrypoint and env settings were validated by the first fork.
+func (c config) userRunFor(img, name string, labels map[string]string) userRun {
+	ep, _ := parseEntrypoint(c.entrypoint)
+	env, _ := c.env.parse()
+	return userRun{
+		img:        img,
+		env:        env,
+		entrypoint: ep,
+		workdir:    c.workdir,
+		user:       c.user,
+		name:       name,
+		labels:     labels,
+		remove:     c.autoRemove,
+	}
+}
+
+// fallbackRunFor returns the userRun of the fallback container. USER_ENTRYPOINT, USER_WORKDIR
+// and USER_USER are meant for the user image, so they are left out and the fallback image's
+// own entrypoint and the action's working directory and user are used instead.
+func (c config) fallbackRunFor(img, name string, labels map[string]string) userRun {
+	run := c.userRunFor(img, name, labels)
+	run.entrypoint = nil
+	run.workdir = ""
+	run.user = ""
+	run.cmd = c.onFailureCmd
+	return run
 }
 
 // dockerRuntime creates a Docker runtime client.
@@ -101,78 +436,894 @@ func nerdctlRuntime(cli []string) (runtime.Runtime, error) {
 	return nerdctl.New(cli)
 }
 
+// containerdRuntime creates a containerd client runtime in the given namespace.
+func containerdRuntime(namespace string) (runtime.Runtime, error) {
+	return containerd.New(getenv(containerdAddressEnv), namespace, getenv(containerdSnapshotterEnv))
+}
+
+// podmanRuntime creates a Podman REST API runtime client.
+func podmanRuntime() (runtime.Runtime, error) {
+	return podman.New(getenv(podmanSocketEnv))
+}
+
+// criRuntime creates a Kubernetes CRI gRPC runtime client.
+func criRuntime() (runtime.Runtime, error) {
+	return cri.New(getenv(criEndpointEnv))
+}
+
 // firstFork pulls the user image and starts a container in the background from the image
 // that is currently being used by the container. This must return immediately after
 // creating the second container. Image pull failures are propagated back to the caller.
-func firstFork(logger *slog.Logger, rt runtime.Runtime, img string) error {
+func firstFork(logger *slog.Logger, rt runtime.Runtime, cfg config) error {
 	ctx := context.Background()
+	img := cfg.img
+
+	// Validate the settings here so that a bad value fails the action.
+	if err := cfg.validate(); err != nil {
+		return err
+	}
 
-	// Pull the user's image before creating the second container.
+	info, err := rt.InspectSelf(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Check for a duplicate run before the sweep removes the containers of completed runs.
+	key := cfg.idempotencyKey(info)
+	if key != "" {
+		skip, err := guardDuplicate(ctx, logger, rt, key, cfg.idemPolicy)
+		if err != nil || skip {
+			return err
+		}
+	}
+
+	if cfg.autoRemove {
+		sweep(ctx, logger, rt)
+	}
+
+	// Pull the user's image, and the fallback image, before creating the second container.
 	// This ensures pull failures are reported back to Tink server.
-	if exists := rt.ImageExists(ctx, img); !exists {
-		logger.Info("pulling image", "image", img)
-		if err := rt.PullImage(ctx, img); err != nil {
+	if err := ensureImage(ctx, logger, rt, img, cfg); err != nil {
+		return err
+	}
+	if fallback := cfg.fallbackImage(); fallback != "" && fallback != img {
+		if err := ensureImage(ctx, logger, rt, fallback, cfg); err != nil {
+			return err
+		}
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	// Pass our own container ID so the second fork can wait for this container to exit, and the
+	// nonce, which the second fork checks against the labels of its container.
+	info.Env = append(stripEnv(info.Env, phaseEnv), fmt.Sprintf("%v=%v", phaseEnv, phaseSecondFork))
+	info.Env = append(stripEnv(info.Env, parentIDEnv), fmt.Sprintf("%v=%v", parentIDEnv, info.ID))
+	info.Env = append(stripEnv(info.Env, nonceEnv), fmt.Sprintf("%v=%v", nonceEnv, nonce))
+	info.Name = containerName(info.ID, phaseLabelSecondFork)
+	info.Labels = containerLabels(phaseLabelSecondFork, info.ID, img, key)
+	info.Labels[labelNonce] = nonce
+	// An exited second fork with the key is how a later run sees that this run completed,
+	// so it is kept even with AUTO_REMOVE.
+	info.AutoRemove = cfg.autoRemove && key == ""
+	// Pass the resolved key so the second fork stamps it on the user containers.
+	if key != "" {
+		info.Env = append(stripEnv(info.Env, idempotencyKeyEnv), fmt.Sprintf("%v=%v", idempotencyKeyEnv, key))
+	}
+
+	warnDropped(logger, rt, info)
+	_, err = rt.RunContainer(ctx, info)
+	return err
+}
+
+// warnDropped logs the settings of info that rt cannot apply. The second fork and the
+// user containers are created with these settings, so they apply to all of them.
+func warnDropped(logger *slog.Logger, rt runtime.Runtime, info runtime.ContainerInfo) {
+	w, ok := rt.(runtime.Warner)
+	if !ok {
+		return
+	}
+	for _, msg := range w.Warnings(info) {
+		logger.Info("setting not supported by the runtime, ignoring it", "warning", msg)
+	}
+}
+
+// newNonce returns a random hex nonce for a run.
+func newNonce() (string, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// verifySecondFork checks that the current container was created by the first fork parentID as its
+// second fork: the container must carry the second fork phase label and the parent and nonce labels
+// matching parentID and nonce. Labels cannot be set from an action, unlike env vars.
+func verifySecondFork(ctx context.Context, rt runtime.Runtime, parentID, nonce string) error {
+	if parentID == "" || nonce == "" {
+		return fmt.Errorf("%s and %s must be set by the first fork", parentIDEnv, nonceEnv)
+	}
+	self, err := rt.InspectSelf(ctx)
+	if err != nil {
+		return fmt.Errorf("inspecting own container: %w", err)
+	}
+	if self.ID == parentID {
+		return fmt.Errorf("container %q is its own parent", self.ID)
+	}
+	cons, err := rt.List(ctx, map[string]string{labelPhase: phaseLabelSecondFork, labelParent: parentID, labelNonce: nonce})
+	if err != nil {
+		return fmt.Errorf("listing second fork containers: %w", err)
+	}
+	if !slices.ContainsFunc(cons, func(c runtime.Container) bool { return c.ID == self.ID }) {
+		return fmt.Errorf("container %q was not created by waitdaemon as the second fork of %q", self.ID, parentID)
+	}
+	return nil
+}
+
+// idempotencyKey returns the idempotency key of the run, or "" when duplicate runs are not checked.
+// self is the inspected first fork container.
+func (c config) idempotencyKey(self runtime.ContainerInfo) string {
+	if c.idemKey != "" {
+		return c.idemKey
+	}
+	if c.idemPolicy == "" {
+		return ""
+	}
+	h := sha256.New()
+	for _, s := range append([]string{self.Image, c.img}, self.Cmd...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// guardDuplicate looks for containers of a previous run with the same idempotency key and applies the policy.
+// It reports whether the action should stop without starting the second fork.
+func guardDuplicate(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, key, policy string) (bool, error) {
+	cons, err := rt.List(ctx, map[string]string{labelKey: key})
+	if err != nil {
+		return false, fmt.Errorf("listing containers with idempotency key %q: %w", key, err)
+	}
+
+	// A running container means the run is in flight; an exited second fork means it completed.
+	var inFlight, completed bool
+	for _, c := range cons {
+		switch {
+		case c.Running:
+			inFlight = true
+		case c.Labels[labelPhase] == phaseLabelSecondFork:
+			completed = true
+		}
+	}
+	if !inFlight && !completed {
+		return false, nil
+	}
+	state := "completed"
+	if inFlight {
+		state = "in flight"
+	}
+
+	switch policy {
+	case idempotencyFail:
+		return false, fmt.Errorf("a run with idempotency key %q is %s", key, state)
+	case idempotencyReplace:
+		logger.Info("replacing previous run", "idempotencyKey", key, "state", state)
+		for _, c := range cons {
+			if c.Running {
+				if err := rt.Stop(ctx, c.ID, syscall.SIGTERM, defaultKillGrace); err != nil {
+					return false, fmt.Errorf("stopping container %q of previous run: %w", c.ID, err)
+				}
+			}
+			if err := rt.Remove(ctx, c.ID); err != nil {
+				return false, fmt.Errorf("removing container %q of previous run: %w", c.ID, err)
+			}
+		}
+		return false, nil
+	default:
+		logger.Info("skipping run, a run with the same idempotency key exists", "idempotencyKey", key, "state", state)
+		return true, nil
+	}
+}
+
+// sweep removes the exited containers of previous waitdaemon runs. Second forks with an idempotency
+// key are kept, as they record that their run completed. Failures are logged and do not stop the action.
+func sweep(ctx context.Context, logger *slog.Logger, rt runtime.Runtime) {
+	cons, err := rt.List(ctx, map[string]string{labelPhase: ""})
+	if err != nil {
+		logger.Info("unable to list containers of previous runs", "error", err)
+		return
+	}
+	removed := 0
+	for _, c := range cons {
+		if c.Running || (c.Labels[labelPhase] == phaseLabelSecondFork && c.Labels[labelKey] != "") {
+			continue
+		}
+		if err := rt.Remove(ctx, c.ID); err != nil {
+			logger.Info("unable to remove container of previous run", "containerID", c.ID, "name", c.Name, "error", err)
+			continue
+		}
+		removed++
+	}
+	logger.Info("removed exited containers of previous runs", "count", removed)
+}
+
+// ensureImage makes sure the image exists locally according to the pull policy of cfg, pulling it
+// with the registry credentials of cfg. An image pinned by digest must have that digest.
+func ensureImage(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, img string, cfg config) error {
+	pinned := runtime.PinnedDigest(img)
+	local, exists := rt.ImageExists(ctx, img)
+	var pull bool
+	switch cfg.pullPolicy {
+	case pullAlways:
+		pull = true
+	case pullNever:
+		if !exists {
+			return fmt.Errorf("image %q does not exist locally and %s is %q", img, pullPolicyEnv, pullNever)
+		}
+	default:
+		pull = !exists || (pinned != "" && !local.HasDigest(pinned))
+	}
+
+	if pull {
+		auth, err := cfg.registry.authFor(img, cfg.img)
+		if err != nil {
+			return fmt.Errorf("getting registry credentials for image %q: %w", img, err)
+		}
+		if auth.Helper != "" {
+			logger.Info("registry credential helpers are not supported, pulling without credentials", "image", img, "registry", auth.ServerAddress, "helper", auth.Helper)
+		}
+		logger.Info("pulling image", "image", img, "registry", auth.ServerAddress, "authenticated", !auth.IsZero())
+		if err := rt.PullImage(ctx, img, auth); err != nil {
+			if auth.Helper != "" {
+				return fmt.Errorf("pulling image %q without credentials, as the credential helper %q of %s is not supported: %w", img, auth.Helper, registryConfigEnv, err)
+			}
 			return fmt.Errorf("pulling image %q: %w", img, err)
 		}
+		if local, exists = rt.ImageExists(ctx, img); !exists {
+			return fmt.Errorf("image %q does not exist after pulling it", img)
+		}
 	} else {
 		logger.Info("image already exists locally", "image", img)
 	}
 
-	info, err := rt.InspectSelf(ctx)
-	if err != nil {
-		return err
+	if pinned != "" && !local.HasDigest(pinned) {
+		return fmt.Errorf("image %q has digest %q, not the pinned digest", img, local.Digest())
 	}
-	info.Env = append(info.Env, fmt.Sprintf("%v=%v", phaseEnv, phaseSecondFork))
+	logger.Info("resolved image", "image", img, "digest", local.Digest(), "imageID", local.ID)
+	return nil
+}
 
-	return rt.RunContainer(ctx, info)
+// registryConfig holds the settings that provide the credentials for pulling images.
+type registryConfig struct {
+	config   string
+	auth     string
+	authFile string
+}
+
+// authFor returns the credentials for pulling img. The inline or file credentials are only
+// used for the registry of the user image userImg; the config.json is used for any registry.
+func (rc registryConfig) authFor(img, userImg string) (runtime.RegistryAuth, error) {
+	host, err := runtime.RegistryHost(img)
+	if err != nil {
+		return runtime.RegistryAuth{}, err
+	}
+	encoded := rc.auth
+	if encoded == "" && rc.authFile != "" {
+		b, err := os.ReadFile(rc.authFile)
+		if err != nil {
+			return runtime.RegistryAuth{}, fmt.Errorf("reading %s: %w", registryAuthFileEnv, err)
+		}
+		encoded = string(b)
+	}
+	if encoded != "" {
+		if userHost, _ := runtime.RegistryHost(userImg); userHost == host {
+			return runtime.ParseRegistryAuth(host, encoded)
+		}
+	}
+	if rc.config == "" {
+		return runtime.RegistryAuth{ServerAddress: host}, nil
+	}
+	path := rc.config
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "config.json")
+	}
+	auth, err := runtime.RegistryAuthFromConfig(path, host)
+	if err != nil {
+		return runtime.RegistryAuth{}, err
+	}
+	auth.ServerAddress = host
+	return auth, nil
 }
 
-func secondFork(logger *slog.Logger, rt runtime.Runtime, waitTime string, img string) error {
+func secondFork(logger *slog.Logger, rt runtime.Runtime, cfg config) error {
 	ctx := context.Background()
+	img := cfg.img
 
 	// Image was already pulled in firstFork, so we just wait and run.
-	t := defaultWaitTime
-	if s := waitTime; s != "" {
-		if i, err := strconv.Atoi(s); err == nil {
-			t = time.Duration(i) * time.Second
+	wait(ctx, logger, rt, cfg.wait)
+	if local, ok := rt.ImageExists(ctx, img); ok {
+		logger.Info("resolved user image", "image", img, "digest", local.Digest(), "imageID", local.ID)
+	}
+
+	stop, err := cfg.stop.parse()
+	if err != nil {
+		// The first fork validated the stop settings, so this should not happen.
+		logger.Info("unable to parse user container timeout settings, not limiting run time", "error", err)
+	}
+
+	err = runWithRetries(ctx, logger, rt, cfg, stop)
+	if err == nil {
+		return nil
+	}
+
+	// The user container failed: run the fallback, if any. Its result is only logged;
+	// the second fork still reports the user container's failure.
+	if fallback := cfg.fallbackImage(); fallback != "" {
+		logger.Info("user image failed, running fallback image", "image", img, "fallbackImage", fallback, "fallbackCommand", cfg.onFailureCmd, "error", err)
+		run := cfg.fallbackRunFor(fallback, containerName(cfg.wait.parentID, phaseLabelFallback), containerLabels(phaseLabelFallback, cfg.wait.parentID, img, cfg.idemKey))
+		code, ferr := runAttempt(ctx, logger, rt, run, stop)
+		if ferr != nil {
+			logger.Info("unable to run fallback image", "fallbackImage", fallback, "error", ferr)
+		} else {
+			logger.Info("fallback container exited", "fallbackImage", fallback, "exitCode", code)
 		}
 	}
-	logger.Info("waiting before running user image", "waitSeconds", t.String())
-	time.Sleep(t)
+	return err
+}
+
+// runWithRetries runs the user image until it succeeds or the retry policy is used up.
+func runWithRetries(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, cfg config, stop stopPolicy) error {
+	img := cfg.img
+	policy, err := cfg.retry.parse()
+	if err != nil {
+		// The first fork validated the retry settings, so this should not happen.
+		logger.Info("unable to parse retry settings, not retrying", "error", err)
+	}
 
-	logger.Info("running user image", "image", img)
-	if err := runUserImage(ctx, rt, img); err != nil {
+	for attempt := 1; ; attempt++ {
+		logger.Info("running user image", "image", img, "attempt", attempt, "maxAttempts", policy.retries+1)
+		suffix := phaseLabelUser
+		if attempt > 1 {
+			suffix = fmt.Sprintf("%s-%d", phaseLabelUser, attempt)
+		}
+		run := cfg.userRunFor(img, containerName(cfg.wait.parentID, suffix), containerLabels(phaseLabelUser, cfg.wait.parentID, img, cfg.idemKey))
+		code, err := runAttempt(ctx, logger, rt, run, stop)
+		if err == nil && code == 0 {
+			return nil
+		}
+		if !policy.shouldRetry(attempt, code, err) {
+			if err != nil {
+				return err
+			}
+			return &exitCodeError{code: code}
+		}
+
+		backoff := policy.backoffFor(attempt)
+		logger.Info("retrying user image", "image", img, "attempt", attempt, "exitCode", code, "error", err, "backoff", backoff.String())
+		<-cfg.wait.clock.After(backoff)
+	}
+}
+
+// userRun describes a container the second fork runs with the settings inherited from itself.
+type userRun struct {
+	img string
+	// cmd replaces the inherited command. Nil keeps the inherited command.
+	cmd []string
+	// env filters the inherited environment.
+	env envFilter
+	// entrypoint replaces the entrypoint of the image. Nil keeps the image entrypoint.
+	entrypoint []string
+	// workdir and user replace the inherited working directory and user when not empty.
+	workdir string
+	user    string
+	name    string
+	labels  map[string]string
+	// remove removes the container once it has exited and its output has been read.
+	remove bool
+}
+
+// containerName returns the name of a container waitdaemon creates for the action container parentID.
+// It returns "" when parentID is unknown, which lets the runtime pick a name.
+func containerName(parentID, suffix string) string {
+	if parentID == "" {
+		return ""
+	}
+	return "waitdaemon-" + parentID[:min(len(parentID), shortIDLength)] + "-" + suffix
+}
+
+// containerLabels returns the labels stamped on a container waitdaemon creates.
+// The idempotency key label is only set when key is not empty.
+func containerLabels(phase, parentID, img, key string) map[string]string {
+	labels := map[string]string{
+		labelPhase:  phase,
+		labelParent: parentID,
+		labelImage:  img,
+	}
+	if key != "" {
+		labels[labelKey] = key
+	}
+	return labels
+}
+
+// runAttempt runs the container once, streams its output and waits for it to exit.
+// The container is stopped when it runs longer than the stop policy allows.
+// The returned error is only set when the container could not be run or waited on.
+func runAttempt(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, run userRun, stop stopPolicy) (int, error) {
+	img := run.img
+	id, err := runUserImage(ctx, rt, run)
+	if err != nil {
 		logger.Info("unable to run user defined image", "error", err)
-		return err
+		return -1, err
 	}
 
+	// Stream the user container's output through our logger so that the
+	// second fork's logs show the whole story.
+	logsDone := streamLogs(ctx, logger, rt, id, img)
+
+	// Wait for the user container so its result is recorded in the second fork's logs and exit status.
+	if stop.timeout > 0 {
+		timer := time.AfterFunc(stop.timeout, func() { stopUserContainer(ctx, logger, rt, id, img, stop) })
+		defer timer.Stop()
+	}
+	code, err := rt.Wait(ctx, id)
+	logsDone()
+	if run.remove {
+		if rerr := rt.Remove(ctx, id); rerr != nil {
+			logger.Info("unable to remove container", "image", img, "containerID", id, "error", rerr)
+		}
+	}
+	if err != nil {
+		logger.Info("unable to wait for user container", "image", img, "containerID", id, "error", err)
+		return -1, err
+	}
+	logger.Info("user container exited", "image", img, "containerID", id, "exitCode", code)
+	return code, nil
+}
+
+// stopUserContainer stops a user container that ran longer than the stop policy allows.
+// If stopping fails, the container is killed.
+func stopUserContainer(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, id, img string, stop stopPolicy) {
+	logger.Info("user container timed out, stopping it", "image", img, "containerID", id, "timeout", stop.timeout.String(), "signal", stop.signal.String(), "killGrace", stop.grace.String())
+	err := rt.Stop(ctx, id, stop.signal, stop.grace)
+	if err == nil {
+		return
+	}
+	logger.Info("unable to stop user container, killing it", "image", img, "containerID", id, "error", err)
+	if err := rt.Kill(ctx, id, syscall.SIGKILL); err != nil {
+		logger.Info("unable to kill user container", "image", img, "containerID", id, "error", err)
+	}
+}
+
+// stopConfig holds the settings that bound how long the user container may run.
+type stopConfig struct {
+	timeout string
+	signal  string
+	grace   string
+}
+
+// stopPolicy is a parsed stopConfig. A zero timeout means no limit.
+type stopPolicy struct {
+	timeout time.Duration
+	signal  syscall.Signal
+	grace   time.Duration
+}
+
+// parse parses and validates the stop settings.
+func (sc stopConfig) parse() (stopPolicy, error) {
+	p := stopPolicy{signal: syscall.SIGTERM, grace: defaultKillGrace}
+	if sc.timeout != "" {
+		d, err := time.ParseDuration(sc.timeout)
+		if err != nil || d < 0 {
+			return stopPolicy{}, fmt.Errorf("invalid %s %q, must be a non-negative duration such as 30m", userTimeoutEnv, sc.timeout)
+		}
+		p.timeout = d
+	}
+	if sc.signal != "" {
+		sig, err := runtime.ParseSignal(sc.signal)
+		if err != nil {
+			return stopPolicy{}, fmt.Errorf("invalid %s: %w", userStopSignalEnv, err)
+		}
+		p.signal = sig
+	}
+	if sc.grace != "" {
+		d, err := time.ParseDuration(sc.grace)
+		if err != nil || d < 0 {
+			return stopPolicy{}, fmt.Errorf("invalid %s %q, must be a non-negative duration such as 10s", userKillGraceEnv, sc.grace)
+		}
+		p.grace = d
+	}
+	return p, nil
+}
+
+// retryConfig holds the settings that control rerunning a failed user container.
+type retryConfig struct {
+	retries   string
+	backoff   string
+	exitCodes string
+}
+
+// retryPolicy is a parsed retryConfig.
+type retryPolicy struct {
+	retries   int
+	backoff   time.Duration
+	exitCodes []int
+}
+
+// parse parses and validates the retry settings.
+func (rc retryConfig) parse() (retryPolicy, error) {
+	p := retryPolicy{backoff: defaultRetryBackoff}
+	if rc.retries != "" {
+		i, err := strconv.Atoi(rc.retries)
+		if err != nil || i < 0 {
+			return retryPolicy{}, fmt.Errorf("invalid %s %q, must be a non-negative number", retriesEnv, rc.retries)
+		}
+		p.retries = i
+	}
+	if rc.backoff != "" {
+		d, err := time.ParseDuration(rc.backoff)
+		if err != nil || d < 0 {
+			return retryPolicy{}, fmt.Errorf("invalid %s %q, must be a non-negative duration such as 10s", retryBackoffEnv, rc.backoff)
+		}
+		p.backoff = d
+	}
+	if rc.exitCodes != "" {
+		for _, s := range strings.Split(rc.exitCodes, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || code == 0 {
+				return retryPolicy{}, fmt.Errorf("invalid %s %q, must be a comma separated list of non-zero exit codes", retryOnExitCodesEnv, rc.exitCodes)
+			}
+			p.exitCodes = append(p.exitCodes, code)
+		}
+	}
+	return p, nil
+}
+
+// shouldRetry reports whether the user container should be run again after the given attempt failed.
+// Failures to run or wait on the container are always retried; exit codes are retried when they match exitCodes.
+func (p retryPolicy) shouldRetry(attempt, code int, err error) bool {
+	if attempt > p.retries {
+		return false
+	}
+	if err != nil || len(p.exitCodes) == 0 {
+		return true
+	}
+	return slices.Contains(p.exitCodes, code)
+}
+
+// backoffFor returns the delay after the given attempt. It doubles with every attempt, up to maxRetryBackoff.
+func (p retryPolicy) backoffFor(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// waitConfig holds the settings that control how long the second fork waits before running the user image.
+type waitConfig struct {
+	seconds  string
+	waitFor  string
+	mode     string
+	grace    string
+	parentID string
+	runAt    string
+	winStart string
+	winEnd   string
+	winDays  string
+	jitter   string
+	clock    schedule.Clock
+}
+
+// schedule parses the scheduling settings.
+func (wc waitConfig) schedule() (schedule.Schedule, error) {
+	return schedule.Parse(wc.runAt, wc.winStart, wc.winEnd, wc.winDays, wc.jitter)
+}
+
+// validate reports whether the wait settings are valid.
+func (wc waitConfig) validate() error {
+	switch wc.mode {
+	case "", waitModeSleep, waitModeParentExit:
+	default:
+		return fmt.Errorf("invalid %s %q, must be %q or %q", waitModeEnv, wc.mode, waitModeSleep, waitModeParentExit)
+	}
+	if wc.grace != "" {
+		if i, err := strconv.Atoi(wc.grace); err != nil || i < 0 {
+			return fmt.Errorf("invalid %s %q, must be a non-negative number of seconds", waitGraceEnv, wc.grace)
+		}
+	}
+	if wc.waitFor != "" {
+		if _, err := waitfor.Parse(wc.waitFor, waitfor.Env{}); err != nil {
+			return fmt.Errorf("parsing %s: %w", waitForEnv, err)
+		}
+	}
+	sched, err := wc.schedule()
+	if err != nil {
+		return fmt.Errorf("parsing schedule: %w", err)
+	}
+	if !sched.RunAt.IsZero() && sched.RunAt.Before(wc.clock.Now()) {
+		return fmt.Errorf("invalid %s %q, must be in the future", runAtEnv, wc.runAt)
+	}
 	return nil
 }
 
-func runUserImage(ctx context.Context, rt runtime.Runtime, img string) error {
+// wait blocks until it is time to run the user image.
+// The parent-exit or WAIT_FOR wait happens first. A run time or maintenance window then replaces
+// the fixed wait time; jitter alone is added on top of whichever wait happened.
+func wait(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, wc waitConfig) {
+	waited := false
+	if wc.mode == waitModeParentExit {
+		waited = waitForParent(ctx, logger, rt, wc)
+	} else if wc.waitFor != "" {
+		waitForCondition(ctx, logger, wc.waitFor)
+		waited = true
+	}
+
+	sched, err := wc.schedule()
+	if err != nil {
+		// The first fork validated the schedule, so this should not happen.
+		logger.Info("unable to parse schedule, ignoring it", "error", err)
+		sched = schedule.Schedule{}
+	}
+
+	if !waited && !sched.HasRunTime() {
+		if wc.mode == waitModeParentExit {
+			logger.Info("falling back to waiting a fixed time")
+		}
+		t := defaultWaitTime
+		if s := wc.seconds; s != "" {
+			if i, err := strconv.Atoi(s); err == nil {
+				t = time.Duration(i) * time.Second
+			}
+		}
+		logger.Info("waiting before running user image", "waitSeconds", t.String())
+		<-wc.clock.After(t)
+	}
+
+	if !sched.IsZero() {
+		next := sched.Next(wc.clock.Now(), schedule.RandomJitter)
+		logger.Info("waiting for scheduled time before running user image", "runAt", next.Format(time.RFC3339), "jitterSeconds", int(sched.Jitter.Seconds()))
+		if err := schedule.SleepUntil(ctx, wc.clock, next); err != nil {
+			logger.Info("unable to wait for scheduled time", "error", err)
+		}
+	}
+}
+
+// waitForParent blocks until the first fork container exits and then waits the grace period.
+// It reports false when the first fork container could not be waited on.
+func waitForParent(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, wc waitConfig) bool {
+	if wc.parentID == "" {
+		logger.Info("first fork container ID is unknown, unable to wait for it to exit")
+		return false
+	}
+	logger.Info("waiting for first fork container to exit", "containerID", wc.parentID)
+	if err := rt.WaitForExit(ctx, wc.parentID); err != nil {
+		logger.Info("unable to wait for first fork container to exit", "containerID", wc.parentID, "error", err)
+		return false
+	}
+
+	grace, _ := strconv.Atoi(wc.grace)
+	logger.Info("first fork container exited, waiting grace period", "containerID", wc.parentID, "graceSeconds", grace)
+	<-wc.clock.After(time.Duration(grace) * time.Second)
+	return true
+}
+
+// waitForCondition blocks until the WAIT_FOR condition is met.
+// A condition that times out or fails is logged and the user image is run anyway,
+// the same as when a fixed wait time elapses.
+func waitForCondition(ctx context.Context, logger *slog.Logger, expr string) {
+	cond, err := waitfor.Parse(expr, waitfor.Env{})
+	if err != nil {
+		// The first fork validated the expression, so this should not happen.
+		logger.Info("unable to parse wait condition, not waiting", "waitFor", expr, "error", err)
+		return
+	}
+	logger.Info("waiting for condition before running user image", "waitFor", cond.String())
+	start := time.Now()
+	if err := cond.Wait(ctx); err != nil {
+		logger.Info("wait condition not met, running user image anyway", "waitFor", cond.String(), "elapsed", time.Since(start).String(), "error", err)
+		return
+	}
+	logger.Info("wait condition met", "waitFor", cond.String(), "elapsed", time.Since(start).String())
+}
+
+// runUserImage runs the container with the settings inherited from this container.
+// A nil run.cmd keeps the inherited command, without the waitdaemon binary.
+func runUserImage(ctx context.Context, rt runtime.Runtime, run userRun) (string, error) {
 	info, err := rt.InspectSelf(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
-	info.Image = img
+	info.Image = run.img
+	info.Name = run.name
+	info.Labels = run.labels
 
-	// Strip the waitdaemon binary from the command.
-	// The inspected Cmd is [/waitdaemon, user-cmd...], but the user image
-	// doesn't have waitdaemon, so we pass only the user's command.
-	if len(info.Cmd) > 1 && info.Cmd[0] == os.Args[0] {
-		info.Cmd = info.Cmd[1:]
+	// The inspected Entrypoint is waitdaemon's own, which the user image doesn't have.
+	// Cmd holds only the user's command, which is passed on as written.
+	info.Entrypoint = run.entrypoint
+	if run.cmd != nil {
+		info.Cmd = run.cmd
+	}
+	if run.workdir != "" {
+		info.WorkingDir = run.workdir
+	}
+	if run.user != "" {
+		info.User = run.user
 	}
 
-	// remove the PATH env var from the User container so that we don't override the existing PATH
-	info.Env = stripEnv(info.Env, "PATH")
+	// Remove waitdaemon's own variables, including PATH so that we don't override the existing PATH.
+	info.Env = run.env.apply(info.Env)
 
 	return rt.RunContainer(ctx, info)
 }
 
+// streamLogs streams the stdout and stderr of the container with the given ID
+// through logger in the background. The returned function waits for the stream to
+// finish, giving up after logDrainTimeout, and must be called after the container exits.
+func streamLogs(ctx context.Context, logger *slog.Logger, rt runtime.Runtime, id, img string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	stdout := &lineLogger{logger: logger.With("image", img, "stream", "stdout")}
+	stderr := &lineLogger{logger: logger.With("image", img, "stream", "stderr")}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := rt.Logs(ctx, id, stdout, stderr); err != nil && ctx.Err() == nil {
+			logger.Info("unable to stream user container logs", "image", img, "containerID", id, "error", err)
+		}
+		stdout.flush()
+		stderr.flush()
+	}()
+
+	return func() {
+		defer cancel()
+		select {
+		case <-done:
+		case <-time.After(logDrainTimeout):
+			logger.Info("timed out waiting for user container logs", "image", img, "containerID", id)
+		}
+	}
+}
+
+// lineLogger is an io.Writer that logs every line written to it.
+type lineLogger struct {
+	logger *slog.Logger
+	buf    []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		line, rest, found := bytes.Cut(l.buf, []byte{'\n'})
+		if !found {
+			break
+		}
+		l.logger.Info("user container output", "line", string(bytes.TrimSuffix(line, []byte{'\r'})))
+		l.buf = rest
+	}
+	return len(p), nil
+}
+
+// flush logs any remaining partial line.
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		l.logger.Info("user container output", "line", string(l.buf))
+		l.buf = nil
+	}
+}
+
+// exitCodeError reports that the user container exited with a non-zero exit code.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("user container exited with code %d", e.code)
+}
+
+// getenv returns the value of the setting key, preferring the variable with waitdaemonEnvPrefix.
+func getenv(key string) string {
+	if v, ok := os.LookupEnv(waitdaemonEnvPrefix + key); ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// reservedEnvs are the variables that are not passed on to the user container unless allowed.
+// PATH is included so that the user image's PATH is used.
+var reservedEnvs = []string{ //nolint:gochecknoglobals // lookup table.
+	"PATH", phaseEnv, imageEnv, waitTimeEnv, waitForEnv, waitModeEnv, waitGraceEnv, runAtEnv,
+	windowStartEnv, windowEndEnv, windowDaysEnv, jitterEnv, retriesEnv, retryBackoffEnv, retryOnExitCodesEnv,
+	onFailureImageEnv, onFailureCommandEnv, userTimeoutEnv, userStopSignalEnv, userKillGraceEnv,
+	userEntrypointEnv, userWorkdirEnv, userUserEnv, envAllowEnv, envDenyEnv, autoRemoveEnv,
+	idempotencyKeyEnv, idempotencyPolicyEnv, parentIDEnv, nonceEnv, runtimeEnv, nerdctlNamespaceEnv,
+	containerdAddressEnv, containerdSnapshotterEnv, podmanSocketEnv, criEndpointEnv, nerdctlHostEnv,
+	registryConfigEnv, registryAuthEnv, registryAuthFileEnv, pullPolicyEnv,
+}
+
+// reservedEnvPatterns are the path.Match patterns of the variables that are not passed on to the
+// user container unless allowed, besides reservedEnvs: the prefixed settings and the variables
+// that configure the nerdctl and containerd clients.
+var reservedEnvPatterns = []string{ //nolint:gochecknoglobals // lookup table.
+	waitdaemonEnvPrefix + "*", "NERDCTL_*", "CONTAINERD_*",
+}
+
+// envConfig holds the settings that control the environment of the user container.
+type envConfig struct {
+	allow string
+	deny  string
+}
+
+// envFilter is a parsed envConfig.
+type envFilter struct {
+	allow []string
+	deny  []string
+}
+
+// parse parses and validates the env settings.
+func (ec envConfig) parse() (envFilter, error) {
+	allow, err := parsePatterns(envAllowEnv, ec.allow)
+	if err != nil {
+		return envFilter{}, err
+	}
+	deny, err := parsePatterns(envDenyEnv, ec.deny)
+	if err != nil {
+		return envFilter{}, err
+	}
+	return envFilter{allow: allow, deny: deny}, nil
+}
+
+// parsePatterns parses the comma separated path.Match patterns of the setting name.
+func parsePatterns(name, value string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", name, p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// apply returns envs without the reserved and denied variables, and with userEnvPrefix removed
+// from the names of prefixed variables. Renamed variables are never removed.
+func (f envFilter) apply(envs []string) []string {
+	result := make([]string, 0, len(envs))
+	var renamed []string
+	for _, env := range envs {
+		key, _, _ := strings.Cut(env, "=")
+		switch {
+		case strings.HasPrefix(key, userEnvPrefix) && key != userEnvPrefix:
+			renamed = append(renamed, strings.TrimPrefix(env, userEnvPrefix))
+		case matchEnv(f.deny, key):
+		case (slices.Contains(reservedEnvs, key) || matchEnv(reservedEnvPatterns, key)) && !matchEnv(f.allow, key):
+		default:
+			result = append(result, env)
+		}
+	}
+	for _, env := range renamed {
+		key, _, _ := strings.Cut(env, "=")
+		result = append(stripEnv(result, key), env)
+	}
+	return result
+}
+
+// matchEnv reports whether key matches any of the patterns.
+func matchEnv(patterns []string, key string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		ok, _ := path.Match(p, key)
+		return ok
+	})
+}
+
 // nsenterEnabled reports whether the NERDCTL_HOST env var is set to a truthy value.
 // When the variable is unset (empty), it defaults to true.
 func nsenterEnabled() bool {
-	v := strings.ToLower(os.Getenv(nerdctlHostEnv))
+	v := strings.ToLower(getenv(nerdctlHostEnv))
 	if v == "" {
 		return true
 	}
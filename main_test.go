@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+// waitFails is an exit code that makes fakeRuntime.Wait return an error.
+const waitFails = -1
+
+// fakeRuntime is a runtime.Runtime that records the containers it runs.
+type fakeRuntime struct {
+	mu sync.Mutex
+	// self is returned by InspectSelf.
+	self runtime.ContainerInfo
+	// exitCodes are returned by Wait in order; the last one repeats.
+	exitCodes []int
+	// runs are the containers passed to RunContainer.
+	runs []runtime.ContainerInfo
+	// stopped, when set, makes Wait block until Stop or Kill is called.
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// stopErr is returned by Stop.
+	stopErr error
+	// containers are returned by List when their labels match.
+	containers []runtime.Container
+	// image is returned by ImageExists when imageExists is set.
+	image       runtime.ImageInfo
+	imageExists bool
+	// pulled replaces image after PullImage, unless pullErr is set.
+	pulled  runtime.ImageInfo
+	pullErr error
+	// calls are the Stop, Kill, Remove and PullImage calls.
+	calls []string
+}
+
+func (f *fakeRuntime) InspectSelf(context.Context) (runtime.ContainerInfo, error) {
+	return f.self, nil
+}
+
+func (f *fakeRuntime) RunContainer(_ context.Context, info runtime.ContainerInfo) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, info)
+	return info.Name, nil
+}
+
+func (f *fakeRuntime) Wait(context.Context, string) (int, error) {
+	if f.stopped != nil {
+		<-f.stopped
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code := f.exitCodes[min(len(f.runs), len(f.exitCodes))-1]
+	if code == waitFails {
+		return -1, errors.New("wait failed")
+	}
+	return code, nil
+}
+
+func (f *fakeRuntime) WaitForExit(context.Context, string) error { return nil }
+
+func (f *fakeRuntime) Stop(_ context.Context, id string, signal syscall.Signal, timeout time.Duration) error {
+	f.record(fmt.Sprintf("stop %s %s %s", id, signal, timeout))
+	if f.stopErr != nil {
+		return f.stopErr
+	}
+	f.exited()
+	return nil
+}
+
+func (f *fakeRuntime) Kill(_ context.Context, id string, signal syscall.Signal) error {
+	f.record(fmt.Sprintf("kill %s %s", id, signal))
+	f.exited()
+	return nil
+}
+
+func (f *fakeRuntime) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+// exited unblocks Wait.
+func (f *fakeRuntime) exited() {
+	if f.stopped != nil {
+		f.stopOnce.Do(func() { close(f.stopped) })
+	}
+}
+
+func (f *fakeRuntime) List(_ context.Context, selector map[string]string) ([]runtime.Container, error) {
+	var cons []runtime.Container
+	for _, c := range f.containers {
+		if runtime.MatchLabels(c.Labels, selector) {
+			cons = append(cons, c)
+		}
+	}
+	return cons, nil
+}
+
+func (f *fakeRuntime) Remove(_ context.Context, id string) error {
+	f.record("remove " + id)
+	return nil
+}
+
+func (f *fakeRuntime) Logs(context.Context, string, io.Writer, io.Writer) error { return nil }
+
+func (f *fakeRuntime) ImageExists(context.Context, string) (runtime.ImageInfo, bool) {
+	return f.image, f.imageExists
+}
+
+func (f *fakeRuntime) PullImage(_ context.Context, imageRef string, _ runtime.RegistryAuth) error {
+	f.record("pull " + imageRef)
+	if f.pullErr != nil {
+		return f.pullErr
+	}
+	f.image, f.imageExists = f.pulled, true
+	return nil
+}
+
+func (f *fakeRuntime) Close() error { return nil }
+
+// fakeClock is a Clock at a fixed time whose After records the duration and fires at once.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.slept = append(c.slept, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+// discardLogger returns a logger that drops everything.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
+
+func TestEnvFilterApply(t *testing.T) {
+	envs := []string{
+		"PATH=/usr/bin",
+		"IMAGE=alpine",
+		"WAITDAEMON_IMAGE=ubuntu",
+		"NERDCTL_NAMESPACE=tinkerbell",
+		"NERDCTL_TOML=/etc/nerdctl/nerdctl.toml",
+		"CONTAINERD_SNAPSHOTTER=overlayfs",
+		"REGISTRY_AUTH=secret",
+		"DEBUG=1",
+		"SECRET_TOKEN=x",
+		"USER_ENV_IMAGE=debian",
+	}
+	tests := map[string]struct {
+		cfg  envConfig
+		want []string
+	}{
+		"reserved names and patterns": {
+			want: []string{"DEBUG=1", "SECRET_TOKEN=x", "IMAGE=debian"},
+		},
+		"allowed": {
+			cfg:  envConfig{allow: "NERDCTL_*, WAITDAEMON_IMAGE, REGISTRY_AUTH"},
+			want: []string{"WAITDAEMON_IMAGE=ubuntu", "NERDCTL_NAMESPACE=tinkerbell", "NERDCTL_TOML=/etc/nerdctl/nerdctl.toml", "REGISTRY_AUTH=secret", "DEBUG=1", "SECRET_TOKEN=x", "IMAGE=debian"},
+		},
+		"denied wins over allowed": {
+			cfg:  envConfig{allow: "NERDCTL_*", deny: "SECRET_*,NERDCTL_TOML"},
+			want: []string{"NERDCTL_NAMESPACE=tinkerbell", "DEBUG=1", "IMAGE=debian"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, err := tt.cfg.parse()
+			if err != nil {
+				t.Fatalf("parse() error = %v", err)
+			}
+			if got := f.apply(envs); !slices.Equal(got, tt.want) {
+				t.Errorf("apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWithRetries(t *testing.T) {
+	tests := map[string]struct {
+		retry     retryConfig
+		exitCodes []int
+		wantRuns  int
+		wantSlept []time.Duration
+		// wantCode is the exit code of the returned exitCodeError; 0 means no error and waitFails a Wait error.
+		wantCode int
+	}{
+		"success": {
+			exitCodes: []int{0},
+			wantRuns:  1,
+		},
+		"no retries": {
+			exitCodes: []int{1},
+			wantRuns:  1,
+			wantCode:  1,
+		},
+		"success after retries": {
+			retry:     retryConfig{retries: "3", backoff: "10s"},
+			exitCodes: []int{1, 2, 0},
+			wantRuns:  3,
+			wantSlept: []time.Duration{10 * time.Second, 20 * time.Second},
+		},
+		"retries used up": {
+			retry:     retryConfig{retries: "2"},
+			exitCodes: []int{1},
+			wantRuns:  3,
+			wantSlept: []time.Duration{defaultRetryBackoff, 2 * defaultRetryBackoff},
+			wantCode:  1,
+		},
+		"backoff capped": {
+			retry:     retryConfig{retries: "3", backoff: "3m"},
+			exitCodes: []int{1},
+			wantRuns:  4,
+			wantSlept: []time.Duration{3 * time.Minute, maxRetryBackoff, maxRetryBackoff},
+			wantCode:  1,
+		},
+		"matching exit code": {
+			retry:     retryConfig{retries: "2", backoff: "0s", exitCodes: "2, 3"},
+			exitCodes: []int{3, 2, 0},
+			wantRuns:  3,
+			wantSlept: []time.Duration{0, 0},
+		},
+		"exit code not matching": {
+			retry:     retryConfig{retries: "2", exitCodes: "2,3"},
+			exitCodes: []int{3, 4},
+			wantRuns:  2,
+			wantSlept: []time.Duration{defaultRetryBackoff},
+			wantCode:  4,
+		},
+		"wait failure retried despite exit codes": {
+			retry:     retryConfig{retries: "1", backoff: "1s", exitCodes: "2"},
+			exitCodes: []int{waitFails, 0},
+			wantRuns:  2,
+			wantSlept: []time.Duration{time.Second},
+		},
+		"wait failure": {
+			exitCodes: []int{waitFails},
+			wantRuns:  1,
+			wantCode:  waitFails,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := &fakeRuntime{exitCodes: tt.exitCodes}
+			clock := &fakeClock{}
+			cfg := config{img: "alpine", retry: tt.retry, wait: waitConfig{parentID: "0123456789abcdef", clock: clock}}
+
+			err := runWithRetries(context.Background(), discardLogger(), rt, cfg, stopPolicy{})
+			var exitErr *exitCodeError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Errorf("runWithRetries() error = %v, want nil", err)
+			case tt.wantCode == waitFails && (err == nil || errors.As(err, &exitErr)):
+				t.Errorf("runWithRetries() error = %v, want the wait error", err)
+			case tt.wantCode > 0 && (!errors.As(err, &exitErr) || exitErr.code != tt.wantCode):
+				t.Errorf("runWithRetries() error = %v, want exit code %d", err, tt.wantCode)
+			}
+			if len(rt.runs) != tt.wantRuns {
+				t.Errorf("runWithRetries() ran %d containers, want %d", len(rt.runs), tt.wantRuns)
+			}
+			if !slices.Equal(clock.slept, tt.wantSlept) {
+				t.Errorf("runWithRetries() backed off %v, want %v", clock.slept, tt.wantSlept)
+			}
+			// Every attempt gets its own container name so they don't collide.
+			names := map[string]bool{}
+			for _, r := range rt.runs {
+				names[r.Name] = true
+			}
+			if len(names) != len(rt.runs) {
+				t.Errorf("runWithRetries() reused container names: %v", names)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := map[string]struct {
+		policy  retryPolicy
+		attempt int
+		code    int
+		err     error
+		want    bool
+	}{
+		"no retries":                  {attempt: 1, code: 1, want: false},
+		"retry left":                  {policy: retryPolicy{retries: 2}, attempt: 2, code: 1, want: true},
+		"retries used up":             {policy: retryPolicy{retries: 2}, attempt: 3, code: 1, want: false},
+		"matching exit code":          {policy: retryPolicy{retries: 1, exitCodes: []int{2, 3}}, attempt: 1, code: 3, want: true},
+		"exit code not matching":      {policy: retryPolicy{retries: 1, exitCodes: []int{2, 3}}, attempt: 1, code: 1, want: false},
+		"error ignores exit codes":    {policy: retryPolicy{retries: 1, exitCodes: []int{2}}, attempt: 1, code: -1, err: errors.New("boom"), want: true},
+		"error with no retries left":  {policy: retryPolicy{retries: 1}, attempt: 2, code: -1, err: errors.New("boom"), want: false},
+		"any exit code without codes": {policy: retryPolicy{retries: 1}, attempt: 1, code: 137, want: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.policy.shouldRetry(tt.attempt, tt.code, tt.err); got != tt.want {
+				t.Errorf("shouldRetry(%d, %d, %v) = %v, want %v", tt.attempt, tt.code, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffFor(t *testing.T) {
+	tests := map[string]struct {
+		backoff time.Duration
+		want    []time.Duration
+	}{
+		"doubles":    {backoff: 10 * time.Second, want: []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second}},
+		"capped":     {backoff: 2 * time.Minute, want: []time.Duration{2 * time.Minute, 4 * time.Minute, maxRetryBackoff, maxRetryBackoff}},
+		"above cap":  {backoff: time.Hour, want: []time.Duration{maxRetryBackoff, maxRetryBackoff}},
+		"no backoff": {want: []time.Duration{0, 0, 0}},
+		"many tries": {backoff: time.Second, want: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, 64 * time.Second, 128 * time.Second, 256 * time.Second, maxRetryBackoff}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := retryPolicy{backoff: tt.backoff}
+			for i, want := range tt.want {
+				if got := p.backoffFor(i + 1); got != want {
+					t.Errorf("backoffFor(%d) = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStopConfigParse(t *testing.T) {
+	tests := map[string]struct {
+		cfg     stopConfig
+		want    stopPolicy
+		wantErr bool
+	}{
+		"defaults":         {want: stopPolicy{signal: syscall.SIGTERM, grace: defaultKillGrace}},
+		"all set":          {cfg: stopConfig{timeout: "30m", signal: "SIGINT", grace: "1m"}, want: stopPolicy{timeout: 30 * time.Minute, signal: syscall.SIGINT, grace: time.Minute}},
+		"signal number":    {cfg: stopConfig{signal: "9"}, want: stopPolicy{signal: syscall.SIGKILL, grace: defaultKillGrace}},
+		"zero values":      {cfg: stopConfig{timeout: "0s", grace: "0s"}, want: stopPolicy{signal: syscall.SIGTERM}},
+		"invalid timeout":  {cfg: stopConfig{timeout: "soon"}, wantErr: true},
+		"timeout number":   {cfg: stopConfig{timeout: "30"}, wantErr: true},
+		"negative timeout": {cfg: stopConfig{timeout: "-1m"}, wantErr: true},
+		"invalid signal":   {cfg: stopConfig{signal: "SIGNOPE"}, wantErr: true},
+		"invalid grace":    {cfg: stopConfig{grace: "later"}, wantErr: true},
+		"negative grace":   {cfg: stopConfig{grace: "-10s"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.cfg.parse()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopUserContainer(t *testing.T) {
+	stop := stopPolicy{timeout: time.Minute, signal: syscall.SIGINT, grace: 5 * time.Second}
+	tests := map[string]struct {
+		stopErr error
+		want    []string
+	}{
+		"stopped": {
+			want: []string{"stop c1 interrupt 5s"},
+		},
+		"killed when stopping fails": {
+			stopErr: errors.New("still running after the grace period"),
+			want:    []string{"stop c1 interrupt 5s", "kill c1 killed"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := &fakeRuntime{stopErr: tt.stopErr}
+			stopUserContainer(context.Background(), discardLogger(), rt, "c1", "alpine", stop)
+			if !slices.Equal(rt.calls, tt.want) {
+				t.Errorf("stopUserContainer() calls = %q, want %q", rt.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAttemptTimeout(t *testing.T) {
+	rt := &fakeRuntime{
+		exitCodes: []int{137},
+		stopped:   make(chan struct{}),
+		stopErr:   errors.New("still running after the grace period"),
+	}
+	stop := stopPolicy{timeout: 10 * time.Millisecond, signal: syscall.SIGTERM, grace: time.Second}
+	run := userRun{img: "alpine", name: "user"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	code, err := runAttempt(ctx, discardLogger(), rt, run, stop)
+	if err != nil || code != 137 {
+		t.Fatalf("runAttempt() = %d, %v, want 137, nil", code, err)
+	}
+	want := []string{"stop user terminated 1s", "kill user killed"}
+	if !slices.Equal(rt.calls, want) {
+		t.Errorf("runAttempt() calls = %q, want %q", rt.calls, want)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	self := runtime.ContainerInfo{Image: "waitdaemon:latest", Cmd: []string{"echo", "hello"}}
+	derived := config{img: "alpine", idemPolicy: idempotencySkip}.idempotencyKey(self)
+	if len(derived) != 16 {
+		t.Fatalf("idempotencyKey() = %q, want 16 hex characters", derived)
+	}
+
+	tests := map[string]struct {
+		cfg  config
+		self runtime.ContainerInfo
+		want string
+	}{
+		"no key or policy":  {cfg: config{img: "alpine"}, self: self, want: ""},
+		"explicit key":      {cfg: config{img: "alpine", idemKey: "provision-1"}, self: self, want: "provision-1"},
+		"key with a policy": {cfg: config{img: "alpine", idemKey: "provision-1", idemPolicy: idempotencyFail}, self: self, want: "provision-1"},
+		"derived":           {cfg: config{img: "alpine", idemPolicy: idempotencySkip}, self: self, want: derived},
+		"other policy":      {cfg: config{img: "alpine", idemPolicy: idempotencyReplace}, self: self, want: derived},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.cfg.idempotencyKey(tt.self); got != tt.want {
+				t.Errorf("idempotencyKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The derived key identifies the action, so a different user image or command is a different run.
+	others := map[string]string{
+		"image":   config{img: "ubuntu", idemPolicy: idempotencySkip}.idempotencyKey(self),
+		"command": config{img: "alpine", idemPolicy: idempotencySkip}.idempotencyKey(runtime.ContainerInfo{Image: self.Image, Cmd: []string{"echo", "bye"}}),
+		"split":   config{img: "alpine", idemPolicy: idempotencySkip}.idempotencyKey(runtime.ContainerInfo{Image: self.Image, Cmd: []string{"echo hello"}}),
+	}
+	for name, key := range others {
+		if key == derived {
+			t.Errorf("idempotencyKey() with another %s = %q, want a different key", name, key)
+		}
+	}
+}
+
+func TestGuardDuplicate(t *testing.T) {
+	containers := []runtime.Container{
+		// Run "running" is in flight: its second fork and user container are running.
+		{ID: "fork1", Running: true, Labels: map[string]string{labelPhase: phaseLabelSecondFork, labelKey: "running"}},
+		{ID: "user1", Running: true, Labels: map[string]string{labelPhase: phaseLabelUser, labelKey: "running"}},
+		// Run "done" has completed: its second fork and user container have exited.
+		{ID: "fork2", Labels: map[string]string{labelPhase: phaseLabelSecondFork, labelKey: "done"}},
+		{ID: "user2", Labels: map[string]string{labelPhase: phaseLabelUser, labelKey: "done"}},
+		// Run "orphan" only left an exited user container, e.g. after its second fork was removed.
+		{ID: "user3", Labels: map[string]string{labelPhase: phaseLabelUser, labelKey: "orphan"}},
+	}
+	tests := map[string]struct {
+		key       string
+		policy    string
+		wantSkip  bool
+		wantErr   bool
+		wantCalls []string
+	}{
+		"no matching key":       {key: "other", policy: idempotencyFail},
+		"exited without a fork": {key: "orphan", policy: idempotencyFail},
+		"skip in flight":        {key: "running", policy: idempotencySkip, wantSkip: true},
+		"skip completed":        {key: "done", policy: idempotencySkip, wantSkip: true},
+		"default policy":        {key: "done", wantSkip: true},
+		"fail in flight":        {key: "running", policy: idempotencyFail, wantErr: true},
+		"fail completed":        {key: "done", policy: idempotencyFail, wantErr: true},
+		"replace in flight": {
+			key:       "running",
+			policy:    idempotencyReplace,
+			wantCalls: []string{"stop fork1 terminated 10s", "remove fork1", "stop user1 terminated 10s", "remove user1"},
+		},
+		"replace completed": {
+			key:       "done",
+			policy:    idempotencyReplace,
+			wantCalls: []string{"remove fork2", "remove user2"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := &fakeRuntime{containers: containers}
+			skip, err := guardDuplicate(context.Background(), discardLogger(), rt, tt.key, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("guardDuplicate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if skip != tt.wantSkip {
+				t.Errorf("guardDuplicate() = %v, want %v", skip, tt.wantSkip)
+			}
+			if !slices.Equal(rt.calls, tt.wantCalls) {
+				t.Errorf("guardDuplicate() calls = %q, want %q", rt.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFork(t *testing.T) {
+	const (
+		parentID = "parent1"
+		nonce    = "0123456789abcdef0123456789abcdef"
+	)
+	forkLabels := map[string]string{labelPhase: phaseLabelSecondFork, labelParent: parentID, labelNonce: nonce, labelImage: "alpine"}
+	tests := map[string]struct {
+		selfID     string
+		containers []runtime.Container
+		parentID   string
+		nonce      string
+		wantErr    bool
+	}{
+		"valid": {
+			selfID:     "fork1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: forkLabels}},
+			parentID:   parentID,
+			nonce:      nonce,
+		},
+		"forged without labels": {
+			selfID:     "fork1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: map[string]string{}}},
+			parentID:   parentID,
+			nonce:      nonce,
+			wantErr:    true,
+		},
+		"forged without env": {
+			selfID:     "fork1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: forkLabels}},
+			wantErr:    true,
+		},
+		"wrong nonce": {
+			selfID:     "fork1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: forkLabels}},
+			parentID:   parentID,
+			nonce:      "fedcba9876543210fedcba9876543210",
+			wantErr:    true,
+		},
+		"wrong parent": {
+			selfID:     "fork1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: forkLabels}},
+			parentID:   "parent2",
+			nonce:      nonce,
+			wantErr:    true,
+		},
+		"labels on another container": {
+			selfID:     "action1",
+			containers: []runtime.Container{{ID: "fork1", Running: true, Labels: forkLabels}},
+			parentID:   parentID,
+			nonce:      nonce,
+			wantErr:    true,
+		},
+		"own parent": {
+			selfID:     parentID,
+			containers: []runtime.Container{{ID: parentID, Running: true, Labels: forkLabels}},
+			parentID:   parentID,
+			nonce:      nonce,
+			wantErr:    true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := &fakeRuntime{self: runtime.ContainerInfo{ID: tt.selfID}, containers: tt.containers}
+			err := verifySecondFork(context.Background(), rt, tt.parentID, tt.nonce)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySecondFork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunPhaseForgedSecondFork(t *testing.T) {
+	// An action that sets PHASE itself must not skip the checks of the first fork, such as the
+	// settings validation and the duplicate run guard, and must not get to run its image.
+	rt := &fakeRuntime{
+		self:       runtime.ContainerInfo{ID: "action1", Image: "waitdaemon"},
+		exitCodes:  []int{0},
+		containers: []runtime.Container{{ID: "action1", Running: true, Labels: map[string]string{"app": "forged"}}},
+	}
+	cfg := config{
+		img:        "alpine",
+		idemPolicy: "bogus",
+		wait:       waitConfig{seconds: "0", parentID: "parent1", clock: &fakeClock{}},
+	}
+	if got := runPhase(discardLogger(), rt, cfg, phaseSecondFork, "forged"); got != secondForkErrorCode {
+		t.Errorf("runPhase() = %d, want %d", got, secondForkErrorCode)
+	}
+	if len(rt.runs) != 0 {
+		t.Errorf("runPhase() ran %d containers, want none", len(rt.runs))
+	}
+
+	// The first fork rejects the same settings.
+	if got := runPhase(discardLogger(), rt, cfg, "", ""); got != firstForkErrorCode {
+		t.Errorf("runPhase() of the first fork = %d, want %d", got, firstForkErrorCode)
+	}
+	if len(rt.runs) != 0 {
+		t.Errorf("runPhase() of the first fork ran %d containers, want none", len(rt.runs))
+	}
+}
+
+func TestEnsureImage(t *testing.T) {
+	const (
+		digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		other  = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+		tagged = "alpine:3.20"
+		pinned = "alpine@" + digest
+	)
+	local := runtime.ImageInfo{ID: "sha256:1111", RepoDigests: []string{"alpine@" + digest}}
+	stale := runtime.ImageInfo{ID: "sha256:2222", RepoDigests: []string{"alpine@" + other}}
+	tests := map[string]struct {
+		img      string
+		policy   string
+		rt       *fakeRuntime
+		wantPull bool
+		wantErr  bool
+	}{
+		"always pulls an existing image":   {img: tagged, policy: pullAlways, rt: &fakeRuntime{image: stale, imageExists: true, pulled: local}, wantPull: true},
+		"always pulls a missing image":     {img: tagged, policy: pullAlways, rt: &fakeRuntime{pulled: local}, wantPull: true},
+		"always with a failing pull":       {img: tagged, policy: pullAlways, rt: &fakeRuntime{image: local, imageExists: true, pullErr: errors.New("unauthorized")}, wantPull: true, wantErr: true},
+		"if not present uses the local":    {img: tagged, policy: pullIfNotPresent, rt: &fakeRuntime{image: stale, imageExists: true}},
+		"if not present pulls missing":     {img: tagged, policy: pullIfNotPresent, rt: &fakeRuntime{pulled: local}, wantPull: true},
+		"default pulls missing":            {img: tagged, rt: &fakeRuntime{pulled: local}, wantPull: true},
+		"never uses the local":             {img: tagged, policy: pullNever, rt: &fakeRuntime{image: stale, imageExists: true}},
+		"never with a missing image":       {img: tagged, policy: pullNever, rt: &fakeRuntime{pulled: local}, wantErr: true},
+		"pinned and present":               {img: pinned, policy: pullIfNotPresent, rt: &fakeRuntime{image: local, imageExists: true}},
+		"pinned with another local digest": {img: pinned, policy: pullIfNotPresent, rt: &fakeRuntime{image: stale, imageExists: true, pulled: local}, wantPull: true},
+		"pinned never with a mismatch":     {img: pinned, policy: pullNever, rt: &fakeRuntime{image: stale, imageExists: true, pulled: local}, wantErr: true},
+		"pinned pull with a mismatch":      {img: pinned, policy: pullAlways, rt: &fakeRuntime{pulled: stale}, wantPull: true, wantErr: true},
+		"pinned pull without digests":      {img: pinned, rt: &fakeRuntime{pulled: runtime.ImageInfo{ID: "sha256:3333"}}, wantPull: true, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := config{img: tt.img, pullPolicy: tt.policy}
+			err := ensureImage(context.Background(), discardLogger(), tt.rt, tt.img, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ensureImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var want []string
+			if tt.wantPull {
+				want = []string{"pull " + tt.img}
+			}
+			if !slices.Equal(tt.rt.calls, want) {
+				t.Errorf("ensureImage() calls = %q, want %q", tt.rt.calls, want)
+			}
+		})
+	}
+}
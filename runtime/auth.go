@@ -0,0 +1,148 @@
+package runtime
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// dockerHubConfigKey is the key docker login stores Docker Hub credentials under in config.json.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// RegistryAuth are the credentials for pulling images from a registry. Without a username or an
+// identity token, images are pulled anonymously.
+type RegistryAuth struct {
+	// ServerAddress is the registry host, e.g. "ghcr.io" or "docker.io".
+	ServerAddress string
+	// Username and Password are the basic auth credentials.
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token, used instead of Username and Password.
+	IdentityToken string
+	// Helper is the credential helper a docker config.json names for ServerAddress, e.g. "ecr-login".
+	// Credential helpers are not run, so there are no credentials when it is set.
+	Helper string
+}
+
+// IsZero reports whether there are no credentials.
+func (a RegistryAuth) IsZero() bool {
+	return a.Username == "" && a.Password == "" && a.IdentityToken == ""
+}
+
+// EncodedAuth returns the credentials in the base64url encoded JSON form of the X-Registry-Auth
+// header of the Docker and Podman APIs.
+func (a RegistryAuth) EncodedAuth() (string, error) {
+	b, err := json.Marshal(map[string]string{
+		"username":      a.Username,
+		"password":      a.Password,
+		"identitytoken": a.IdentityToken,
+		"serveraddress": a.ServerAddress,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// DockerConfig returns a docker config.json document holding the credentials for ServerAddress,
+// for CLIs that read their credentials from DOCKER_CONFIG.
+func (a RegistryAuth) DockerConfig() ([]byte, error) {
+	key := a.ServerAddress
+	if key == "docker.io" {
+		key = dockerHubConfigKey
+	}
+	entry := dockerConfigAuth{IdentityToken: a.IdentityToken}
+	if a.Username != "" || a.Password != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+	}
+	return json.Marshal(dockerConfig{Auths: map[string]dockerConfigAuth{key: entry}})
+}
+
+// dockerConfig is the subset of a docker config.json that holds registry credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+}
+
+// dockerConfigAuth is a config.json credentials entry. Auth is the base64 encoded "username:password".
+type dockerConfigAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// RegistryHost returns the registry host of an image reference, e.g. "docker.io" for "alpine".
+func RegistryHost(imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", fmt.Errorf("parsing image reference %q: %w", imageRef, err)
+	}
+	return reference.Domain(named), nil
+}
+
+// ParseRegistryAuth parses the base64 encoded "username:password" form of the config.json
+// "auth" field into credentials for host.
+func ParseRegistryAuth(host, encoded string) (RegistryAuth, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return RegistryAuth{}, fmt.Errorf("decoding registry auth: %w", err)
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return RegistryAuth{}, fmt.Errorf("invalid registry auth, must be the base64 encoded username:password")
+	}
+	return RegistryAuth{ServerAddress: host, Username: user, Password: password}, nil
+}
+
+// RegistryAuthFromConfig returns the credentials for host in the docker config.json at path.
+// It returns no credentials when the file has no entry for host. Credential helpers are not
+// supported: when the file uses one for host, no credentials are returned and Helper is set.
+func RegistryAuthFromConfig(path, host string) (RegistryAuth, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return RegistryAuth{}, fmt.Errorf("reading registry config: %w", err)
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return RegistryAuth{}, fmt.Errorf("parsing registry config %q: %w", path, err)
+	}
+	for key, e := range cfg.Auths {
+		if configKeyHost(key) != host {
+			continue
+		}
+		a := RegistryAuth{ServerAddress: host, Username: e.Username, Password: e.Password, IdentityToken: e.IdentityToken}
+		if e.Auth != "" {
+			if a, err = ParseRegistryAuth(host, e.Auth); err != nil {
+				return RegistryAuth{}, fmt.Errorf("registry config %q entry %q: %w", path, key, err)
+			}
+			a.IdentityToken = e.IdentityToken
+		}
+		// docker login leaves an empty entry when the credentials are in a credential helper.
+		if !a.IsZero() {
+			return a, nil
+		}
+	}
+	if helper := cmp.Or(cfg.CredHelpers[host], cfg.CredsStore); helper != "" {
+		return RegistryAuth{ServerAddress: host, Helper: helper}, nil
+	}
+	return RegistryAuth{}, nil
+}
+
+// configKeyHost returns the registry host of a config.json auths key, which may be a
+// host or a URL such as "https://index.docker.io/v1/".
+func configKeyHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	switch key {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return key
+}
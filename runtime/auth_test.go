@@ -0,0 +1,217 @@
+package runtime_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+// basic returns the base64 encoded "username:password" form of a config.json "auth" field.
+func basic(userPassword string) string {
+	return base64.StdEncoding.EncodeToString([]byte(userPassword))
+}
+
+// writeConfig writes a docker config.json with the given content to a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	const ownerOnly = 0o600
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), ownerOnly); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseRegistryAuth(t *testing.T) {
+	got, err := runtime.ParseRegistryAuth("ghcr.io", " "+basic("user:pass:with:colons")+"\n")
+	want := runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "user", Password: "pass:with:colons"}
+	if err != nil || got != want {
+		t.Errorf("ParseRegistryAuth() = %+v, %v, want %+v", got, err, want)
+	}
+
+	for name, encoded := range map[string]string{
+		"not base64":    "not base64!",
+		"without colon": basic("user"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := runtime.ParseRegistryAuth("ghcr.io", encoded); err == nil {
+				t.Error("ParseRegistryAuth() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestRegistryAuthFromConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "`+basic("hub:hubpass")+`"},
+			"ghcr.io": {"username": "gh", "password": "ghpass"},
+			"http://registry.local:5000/v2/": {"auth": "`+basic("local:localpass")+`", "identitytoken": "token"}
+		}
+	}`)
+	tests := map[string]struct {
+		host string
+		want runtime.RegistryAuth
+	}{
+		"docker hub URL key": {
+			host: "docker.io",
+			want: runtime.RegistryAuth{ServerAddress: "docker.io", Username: "hub", Password: "hubpass"},
+		},
+		"username and password fields": {
+			host: "ghcr.io",
+			want: runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "gh", Password: "ghpass"},
+		},
+		"URL key with a port and path": {
+			host: "registry.local:5000",
+			want: runtime.RegistryAuth{ServerAddress: "registry.local:5000", Username: "local", Password: "localpass", IdentityToken: "token"},
+		},
+		"no entry": {host: "quay.io"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := runtime.RegistryAuthFromConfig(path, tt.host)
+			if err != nil || got != tt.want {
+				t.Errorf("RegistryAuthFromConfig(%q) = %+v, %v, want %+v", tt.host, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthFromConfigDockerHubAliases(t *testing.T) {
+	for _, key := range []string{"docker.io", "index.docker.io", "registry-1.docker.io", "https://index.docker.io/v1/"} {
+		t.Run(key, func(t *testing.T) {
+			path := writeConfig(t, `{"auths": {"`+key+`": {"auth": "`+basic("hub:hubpass")+`"}}}`)
+			got, err := runtime.RegistryAuthFromConfig(path, "docker.io")
+			if err != nil || got.Username != "hub" {
+				t.Errorf("RegistryAuthFromConfig() = %+v, %v, want the docker.io credentials", got, err)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthFromConfigHelpers(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		want    runtime.RegistryAuth
+	}{
+		"credential store": {
+			content: `{"auths": {"ghcr.io": {}}, "credsStore": "desktop"}`,
+			want:    runtime.RegistryAuth{ServerAddress: "ghcr.io", Helper: "desktop"},
+		},
+		"credential helper": {
+			content: `{"credsStore": "desktop", "credHelpers": {"ghcr.io": "gcloud", "quay.io": "quay"}}`,
+			want:    runtime.RegistryAuth{ServerAddress: "ghcr.io", Helper: "gcloud"},
+		},
+		"helper of another registry": {
+			content: `{"credHelpers": {"quay.io": "quay"}}`,
+		},
+		"credentials win over a helper": {
+			content: `{"auths": {"ghcr.io": {"auth": "` + basic("gh:ghpass") + `"}}, "credsStore": "desktop"}`,
+			want:    runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "gh", Password: "ghpass"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := runtime.RegistryAuthFromConfig(writeConfig(t, tt.content), "ghcr.io")
+			if err != nil || got != tt.want {
+				t.Errorf("RegistryAuthFromConfig() = %+v, %v, want %+v", got, err, tt.want)
+			}
+			if !got.IsZero() && got.Helper != "" {
+				t.Errorf("RegistryAuthFromConfig() = %+v, want no credentials with a helper", got)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthFromConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"invalid JSON": `{"auths": `,
+		"invalid auth": `{"auths": {"ghcr.io": {"auth": "` + basic("nocolon") + `"}}}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := runtime.RegistryAuthFromConfig(writeConfig(t, content), "ghcr.io"); err == nil {
+				t.Error("RegistryAuthFromConfig() error = nil, want an error")
+			}
+		})
+	}
+
+	if _, err := runtime.RegistryAuthFromConfig(filepath.Join(t.TempDir(), "missing.json"), "ghcr.io"); err == nil {
+		t.Error("RegistryAuthFromConfig() of a missing file error = nil, want an error")
+	}
+}
+
+func TestDockerConfig(t *testing.T) {
+	tests := map[string]struct {
+		auth    runtime.RegistryAuth
+		wantKey string
+	}{
+		"basic auth":     {auth: runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "gh", Password: "ghpass"}, wantKey: "ghcr.io"},
+		"docker hub":     {auth: runtime.RegistryAuth{ServerAddress: "docker.io", Username: "hub", Password: "hubpass"}, wantKey: "https://index.docker.io/v1/"},
+		"identity token": {auth: runtime.RegistryAuth{ServerAddress: "ghcr.io", IdentityToken: "token"}, wantKey: "ghcr.io"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := tt.auth.DockerConfig()
+			if err != nil {
+				t.Fatalf("DockerConfig() error = %v", err)
+			}
+			var cfg struct {
+				Auths map[string]json.RawMessage `json:"auths"`
+			}
+			if err := json.Unmarshal(b, &cfg); err != nil {
+				t.Fatalf("DockerConfig() = %s, not JSON: %v", b, err)
+			}
+			if _, ok := cfg.Auths[tt.wantKey]; !ok || len(cfg.Auths) != 1 {
+				t.Errorf("DockerConfig() = %s, want a single entry for %q", b, tt.wantKey)
+			}
+
+			// The CLIs read the file the same way RegistryAuthFromConfig does.
+			got, err := runtime.RegistryAuthFromConfig(writeConfig(t, string(b)), tt.auth.ServerAddress)
+			if err != nil || got != tt.auth {
+				t.Errorf("RegistryAuthFromConfig(DockerConfig()) = %+v, %v, want %+v", got, err, tt.auth)
+			}
+		})
+	}
+}
+
+func TestEncodedAuth(t *testing.T) {
+	auth := runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "gh", Password: "p+/=ss"}
+	encoded, err := auth.EncodedAuth()
+	if err != nil {
+		t.Fatalf("EncodedAuth() error = %v", err)
+	}
+	b, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("EncodedAuth() = %q, not base64url: %v", encoded, err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("EncodedAuth() = %s, not JSON: %v", b, err)
+	}
+	if got["username"] != "gh" || got["password"] != "p+/=ss" || got["serveraddress"] != "ghcr.io" {
+		t.Errorf("EncodedAuth() = %s, want the credentials of %+v", b, auth)
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := map[string]string{
+		"alpine":                     "docker.io",
+		"library/alpine:3.20":        "docker.io",
+		"ghcr.io/tinkerbell/actions": "ghcr.io",
+		"localhost:5000/image@sha256:" + strings.Repeat("a", 64): "localhost:5000",
+	}
+	for ref, want := range tests {
+		if got, err := runtime.RegistryHost(ref); err != nil || got != want {
+			t.Errorf("RegistryHost(%q) = %q, %v, want %q", ref, got, err, want)
+		}
+	}
+	if _, err := runtime.RegistryHost("Invalid Reference"); err == nil {
+		t.Error("RegistryHost() of an invalid reference error = nil, want an error")
+	}
+}
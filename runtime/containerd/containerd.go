@@ -0,0 +1,864 @@
+// Package containerd implements the runtime.Runtime interface using the containerd Go client.
+// It talks to the containerd socket directly and needs neither nerdctl nor the docker CLI.
+package containerd
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultAddress is the default containerd socket path.
+	DefaultAddress = "/run/containerd/containerd.sock"
+	// LogDir is the host directory the output of created containers is written to.
+	// It must be mounted at the same path for Logs to be able to read it.
+	LogDir = "/var/log/waitdaemon"
+	// nameLabel is the label nerdctl stores container names in.
+	nameLabel = "nerdctl/name"
+	// logPollInterval is how often the log file and task state are polled while following logs.
+	logPollInterval = time.Second
+	// containerIDEnv is set to the container ID in the containers RunContainer creates. InspectSelf
+	// uses it to find them when they share the host's UTS namespace, and so its hostname.
+	containerIDEnv = "WAITDAEMON_CONTAINER_ID"
+	// minIDPrefix is the length of the short container ID nerdctl and RunContainer use as the hostname.
+	minIDPrefix = 12
+)
+
+// Containerd implements runtime.Runtime using the containerd Go client.
+type Containerd struct {
+	client *client.Client
+	// snapshotter is used for pulls and for containers whose info has no snapshotter.
+	// When empty, containerd's default snapshotter for the namespace is used.
+	snapshotter string
+}
+
+// New creates a new containerd runtime client connected to the socket at address.
+// All operations are scoped to the given containerd namespace. Images are pulled and
+// unpacked with snapshotter, or with containerd's default snapshotter when it is empty.
+func New(address, namespace, snapshotter string) (*Containerd, error) {
+	if address == "" {
+		address = DefaultAddress
+	}
+	cl, err := client.New(address, client.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to containerd at %q: %w", address, err)
+	}
+	return &Containerd{client: cl, snapshotter: snapshotter}, nil
+}
+
+// Ping checks if the containerd daemon is responsive.
+func (c *Containerd) Ping(ctx context.Context) error {
+	_, err := c.client.Version(ctx)
+	return err
+}
+
+// InspectSelf returns the container configuration for the current container.
+// nerdctl and RunContainer set the hostname to the first 12 characters of the
+// container ID, so the container is found by matching the IDs from runtime.SelfIDs
+// as an ID prefix. RunContainer also passes the ID in containerIDEnv, which works
+// when the hostname is the host's.
+func (c *Containerd) InspectSelf(ctx context.Context) (runtime.ContainerInfo, error) {
+	ids := runtime.SelfIDs()
+	if id := os.Getenv(containerIDEnv); id != "" {
+		ids = append([]string{id}, ids...)
+	}
+	return runtime.InspectFirst(ctx, ids, c.inspect)
+}
+
+// inspect returns the container configuration of the container whose ID starts with idPrefix.
+func (c *Containerd) inspect(ctx context.Context, idPrefix string) (runtime.ContainerInfo, error) {
+	con, err := c.findContainer(ctx, idPrefix)
+	if err != nil {
+		return runtime.ContainerInfo{}, err
+	}
+
+	meta, err := con.Info(ctx)
+	if err != nil {
+		return runtime.ContainerInfo{}, fmt.Errorf("getting container %q info: %w", con.ID(), err)
+	}
+	spec, err := con.Spec(ctx)
+	if err != nil {
+		return runtime.ContainerInfo{}, fmt.Errorf("getting container %q spec: %w", con.ID(), err)
+	}
+
+	info := infoFromSpec(spec)
+	info.ID = con.ID()
+	info.Image = meta.Image
+	info.Snapshotter = meta.Snapshotter
+
+	// The OCI process args are the entrypoint followed by the command. infoFromSpec
+	// reports the first argument as the entrypoint; use the image entrypoint instead
+	// when the args start with it.
+	if img, err := c.client.GetImage(ctx, meta.Image); err == nil {
+		if cfg, err := img.Spec(ctx); err == nil {
+			ep := cfg.Config.Entrypoint
+			args := append(slices.Clone(info.Entrypoint), info.Cmd...)
+			if len(ep) > 0 && len(args) >= len(ep) && slices.Equal(args[:len(ep)], ep) {
+				info.Entrypoint, info.Cmd = args[:len(ep)], args[len(ep):]
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// findContainer returns the container whose ID starts with the given prefix. A prefix
+// shorter than a short container ID, such as a hostname that is not one, is not matched.
+func (c *Containerd) findContainer(ctx context.Context, idPrefix string) (client.Container, error) {
+	if len(idPrefix) < minIDPrefix || strings.Trim(idPrefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("%q is not a container ID prefix", idPrefix)
+	}
+	cons, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	for _, con := range cons {
+		if strings.HasPrefix(con.ID(), idPrefix) {
+			return con, nil
+		}
+	}
+	return nil, fmt.Errorf("container with ID prefix %q not found", idPrefix)
+}
+
+// RunContainer creates and starts a new container with the given configuration.
+// There is no CNI setup when talking to containerd directly, so the container
+// shares the host network namespace, /etc/hosts and /etc/resolv.conf.
+func (c *Containerd) RunContainer(ctx context.Context, info runtime.ContainerInfo) (string, error) {
+	// The client resolves an empty name to containerd's default snapshotter.
+	snapshotter := cmp.Or(info.Snapshotter, c.snapshotter)
+
+	img, err := c.client.GetImage(ctx, normalizeRef(info.Image))
+	if err != nil {
+		return "", fmt.Errorf("getting image %q: %w", info.Image, err)
+	}
+	unpacked, err := img.IsUnpacked(ctx, snapshotter)
+	if err != nil {
+		return "", fmt.Errorf("checking image %q unpack state: %w", info.Image, err)
+	}
+	if !unpacked {
+		if err := img.Unpack(ctx, snapshotter); err != nil {
+			return "", fmt.Errorf("unpacking image %q: %w", info.Image, err)
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	// The image config sets the default args, working directory and user; an explicit
+	// entrypoint replaces the image entrypoint and command.
+	specOpts := []oci.SpecOpts{oci.WithImageConfigArgs(img, info.Cmd)}
+	if len(info.Entrypoint) > 0 {
+		specOpts = []oci.SpecOpts{oci.WithImageConfig(img), oci.WithProcessArgs(append(slices.Clone(info.Entrypoint), info.Cmd...)...)}
+	}
+	if info.WorkingDir != "" {
+		specOpts = append(specOpts, oci.WithProcessCwd(info.WorkingDir))
+	}
+	if info.User != "" {
+		specOpts = append(specOpts, oci.WithUser(info.User))
+	}
+	specOpts = append(specOpts,
+		oci.WithEnv(append(slices.Clone(info.Env), containerIDEnv+"="+id)),
+		oci.WithMounts(append(mountsFromBinds(info.Binds), ociMounts(info.Mounts)...)),
+		oci.WithHostNamespace(specs.NetworkNamespace),
+		oci.WithHostHostsFile,
+		oci.WithHostResolvconf,
+	)
+	// InspectSelf finds the container by its hostname, so it is the ID prefix like with nerdctl.
+	if info.UTSMode != "host" {
+		specOpts = append(specOpts, oci.WithHostname(id[:12]))
+	}
+	if info.Tty {
+		specOpts = append(specOpts, oci.WithTTY)
+	}
+	if info.Privileged {
+		specOpts = append(specOpts, oci.WithPrivileged, oci.WithAllDevicesAllowed, oci.WithHostDevices)
+	}
+	for ns, mode := range map[specs.LinuxNamespaceType]string{
+		specs.PIDNamespace:    info.PidMode,
+		specs.IPCNamespace:    info.IpcMode,
+		specs.UTSNamespace:    info.UTSMode,
+		specs.CgroupNamespace: info.CgroupnsMode,
+	} {
+		if mode == "host" {
+			specOpts = append(specOpts, oci.WithHostNamespace(ns))
+		}
+	}
+	if info.ShmSize > 0 {
+		specOpts = append(specOpts, oci.WithDevShmSize(info.ShmSize/1024)) //nolint:mnd // the size is in KiB.
+	}
+	specOpts = append(specOpts, withResources(info))
+	security, err := securitySpecOpts(info)
+	if err != nil {
+		return "", err
+	}
+	specOpts = append(specOpts, security...)
+	for _, d := range info.Devices {
+		specOpts = append(specOpts, oci.WithDevices(d.PathOnHost, d.ContainerPath(), d.Permissions()))
+	}
+	if len(info.DeviceCgroupRules) > 0 {
+		rules := make([]specs.LinuxDeviceCgroup, 0, len(info.DeviceCgroupRules))
+		for _, rule := range info.DeviceCgroupRules {
+			d, err := runtime.ParseDeviceCgroupRule(rule)
+			if err != nil {
+				return "", err
+			}
+			rules = append(rules, d)
+		}
+		specOpts = append(specOpts, withDeviceCgroupRules(rules))
+	}
+
+	// containerd has no container names; nerdctl shows this label as the name.
+	labels := maps.Clone(info.Labels)
+	if info.Name != "" {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[nameLabel] = info.Name
+	}
+
+	con, err := c.client.NewContainer(ctx, id,
+		client.WithContainerLabels(labels),
+		client.WithImage(img),
+		client.WithSnapshotter(snapshotter),
+		client.WithNewSnapshot(id, img),
+		client.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		return "", fmt.Errorf("creating container with image %q: %w", info.Image, err)
+	}
+
+	// Nothing refers to a container whose task did not start, so it and its snapshot are
+	// removed again, even when ctx is done.
+	cleanupCtx := context.WithoutCancel(ctx)
+	task, err := con.NewTask(ctx, cio.LogFile(logPath(id)))
+	if err != nil {
+		_ = con.Delete(cleanupCtx, client.WithSnapshotCleanup)
+		return "", fmt.Errorf("creating task for container %q: %w", id, err)
+	}
+	if err := task.Start(ctx); err != nil {
+		_, _ = task.Delete(cleanupCtx)
+		_ = con.Delete(cleanupCtx, client.WithSnapshotCleanup)
+		return "", fmt.Errorf("starting task for container %q: %w", id, err)
+	}
+	return id, nil
+}
+
+// Warnings reports the network settings of info, which RunContainer drops: the container
+// always shares the host network namespace, /etc/hosts and /etc/resolv.conf.
+func (c *Containerd) Warnings(info runtime.ContainerInfo) []string {
+	var warnings []string
+	if info.NetworkMode != "" && info.NetworkMode != "host" {
+		warnings = append(warnings, fmt.Sprintf("network mode %q is not supported by containerd, the host network is used", info.NetworkMode))
+	}
+	if len(info.ExtraHosts) > 0 {
+		warnings = append(warnings, fmt.Sprintf("extra hosts %q are not supported by containerd, the host's /etc/hosts is used", info.ExtraHosts))
+	}
+	if len(info.DNS) > 0 || len(info.DNSSearch) > 0 {
+		warnings = append(warnings, "DNS settings are not supported by containerd, the host's /etc/resolv.conf is used")
+	}
+	if info.AutoRemove {
+		warnings = append(warnings, "auto remove is not supported by containerd, the exited container is removed by the next waitdaemon run")
+	}
+	return warnings
+}
+
+// Wait blocks until the container's task exits and returns its exit code.
+func (c *Containerd) Wait(ctx context.Context, id string) (int, error) {
+	con, err := c.client.LoadContainer(ctx, id)
+	if err != nil {
+		return -1, fmt.Errorf("loading container %q: %w", id, err)
+	}
+	task, err := con.Task(ctx, nil)
+	if err != nil {
+		return -1, fmt.Errorf("loading task for container %q: %w", id, err)
+	}
+	statusCh, err := task.Wait(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("waiting for container %q: %w", id, err)
+	}
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case status := <-statusCh:
+		code, _, err := status.Result()
+		if err != nil {
+			return -1, fmt.Errorf("waiting for container %q: %w", id, err)
+		}
+		return int(code), nil
+	}
+}
+
+// WaitForExit blocks until the container's task exits.
+// A container or task that does not exist counts as exited.
+func (c *Containerd) WaitForExit(ctx context.Context, id string) error {
+	con, err := c.client.LoadContainer(ctx, id)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading container %q: %w", id, err)
+	}
+	task, err := con.Task(ctx, nil)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading task for container %q: %w", id, err)
+	}
+	statusCh, err := task.Wait(ctx)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("waiting for container %q: %w", id, err)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-statusCh:
+		return nil
+	}
+}
+
+// Stop sends signal to the container's task and kills it if it is still running after timeout.
+func (c *Containerd) Stop(ctx context.Context, id string, signal syscall.Signal, timeout time.Duration) error {
+	return runtime.StopWithKill(ctx, c, id, signal, timeout)
+}
+
+// Kill sends signal to the container's task.
+func (c *Containerd) Kill(ctx context.Context, id string, signal syscall.Signal) error {
+	con, err := c.client.LoadContainer(ctx, id)
+	if err != nil {
+		return fmt.Errorf("loading container %q: %w", id, err)
+	}
+	task, err := con.Task(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("loading task for container %q: %w", id, err)
+	}
+	if err := task.Kill(ctx, signal); err != nil {
+		return fmt.Errorf("sending %s to container %q: %w", unix.SignalName(signal), id, err)
+	}
+	return nil
+}
+
+// List returns the containers whose labels match selector.
+func (c *Containerd) List(ctx context.Context, selector map[string]string) ([]runtime.Container, error) {
+	// Filters passed separately are ORed, so they are joined into a single ANDed filter.
+	var filters []string
+	for _, k := range slices.Sorted(maps.Keys(selector)) {
+		if v := selector[k]; v != "" {
+			filters = append(filters, fmt.Sprintf("labels.%q==%q", k, v))
+			continue
+		}
+		filters = append(filters, fmt.Sprintf("labels.%q", k))
+	}
+	var cons []client.Container
+	var err error
+	if len(filters) > 0 {
+		cons, err = c.client.Containers(ctx, strings.Join(filters, ","))
+	} else {
+		cons, err = c.client.Containers(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	out := make([]runtime.Container, 0, len(cons))
+	for _, con := range cons {
+		labels, err := con.Labels(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting container %q labels: %w", con.ID(), err)
+		}
+		running := false
+		if task, err := con.Task(ctx, nil); err == nil {
+			if status, err := task.Status(ctx); err == nil {
+				running = status.Status != client.Stopped
+			}
+		}
+		out = append(out, runtime.Container{ID: con.ID(), Name: labels[nameLabel], Labels: labels, Running: running})
+	}
+	return out, nil
+}
+
+// Remove deletes the stopped container's task, the container, its snapshot and its log file.
+func (c *Containerd) Remove(ctx context.Context, id string) error {
+	con, err := c.client.LoadContainer(ctx, id)
+	if err != nil {
+		return fmt.Errorf("loading container %q: %w", id, err)
+	}
+	task, err := con.Task(ctx, nil)
+	switch {
+	case err == nil:
+		if _, err := task.Delete(ctx); err != nil {
+			return fmt.Errorf("deleting task for container %q: %w", id, err)
+		}
+	case !errors.Is(err, errdefs.ErrNotFound):
+		return fmt.Errorf("loading task for container %q: %w", id, err)
+	}
+	if err := con.Delete(ctx, client.WithSnapshotCleanup); err != nil {
+		return fmt.Errorf("deleting container %q: %w", id, err)
+	}
+	if err := os.Remove(logPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing log file of container %q: %w", id, err)
+	}
+	return nil
+}
+
+// Logs follows the container's log file until the container's task exits.
+// containerd writes stdout and stderr to the same file, so all output goes to stdout.
+func (c *Containerd) Logs(ctx context.Context, id string, stdout, _ io.Writer) error {
+	stopped := func(ctx context.Context) (bool, error) {
+		con, err := c.client.LoadContainer(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		task, err := con.Task(ctx, nil)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		status, err := task.Status(ctx)
+		if err != nil {
+			return false, err
+		}
+		return status.Status == client.Stopped, nil
+	}
+	return runtime.FollowFile(ctx, logPath(id), logPollInterval, stopped, func(line []byte) {
+		_, _ = stdout.Write(append(line, '\n'))
+	})
+}
+
+// ImageExists reports whether the given image reference exists locally and returns its metadata.
+// containerd stores an image under the digest of the manifest it was pulled by, which is
+// returned as both the ID and the repository digest.
+func (c *Containerd) ImageExists(ctx context.Context, imageRef string) (runtime.ImageInfo, bool) {
+	img, err := c.client.GetImage(ctx, normalizeRef(imageRef))
+	if err != nil {
+		return runtime.ImageInfo{}, false
+	}
+	digest := img.Target().Digest.String()
+	info := runtime.ImageInfo{ID: digest}
+	if named, err := reference.ParseNormalizedNamed(img.Name()); err == nil {
+		info.RepoDigests = []string{reference.TrimNamed(named).String() + "@" + digest}
+	}
+	return info, true
+}
+
+// PullImage pulls and unpacks the given image reference from a registry.
+func (c *Containerd) PullImage(ctx context.Context, imageRef string, auth runtime.RegistryAuth) error {
+	opts := []client.RemoteOpt{client.WithPullUnpack}
+	if c.snapshotter != "" {
+		opts = append(opts, client.WithPullSnapshotter(c.snapshotter))
+	}
+	if !auth.IsZero() {
+		opts = append(opts, client.WithResolver(resolver(auth)))
+	}
+	_, err := c.client.Pull(ctx, normalizeRef(imageRef), opts...)
+	return err
+}
+
+// resolver returns a resolver that sends the credentials of auth to the registry of auth.
+func resolver(auth runtime.RegistryAuth, opts ...docker.RegistryOpt) remotes.Resolver {
+	creds := func(host string) (string, string, error) {
+		// Docker Hub is served from registry-1.docker.io.
+		if host != auth.ServerAddress && (auth.ServerAddress != "docker.io" || host != "registry-1.docker.io") {
+			return "", "", nil
+		}
+		if auth.IdentityToken != "" {
+			return "", auth.IdentityToken, nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+	opts = append(opts, docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthCreds(creds))))
+	return docker.NewResolver(docker.ResolverOptions{Hosts: docker.ConfigureDefaultRegistries(opts...)})
+}
+
+// Close cleans up the containerd client resources.
+func (c *Containerd) Close() error {
+	return c.client.Close()
+}
+
+// infoFromSpec converts an OCI runtime spec to a runtime.ContainerInfo.
+// Image and Snapshotter are not part of the spec and must be filled in by the caller.
+func infoFromSpec(spec *oci.Spec) runtime.ContainerInfo {
+	var info runtime.ContainerInfo
+	if spec.Process != nil {
+		// containerIDEnv holds the ID of this container, not of the ones created from its info.
+		info.Env = slices.DeleteFunc(slices.Clone(spec.Process.Env), func(e string) bool {
+			return strings.HasPrefix(e, containerIDEnv+"=")
+		})
+		if args := spec.Process.Args; len(args) > 0 {
+			info.Entrypoint, info.Cmd = args[:1], args[1:]
+		}
+		// "/" is the OCI default working directory and root the default user.
+		if spec.Process.Cwd != "/" {
+			info.WorkingDir = spec.Process.Cwd
+		}
+		if u := spec.Process.User; u.UID != 0 || u.GID != 0 {
+			info.User = fmt.Sprintf("%d:%d", u.UID, u.GID)
+		}
+		info.Tty = spec.Process.Terminal
+		info.AttachStdout = true
+		info.AttachStderr = true
+	}
+
+	for _, m := range spec.Mounts {
+		if m.Type == runtime.MountTypeTmpfs && !isDefaultTmpfs(m.Destination) {
+			tm := runtime.Mount{Type: runtime.MountTypeTmpfs, Target: m.Destination}
+			tm.ParseMountOptions(m.Options)
+			info.Mounts = append(info.Mounts, tm)
+			continue
+		}
+		if m.Type != "bind" || isInternalMount(m.Destination) {
+			continue
+		}
+		bind := m.Source + ":" + m.Destination
+		if opts := bindOptions(m.Options); len(opts) > 0 {
+			bind += ":" + strings.Join(opts, ",")
+		}
+		info.Binds = append(info.Binds, bind)
+	}
+
+	if spec.Linux != nil {
+		// A missing namespace entry means the container shares the host namespace.
+		info.PidMode = namespaceMode(spec.Linux, specs.PIDNamespace)
+		info.IpcMode = namespaceMode(spec.Linux, specs.IPCNamespace)
+		info.UTSMode = namespaceMode(spec.Linux, specs.UTSNamespace)
+		info.CgroupnsMode = namespaceMode(spec.Linux, specs.CgroupNamespace)
+		info.Resources = runtime.ResourcesFromLinux(spec.Linux.Resources)
+		info.Sysctls = spec.Linux.Sysctl
+		// oci.WithPrivileged (used by nerdctl --privileged) clears the masked
+		// and read-only path lists, which unprivileged containers always have.
+		info.Privileged = len(spec.Linux.MaskedPaths) == 0 && len(spec.Linux.ReadonlyPaths) == 0
+		// A privileged container already gets every host device.
+		if !info.Privileged {
+			info.Devices, info.DeviceCgroupRules = devicesFromSpec(spec.Linux)
+		}
+	}
+	securityFromSpec(&info, spec)
+	if spec.Process != nil {
+		for _, rl := range spec.Process.Rlimits {
+			info.Ulimits = append(info.Ulimits, runtime.UlimitFromRlimit(rl.Type, int64(rl.Soft), int64(rl.Hard))) //nolint:gosec // limits above MaxInt64 are unlimited either way.
+		}
+	}
+	for _, m := range spec.Mounts {
+		if m.Destination == "/dev/shm" {
+			info.ShmSize = shmSize(m.Options)
+		}
+	}
+
+	return info
+}
+
+// devicesFromSpec returns the extra devices of a container and the device cgroup rules
+// that do not belong to one of its devices. The spec does not record the host path of a
+// device, so it is assumed to be the same as the container path, which is what nerdctl
+// does for "--device /dev/x". The permissions come from the device's cgroup rule.
+func devicesFromSpec(linux *specs.Linux) ([]runtime.DeviceMapping, []string) {
+	var cgroupRules []specs.LinuxDeviceCgroup
+	if linux.Resources != nil {
+		cgroupRules = linux.Resources.Devices
+	}
+	matches := func(rule specs.LinuxDeviceCgroup, d specs.LinuxDevice) bool {
+		return rule.Allow && rule.Type == d.Type && rule.Major != nil && *rule.Major == d.Major &&
+			rule.Minor != nil && *rule.Minor == d.Minor
+	}
+
+	var devices []runtime.DeviceMapping
+	for _, d := range linux.Devices {
+		if runtime.IsDefaultDevice(d.Path) {
+			continue
+		}
+		m := runtime.DeviceMapping{PathOnHost: d.Path, PathInContainer: d.Path}
+		for _, rule := range cgroupRules {
+			if matches(rule, d) {
+				m.CgroupPermissions = rule.Access
+				break
+			}
+		}
+		devices = append(devices, m)
+	}
+
+	var rules []string
+	for _, rule := range cgroupRules {
+		if slices.ContainsFunc(linux.Devices, func(d specs.LinuxDevice) bool { return matches(rule, d) }) {
+			continue
+		}
+		if s, ok := runtime.FormatDeviceCgroupRule(rule); ok {
+			rules = append(rules, s)
+		}
+	}
+	return devices, rules
+}
+
+// securitySpecOpts returns the spec options for the capabilities, security options and
+// read-only rootfs of info. The user namespace mode and SELinux labels are not supported.
+// Containers created by this runtime have no seccomp filter, so only "seccomp=unconfined" is accepted.
+func securitySpecOpts(info runtime.ContainerInfo) ([]oci.SpecOpts, error) {
+	var opts []oci.SpecOpts
+	if !info.Privileged {
+		if len(info.CapAdd) > 0 {
+			opts = append(opts, oci.WithAddedCapabilities(runtime.ExpandCapabilities(info.CapAdd)))
+		}
+		if len(info.CapDrop) > 0 {
+			opts = append(opts, oci.WithDroppedCapabilities(runtime.ExpandCapabilities(info.CapDrop)))
+		}
+	}
+	sec, err := runtime.ParseSecurityOpts(info.SecurityOpt)
+	if err != nil {
+		return nil, err
+	}
+	if sec.NoNewPrivileges {
+		opts = append(opts, oci.WithNoNewPrivileges)
+	}
+	if sec.AppArmorProfile != "" && sec.AppArmorProfile != "unconfined" {
+		opts = append(opts, oci.WithApparmorProfile(sec.AppArmorProfile))
+	}
+	if sec.SeccompProfile != "" && sec.SeccompProfile != "unconfined" {
+		return nil, fmt.Errorf("seccomp profile %q is not supported by the containerd runtime", sec.SeccompProfile)
+	}
+	if info.ReadonlyRootfs {
+		opts = append(opts, oci.WithRootFSReadonly())
+	}
+	return opts, nil
+}
+
+// securityFromSpec fills in the capabilities, security options and read-only rootfs of info from spec.
+func securityFromSpec(info *runtime.ContainerInfo, spec *oci.Spec) {
+	if spec.Root != nil {
+		info.ReadonlyRootfs = spec.Root.Readonly
+	}
+	if info.Privileged || spec.Process == nil {
+		return
+	}
+	// The bounding set is filled in whichever user the process runs as, unlike the effective set.
+	if spec.Process.Capabilities != nil {
+		info.CapAdd, info.CapDrop = runtime.CapabilityChanges(spec.Process.Capabilities.Bounding)
+	}
+	if spec.Process.NoNewPrivileges {
+		info.SecurityOpt = append(info.SecurityOpt, "no-new-privileges")
+	}
+	if p := spec.Process.ApparmorProfile; p != "" && p != "nerdctl-default" {
+		info.SecurityOpt = append(info.SecurityOpt, "apparmor="+p)
+	}
+	if spec.Linux != nil && spec.Linux.Seccomp == nil {
+		info.SecurityOpt = append(info.SecurityOpt, "seccomp=unconfined")
+	}
+}
+
+// namespaceMode returns "host" when the spec has no namespace of type ns, which means
+// the container shares the host namespace, and an empty string otherwise.
+func namespaceMode(linux *specs.Linux, ns specs.LinuxNamespaceType) string {
+	if slices.ContainsFunc(linux.Namespaces, func(n specs.LinuxNamespace) bool { return n.Type == ns }) {
+		return ""
+	}
+	return "host"
+}
+
+// shmSize returns the size in bytes of a tmpfs "size=65536k" mount option, or 0 when there is none.
+func shmSize(opts []string) int64 {
+	for _, o := range opts {
+		v, ok := strings.CutPrefix(o, "size=")
+		if !ok || v == "" {
+			continue
+		}
+		unit := int64(1)
+		switch v[len(v)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			v = v[:len(v)-1]
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n * unit
+	}
+	return 0
+}
+
+// withResources sets the resource limits, ulimits and sysctls of info. It leaves the
+// device rules of the default spec alone.
+func withResources(info runtime.ContainerInfo) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if res := info.Resources.LinuxResources(); res != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			s.Linux.Resources.Memory = res.Memory
+			s.Linux.Resources.CPU = res.CPU
+			s.Linux.Resources.Pids = res.Pids
+		}
+		if len(info.Sysctls) > 0 {
+			s.Linux.Sysctl = maps.Clone(info.Sysctls)
+		}
+		if len(info.Ulimits) > 0 && s.Process != nil {
+			s.Process.Rlimits = nil
+			for _, u := range info.Ulimits {
+				s.Process.Rlimits = append(s.Process.Rlimits, specs.POSIXRlimit{
+					Type: u.RlimitType(),
+					Hard: uint64(u.Hard), //nolint:gosec // -1 wraps to unlimited.
+					Soft: uint64(u.Soft), //nolint:gosec // -1 wraps to unlimited.
+				})
+			}
+		}
+		return nil
+	}
+}
+
+// withDeviceCgroupRules adds allow rules to the device cgroup of the container.
+func withDeviceCgroupRules(rules []specs.LinuxDeviceCgroup) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		s.Linux.Resources.Devices = append(s.Linux.Resources.Devices, rules...)
+		return nil
+	}
+}
+
+// mountsFromBinds converts "host:container[:opts]" bind strings to OCI bind mounts.
+func mountsFromBinds(binds []string) []specs.Mount {
+	mounts := make([]specs.Mount, 0, len(binds))
+	for _, b := range binds {
+		parts := strings.SplitN(b, ":", 3) //nolint:mnd // source, destination, options.
+		if len(parts) < 2 {                //nolint:mnd // source and destination are required.
+			continue
+		}
+		opts := []string{"rbind"}
+		if len(parts) == 3 { //nolint:mnd // options are present.
+			opts = append(opts, strings.Split(parts[2], ",")...)
+		}
+		mounts = append(mounts, specs.Mount{
+			Type:        "bind",
+			Source:      parts[0],
+			Destination: parts[1],
+			Options:     opts,
+		})
+	}
+	return mounts
+}
+
+// ociMounts converts bind and tmpfs mounts to OCI mounts. containerd has no volumes,
+// so volume mounts are skipped; nerdctl volumes show up as binds of their data directory.
+// There is no SELinux relabeling, so the relabel option is not used.
+func ociMounts(mounts []runtime.Mount) []specs.Mount {
+	var out []specs.Mount
+	for _, m := range mounts {
+		switch m.Type {
+		case runtime.MountTypeBind:
+			opts := []string{"rbind"}
+			if m.ReadOnly {
+				opts = append(opts, "ro")
+			}
+			if m.Propagation != "" {
+				opts = append(opts, m.Propagation)
+			}
+			out = append(out, specs.Mount{Type: "bind", Source: m.Source, Destination: m.Target, Options: append(opts, m.Options...)})
+		case runtime.MountTypeTmpfs:
+			opts := m.AllOptions()
+			if len(opts) == 0 {
+				// The default options of docker and nerdctl --tmpfs.
+				opts = []string{"noexec", "nosuid", "nodev"}
+			}
+			out = append(out, specs.Mount{Type: "tmpfs", Source: "tmpfs", Destination: m.Target, Options: opts})
+		}
+	}
+	return out
+}
+
+// isDefaultTmpfs reports whether destination is a tmpfs every container gets.
+func isDefaultTmpfs(destination string) bool {
+	switch destination {
+	case "/dev", "/dev/shm", "/run":
+		return true
+	}
+	return false
+}
+
+// bindOptions keeps the OCI mount options that are meaningful in a bind string.
+func bindOptions(opts []string) []string {
+	var out []string
+	for _, o := range opts {
+		switch o {
+		case "ro", "rw", "shared", "rshared", "slave", "rslave", "private", "rprivate":
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// isInternalMount returns true for per-container mounts that nerdctl manages
+// and that must not be propagated to child containers.
+func isInternalMount(destination string) bool {
+	switch destination {
+	case "/etc/resolv.conf", "/etc/hosts", "/etc/hostname":
+		return true
+	}
+	return false
+}
+
+// normalizeRef expands short image references (e.g. "alpine") to the fully
+// qualified form containerd stores them under (e.g. "docker.io/library/alpine:latest").
+func normalizeRef(ref string) string {
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return ref
+	}
+	return named.String()
+}
+
+// logPath returns the log file path of the container with the given ID.
+func logPath(id string) string {
+	return filepath.Join(LogDir, id+".log")
+}
+
+// newID returns a random 64 character hex container ID.
+func newID() (string, error) {
+	b := make([]byte, 32) //nolint:mnd // 32 bytes is a 64 character hex ID.
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating container ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,123 @@
+package containerd_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	"github.com/jacobweinstock/waitdaemon/runtime/containerd"
+)
+
+func TestWarnings(t *testing.T) {
+	tests := map[string]struct {
+		info runtime.ContainerInfo
+		want int
+	}{
+		"none":           {},
+		"host network":   {info: runtime.ContainerInfo{NetworkMode: "host"}},
+		"bridge network": {info: runtime.ContainerInfo{NetworkMode: "bridge"}, want: 1},
+		"auto remove":    {info: runtime.ContainerInfo{AutoRemove: true}, want: 1},
+		"everything": {
+			info: runtime.ContainerInfo{NetworkMode: "bridge", ExtraHosts: []string{"tink:10.0.0.1"}, DNS: []string{"1.1.1.1"}, AutoRemove: true},
+			want: 4,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := (&containerd.Containerd{}).Warnings(tt.info); len(got) != tt.want {
+				t.Errorf("Warnings() = %q, want %d warnings", got, tt.want)
+			}
+		})
+	}
+}
+
+// manifest is the image manifest the test registry serves.
+const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+
+// testRegistry is a registry that serves the manifest of app:v1 only to requests with its basic auth credentials.
+type testRegistry struct {
+	*httptest.Server
+	user, password string
+
+	mu sync.Mutex
+	// authorized is set once a request has sent the credentials.
+	authorized bool
+}
+
+func newTestRegistry(t *testing.T, user, password string) *testRegistry {
+	t.Helper()
+	reg := &testRegistry{user: user, password: password}
+	reg.Server = httptest.NewTLSServer(http.HandlerFunc(reg.serve))
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+// host returns the registry host, as used in image references.
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.URL, "https://")
+}
+
+func (reg *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != reg.user || password != reg.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	reg.mu.Lock()
+	reg.authorized = true
+	reg.mu.Unlock()
+	if r.URL.Path != "/v2/app/manifests/v1" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+	w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write([]byte(manifest))
+	}
+}
+
+func TestResolverRegistryAuth(t *testing.T) {
+	tests := map[string]struct {
+		// auth is the credentials; an empty ServerAddress is replaced by the test registry host.
+		auth    runtime.RegistryAuth
+		wantErr bool
+	}{
+		"credentials":                   {auth: runtime.RegistryAuth{Username: "user", Password: "secret"}},
+		"wrong password":                {auth: runtime.RegistryAuth{Username: "user", Password: "wrong"}, wantErr: true},
+		"credentials of another server": {auth: runtime.RegistryAuth{ServerAddress: "ghcr.io", Username: "user", Password: "secret"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			reg := newTestRegistry(t, "user", "secret")
+			if tt.auth.ServerAddress == "" {
+				tt.auth.ServerAddress = reg.host()
+			}
+
+			_, desc, err := containerd.Resolver(tt.auth, reg.Client()).Resolve(context.Background(), reg.host()+"/app:v1")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Resolve() = %v, want an error", desc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))); desc.Digest.String() != want {
+				t.Errorf("Resolve() digest = %s, want %s", desc.Digest, want)
+			}
+			if !reg.authorized {
+				t.Error("the registry did not receive the credentials")
+			}
+		})
+	}
+}
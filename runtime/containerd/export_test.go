@@ -0,0 +1,14 @@
+package containerd
+
+import (
+	"net/http"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+// Resolver exports resolver for the tests, reaching the registries through client.
+func Resolver(auth runtime.RegistryAuth, client *http.Client) remotes.Resolver {
+	return resolver(auth, docker.WithClient(client))
+}
@@ -0,0 +1,876 @@
+// Package cri implements the runtime.Runtime interface using the Kubernetes
+// Container Runtime Interface (CRI) gRPC API. This works with any CRI endpoint,
+// such as containerd's CRI plugin or CRI-O.
+package cri
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// DefaultEndpoint is the default CRI socket path (containerd's CRI plugin).
+	DefaultEndpoint = "/run/containerd/containerd.sock"
+	// podNamespace is the CRI metadata namespace of the pod sandboxes waitdaemon creates.
+	podNamespace = "waitdaemon"
+	// containerName is the CRI metadata name of the containers waitdaemon creates.
+	containerName = "waitdaemon"
+	// hostnameLabel is the container label holding the hostname of the sandbox RunContainer
+	// created it in, so InspectSelf can find the container by its hostname.
+	hostnameLabel = "waitdaemon.hostname"
+	// podLogRoot is the directory under which the sandbox log directories are created.
+	podLogRoot = "/var/log/pods"
+	// pollInterval is how often container status is polled while waiting.
+	pollInterval = time.Second
+)
+
+// CRI implements runtime.Runtime using the CRI RuntimeService and ImageService.
+type CRI struct {
+	conn    *grpc.ClientConn
+	runtime runtimeapi.RuntimeServiceClient
+	image   runtimeapi.ImageServiceClient
+}
+
+// New creates a new CRI runtime client connected to the unix socket at endpoint.
+func New(endpoint string) (*CRI, error) {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	conn, err := grpc.NewClient("unix://"+strings.TrimPrefix(endpoint, "unix://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to CRI endpoint %q: %w", endpoint, err)
+	}
+	return newFromConn(conn), nil
+}
+
+// newFromConn creates a CRI runtime client from an existing gRPC connection.
+func newFromConn(conn *grpc.ClientConn) *CRI {
+	return &CRI{
+		conn:    conn,
+		runtime: runtimeapi.NewRuntimeServiceClient(conn),
+		image:   runtimeapi.NewImageServiceClient(conn),
+	}
+}
+
+// Ping checks if the CRI runtime is responsive.
+func (c *CRI) Ping(ctx context.Context) error {
+	_, err := c.runtime.Version(ctx, &runtimeapi.VersionRequest{})
+	return err
+}
+
+// verboseInfo is the subset of the verbose container status info that
+// containerd and CRI-O report under the "info" key.
+type verboseInfo struct {
+	// Config is the CRI container config. Only reported by containerd.
+	Config *struct {
+		Command    []string `json:"command"`
+		Args       []string `json:"args"`
+		WorkingDir string   `json:"working_dir"`
+		Envs       []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"envs"`
+		Tty     bool `json:"tty"`
+		Devices []struct {
+			ContainerPath string `json:"container_path"`
+			HostPath      string `json:"host_path"`
+			Permissions   string `json:"permissions"`
+		} `json:"devices"`
+		Linux *struct {
+			SecurityContext *securityContext `json:"security_context"`
+		} `json:"linux"`
+	} `json:"config"`
+	// RuntimeSpec is the OCI runtime spec of the container.
+	RuntimeSpec *specs.Spec `json:"runtimeSpec"`
+	// Privileged is reported by CRI-O.
+	Privileged bool `json:"privileged"`
+}
+
+// securityContext is the subset of the CRI container security context reported by containerd.
+type securityContext struct {
+	Privileged   bool `json:"privileged"`
+	Capabilities *struct {
+		AddCapabilities  []string `json:"add_capabilities"`
+		DropCapabilities []string `json:"drop_capabilities"`
+	} `json:"capabilities"`
+	RunAsUser      *int64Value      `json:"run_as_user"`
+	RunAsGroup     *int64Value      `json:"run_as_group"`
+	RunAsUsername  string           `json:"run_as_username"`
+	NoNewPrivs     bool             `json:"no_new_privs"`
+	ReadonlyRootfs bool             `json:"readonly_rootfs"`
+	Apparmor       *securityProfile `json:"apparmor"`
+	Seccomp        *securityProfile `json:"seccomp"`
+}
+
+// int64Value is a CRI optional integer, e.g. {"value": 1000}.
+type int64Value struct {
+	Value int64 `json:"value"`
+}
+
+// securityProfile is a CRI AppArmor or seccomp profile.
+type securityProfile struct {
+	ProfileType  runtimeapi.SecurityProfile_ProfileType `json:"profile_type"`
+	LocalhostRef string                                 `json:"localhost_ref"`
+}
+
+// InspectSelf returns the container configuration for the current container.
+// The CRI runtimes accept the full or short container IDs from runtime.SelfIDs as
+// the container ID; the containers RunContainer creates are found by their hostname
+// label instead.
+func (c *CRI) InspectSelf(ctx context.Context) (runtime.ContainerInfo, error) {
+	return runtime.InspectFirst(ctx, runtime.SelfIDs(), c.inspect)
+}
+
+// inspect returns the container configuration of the container with the given ID or hostname label.
+func (c *CRI) inspect(ctx context.Context, idOrHostname string) (runtime.ContainerInfo, error) {
+	id, err := c.resolveID(ctx, idOrHostname)
+	if err != nil {
+		return runtime.ContainerInfo{}, err
+	}
+
+	resp, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id, Verbose: true})
+	if err != nil {
+		return runtime.ContainerInfo{}, fmt.Errorf("getting container %q status: %w", id, err)
+	}
+
+	var vi verboseInfo
+	if raw, ok := resp.GetInfo()["info"]; ok {
+		if err := json.Unmarshal([]byte(raw), &vi); err != nil {
+			return runtime.ContainerInfo{}, fmt.Errorf("parsing container %q verbose info: %w", id, err)
+		}
+	}
+
+	info := infoFromStatus(resp.GetStatus(), vi)
+	info.AttachStdout = true
+	info.AttachStderr = true
+	return info, nil
+}
+
+// resolveID returns the ID of the container with the given ID, or else of the one container
+// with the given hostname label. The sandboxes RunContainer creates use the host network, so
+// their hostname is only in /etc/hostname and the container's hostname label.
+func (c *CRI) resolveID(ctx context.Context, idOrHostname string) (string, error) {
+	if _, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: idOrHostname}); err == nil {
+		return idOrHostname, nil
+	}
+
+	resp, err := c.runtime.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{LabelSelector: map[string]string{hostnameLabel: idOrHostname}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("listing containers: %w", err)
+	}
+	if cons := resp.GetContainers(); len(cons) == 1 {
+		return cons[0].GetId(), nil
+	}
+	return "", fmt.Errorf("container with ID or hostname %q not found", idOrHostname)
+}
+
+// infoFromStatus converts a CRI container status and its verbose info to a runtime.ContainerInfo.
+func infoFromStatus(status *runtimeapi.ContainerStatus, vi verboseInfo) runtime.ContainerInfo {
+	info := runtime.ContainerInfo{
+		ID:         status.GetId(),
+		Image:      status.GetImage().GetImage(),
+		Privileged: vi.Privileged,
+	}
+
+	for _, m := range status.GetMounts() {
+		if isInternalMount(m.GetContainerPath()) {
+			continue
+		}
+		info.Binds = append(info.Binds, bindFromMount(m))
+	}
+
+	if spec := vi.RuntimeSpec; spec != nil {
+		if spec.Process != nil {
+			info.Env = spec.Process.Env
+			if args := spec.Process.Args; len(args) > 0 {
+				info.Entrypoint, info.Cmd = args[:1], args[1:]
+			}
+			// "/" is the OCI default working directory and root the default user.
+			if spec.Process.Cwd != "/" {
+				info.WorkingDir = spec.Process.Cwd
+			}
+			if u := spec.Process.User; u.UID != 0 || u.GID != 0 {
+				info.User = fmt.Sprintf("%d:%d", u.UID, u.GID)
+			}
+			info.Tty = spec.Process.Terminal
+		}
+		if spec.Linux != nil {
+			// A missing namespace entry means the container shares the host namespace.
+			info.PidMode = namespaceMode(spec.Linux, specs.PIDNamespace)
+			info.IpcMode = namespaceMode(spec.Linux, specs.IPCNamespace)
+			info.Resources = runtime.ResourcesFromLinux(spec.Linux.Resources)
+			info.Sysctls = spec.Linux.Sysctl
+		}
+	}
+
+	// containerd reports the CRI config, which separates the command (entrypoint)
+	// from the args (CMD portion). Prefer it over the OCI process args. An empty
+	// command means the image entrypoint.
+	if cfg := vi.Config; cfg != nil {
+		info.Entrypoint = cfg.Command
+		info.Cmd = cfg.Args
+		info.WorkingDir = cfg.WorkingDir
+		info.Tty = cfg.Tty
+		if len(cfg.Envs) > 0 {
+			info.Env = make([]string, 0, len(cfg.Envs))
+			for _, kv := range cfg.Envs {
+				info.Env = append(info.Env, kv.Key+"="+kv.Value)
+			}
+		}
+		if cfg.Linux != nil && cfg.Linux.SecurityContext != nil {
+			securityFromConfig(&info, cfg.Linux.SecurityContext)
+		}
+		for _, d := range cfg.Devices {
+			info.Devices = append(info.Devices, runtime.DeviceMapping{
+				PathOnHost:        d.HostPath,
+				PathInContainer:   d.ContainerPath,
+				CgroupPermissions: d.Permissions,
+			})
+		}
+	}
+
+	return info
+}
+
+// securityFromConfig fills in the privileged flag, capabilities, security options,
+// read-only rootfs and user of info from a CRI security context.
+func securityFromConfig(info *runtime.ContainerInfo, sc *securityContext) {
+	info.Privileged = sc.Privileged
+	info.ReadonlyRootfs = sc.ReadonlyRootfs
+	info.User = sc.RunAsUsername
+	if sc.RunAsUser != nil {
+		info.User = strconv.FormatInt(sc.RunAsUser.Value, 10)
+	}
+	if sc.RunAsGroup != nil && info.User != "" {
+		info.User += ":" + strconv.FormatInt(sc.RunAsGroup.Value, 10)
+	}
+	if sc.Capabilities != nil {
+		for _, c := range sc.Capabilities.AddCapabilities {
+			info.CapAdd = append(info.CapAdd, runtime.NormalizeCapability(c))
+		}
+		for _, c := range sc.Capabilities.DropCapabilities {
+			info.CapDrop = append(info.CapDrop, runtime.NormalizeCapability(c))
+		}
+	}
+	if sc.NoNewPrivs {
+		info.SecurityOpt = append(info.SecurityOpt, "no-new-privileges")
+	}
+	if opt := securityOptFromProfile("apparmor", sc.Apparmor); opt != "" {
+		info.SecurityOpt = append(info.SecurityOpt, opt)
+	}
+	if opt := securityOptFromProfile("seccomp", sc.Seccomp); opt != "" {
+		info.SecurityOpt = append(info.SecurityOpt, opt)
+	}
+}
+
+// securityOptFromProfile returns the "apparmor=..." or "seccomp=..." option for a profile,
+// or an empty string for the runtime default.
+func securityOptFromProfile(key string, p *securityProfile) string {
+	switch {
+	case p == nil:
+		return ""
+	case p.ProfileType == runtimeapi.SecurityProfile_Unconfined:
+		return key + "=unconfined"
+	case p.ProfileType == runtimeapi.SecurityProfile_Localhost:
+		return key + "=" + p.LocalhostRef
+	}
+	return ""
+}
+
+// profileFromSecurityOpt is the inverse of securityOptFromProfile for a parsed option value.
+func profileFromSecurityOpt(value string) *runtimeapi.SecurityProfile {
+	switch value {
+	case "":
+		return nil
+	case "unconfined":
+		return &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Unconfined}
+	}
+	return &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Localhost, LocalhostRef: value}
+}
+
+// RunContainer creates a pod sandbox and starts a new container in it.
+// The sandbox always uses the host network namespace; the PID namespace and
+// privileges are taken from info.
+func (c *CRI) RunContainer(ctx context.Context, info runtime.ContainerInfo) (string, error) {
+	containerCfg, err := containerConfig(info)
+	if err != nil {
+		return "", err
+	}
+	suffix, err := randomHex(4) //nolint:mnd // 8 hex characters is enough to keep sandbox names unique.
+	if err != nil {
+		return "", err
+	}
+	uid, err := randomHex(16) //nolint:mnd // 16 bytes is a 32 character UID.
+	if err != nil {
+		return "", err
+	}
+
+	nsOpts := namespaceOptions(info)
+
+	// The hostname is unique, so InspectSelf in the new container can find it by its label.
+	hostname := containerName + "-" + suffix
+	containerCfg.Labels = maps.Clone(containerCfg.GetLabels())
+	if containerCfg.Labels == nil {
+		containerCfg.Labels = map[string]string{}
+	}
+	containerCfg.Labels[hostnameLabel] = hostname
+
+	name := info.Name
+	if name == "" {
+		name = hostname
+	}
+	sandboxConfig := &runtimeapi.PodSandboxConfig{
+		Metadata: &runtimeapi.PodSandboxMetadata{
+			Name:      name,
+			Uid:       uid,
+			Namespace: podNamespace,
+		},
+		Hostname:     hostname,
+		Labels:       info.Labels,
+		LogDirectory: fmt.Sprintf("%s/%s_%s_%s", podLogRoot, podNamespace, name, uid),
+		Linux: &runtimeapi.LinuxPodSandboxConfig{
+			SecurityContext: &runtimeapi.LinuxSandboxSecurityContext{
+				NamespaceOptions: nsOpts,
+				Privileged:       info.Privileged,
+			},
+			Sysctls: sandboxSysctls(info),
+		},
+	}
+
+	// The sandbox always uses the host network; only the DNS settings can be carried over.
+	if len(info.DNS) > 0 || len(info.DNSSearch) > 0 {
+		sandboxConfig.DnsConfig = &runtimeapi.DNSConfig{Servers: info.DNS, Searches: info.DNSSearch}
+	}
+
+	sandbox, err := c.runtime.RunPodSandbox(ctx, &runtimeapi.RunPodSandboxRequest{Config: sandboxConfig})
+	if err != nil {
+		return "", fmt.Errorf("creating pod sandbox: %w", err)
+	}
+
+	created, err := c.runtime.CreateContainer(ctx, &runtimeapi.CreateContainerRequest{
+		PodSandboxId:  sandbox.GetPodSandboxId(),
+		Config:        containerCfg,
+		SandboxConfig: sandboxConfig,
+	})
+	// Nothing refers to a sandbox whose container did not start, so it is removed again,
+	// even when ctx is done.
+	cleanupCtx := context.WithoutCancel(ctx)
+	if err != nil {
+		_ = c.removeSandbox(cleanupCtx, sandbox.GetPodSandboxId())
+		return "", fmt.Errorf("creating container with image %q: %w", info.Image, err)
+	}
+
+	if _, err := c.runtime.StartContainer(ctx, &runtimeapi.StartContainerRequest{ContainerId: created.GetContainerId()}); err != nil {
+		_, _ = c.runtime.RemoveContainer(cleanupCtx, &runtimeapi.RemoveContainerRequest{ContainerId: created.GetContainerId()})
+		_ = c.removeSandbox(cleanupCtx, sandbox.GetPodSandboxId())
+		return "", fmt.Errorf("starting container %q: %w", created.GetContainerId(), err)
+	}
+	return created.GetContainerId(), nil
+}
+
+// Warnings reports the network settings of info, which RunContainer drops: the sandbox
+// always uses the host network and the host's /etc/hosts.
+func (c *CRI) Warnings(info runtime.ContainerInfo) []string {
+	var warnings []string
+	if info.NetworkMode != "" && info.NetworkMode != "host" {
+		warnings = append(warnings, fmt.Sprintf("network mode %q is not supported by CRI, the host network is used", info.NetworkMode))
+	}
+	if len(info.ExtraHosts) > 0 {
+		warnings = append(warnings, fmt.Sprintf("extra hosts %q are not supported by CRI, the host's /etc/hosts is used", info.ExtraHosts))
+	}
+	var dropped []string
+	for _, k := range slices.Sorted(maps.Keys(info.Sysctls)) {
+		if hostNamespaceSysctl(k, info.IpcMode) {
+			dropped = append(dropped, k)
+		}
+	}
+	if len(dropped) > 0 {
+		warnings = append(warnings, fmt.Sprintf("sysctls %q are not supported by CRI, they cannot be set with the host's namespaces", dropped))
+	}
+	if info.AutoRemove {
+		warnings = append(warnings, "auto remove is not supported by CRI, the exited container and its sandbox are removed by the next waitdaemon run")
+	}
+	return warnings
+}
+
+// sandboxSysctls returns the sysctls of info that can be set on a sandbox that shares the
+// host network namespace, and the host IPC namespace when info uses it.
+func sandboxSysctls(info runtime.ContainerInfo) map[string]string {
+	sysctls := maps.Clone(info.Sysctls)
+	maps.DeleteFunc(sysctls, func(k, _ string) bool { return hostNamespaceSysctl(k, info.IpcMode) })
+	return sysctls
+}
+
+// hostNamespaceSysctl reports whether the sysctl belongs to a namespace the sandbox shares with the host,
+// which the CRI runtimes refuse to set: the network namespace, and the IPC namespace when
+// ipcMode is "host".
+func hostNamespaceSysctl(name, ipcMode string) bool {
+	if strings.HasPrefix(name, "net.") {
+		return true
+	}
+	ipc := strings.HasPrefix(name, "kernel.shm") || strings.HasPrefix(name, "kernel.msg") ||
+		name == "kernel.sem" || strings.HasPrefix(name, "fs.mqueue.")
+	return ipc && ipcMode == "host"
+}
+
+// Wait polls the container status until the container exits and returns its exit code.
+// CRI has no blocking wait call.
+func (c *CRI) Wait(ctx context.Context, id string) (int, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id})
+		if err != nil {
+			return -1, fmt.Errorf("getting container %q status: %w", id, err)
+		}
+		if resp.GetStatus().GetState() == runtimeapi.ContainerState_CONTAINER_EXITED {
+			return int(resp.GetStatus().GetExitCode()), nil
+		}
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForExit polls the container status until the container exits.
+// A container that does not exist counts as exited.
+func (c *CRI) WaitForExit(ctx context.Context, id string) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id})
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("getting container %q status: %w", id, err)
+		}
+		if resp.GetStatus().GetState() == runtimeapi.ContainerState_CONTAINER_EXITED {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the container, killing it if it is still running after timeout.
+// CRI has no way to choose the signal: the runtime sends the image's stop signal, usually SIGTERM.
+func (c *CRI) Stop(ctx context.Context, id string, _ syscall.Signal, timeout time.Duration) error {
+	_, err := c.runtime.StopContainer(ctx, &runtimeapi.StopContainerRequest{ContainerId: id, Timeout: int64(timeout.Seconds())})
+	if err != nil {
+		return fmt.Errorf("stopping container %q: %w", id, err)
+	}
+	return nil
+}
+
+// Kill kills the container. CRI has no kill call, so the container is stopped without a grace period,
+// which kills it with SIGKILL regardless of signal.
+func (c *CRI) Kill(ctx context.Context, id string, _ syscall.Signal) error {
+	return c.Stop(ctx, id, syscall.SIGKILL, 0)
+}
+
+// List returns the containers whose labels match selector.
+func (c *CRI) List(ctx context.Context, selector map[string]string) ([]runtime.Container, error) {
+	// The CRI label selector only matches exact values, so keys without a value are matched here.
+	exact := map[string]string{}
+	for k, v := range selector {
+		if v != "" {
+			exact[k] = v
+		}
+	}
+	resp, err := c.runtime.ListContainers(ctx, &runtimeapi.ListContainersRequest{Filter: &runtimeapi.ContainerFilter{LabelSelector: exact}})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	var cons []runtime.Container
+	for _, con := range resp.GetContainers() {
+		if !runtime.MatchLabels(con.GetLabels(), selector) {
+			continue
+		}
+		cons = append(cons, runtime.Container{
+			ID:      con.GetId(),
+			Name:    con.GetMetadata().GetName(),
+			Labels:  con.GetLabels(),
+			Running: con.GetState() == runtimeapi.ContainerState_CONTAINER_RUNNING,
+		})
+	}
+	return cons, nil
+}
+
+// Remove removes the container. RunContainer creates a pod sandbox for every container,
+// so the sandbox is removed too when it is one of ours.
+func (c *CRI) Remove(ctx context.Context, id string) error {
+	resp, err := c.runtime.ListContainers(ctx, &runtimeapi.ListContainersRequest{Filter: &runtimeapi.ContainerFilter{Id: id}})
+	if err != nil {
+		return fmt.Errorf("getting container %q: %w", id, err)
+	}
+	if len(resp.GetContainers()) == 0 {
+		return fmt.Errorf("container %q not found", id)
+	}
+	sandboxID := resp.GetContainers()[0].GetPodSandboxId()
+
+	if _, err := c.runtime.RemoveContainer(ctx, &runtimeapi.RemoveContainerRequest{ContainerId: id}); err != nil {
+		return fmt.Errorf("removing container %q: %w", id, err)
+	}
+
+	sandbox, err := c.runtime.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: sandboxID})
+	if err != nil {
+		return fmt.Errorf("getting pod sandbox %q status: %w", sandboxID, err)
+	}
+	if sandbox.GetStatus().GetMetadata().GetNamespace() != podNamespace {
+		return nil
+	}
+	return c.removeSandbox(ctx, sandboxID)
+}
+
+// removeSandbox stops and removes a pod sandbox.
+func (c *CRI) removeSandbox(ctx context.Context, id string) error {
+	if _, err := c.runtime.StopPodSandbox(ctx, &runtimeapi.StopPodSandboxRequest{PodSandboxId: id}); err != nil {
+		return fmt.Errorf("stopping pod sandbox %q: %w", id, err)
+	}
+	if _, err := c.runtime.RemovePodSandbox(ctx, &runtimeapi.RemovePodSandboxRequest{PodSandboxId: id}); err != nil {
+		return fmt.Errorf("removing pod sandbox %q: %w", id, err)
+	}
+	return nil
+}
+
+// containerConfig maps a runtime.ContainerInfo to a CRI container config.
+// info.Entrypoint and info.Cmd are passed as the CRI command and args; an empty
+// command keeps the image entrypoint.
+// CRI has no device cgroup rules, user namespace modes, volumes, tmpfs mounts, ulimits,
+// shm size or UTS and cgroup namespace modes, so those settings of info are not used.
+func containerConfig(info runtime.ContainerInfo) (*runtimeapi.ContainerConfig, error) {
+	name := info.Name
+	if name == "" {
+		name = containerName
+	}
+	cfg := &runtimeapi.ContainerConfig{
+		Metadata: &runtimeapi.ContainerMetadata{Name: name},
+		Labels:   info.Labels,
+		Image:    &runtimeapi.ImageSpec{Image: info.Image},
+		Command:  info.Entrypoint,
+		Args:     info.Cmd,
+		Tty:      info.Tty,
+		LogPath:  containerName + ".log",
+
+		WorkingDir: info.WorkingDir,
+		Linux: &runtimeapi.LinuxContainerConfig{
+			SecurityContext: &runtimeapi.LinuxContainerSecurityContext{
+				Privileged:     info.Privileged,
+				ReadonlyRootfs: info.ReadonlyRootfs,
+			},
+		},
+	}
+	if err := applySecurity(cfg.Linux.SecurityContext, info); err != nil {
+		return nil, err
+	}
+	if err := applyUser(cfg.Linux.SecurityContext, info.User); err != nil {
+		return nil, err
+	}
+	if info.PidMode == "host" || info.IpcMode == "host" {
+		cfg.Linux.SecurityContext.NamespaceOptions = namespaceOptions(info)
+	}
+	if res := info.Resources.LinuxResources(); res != nil {
+		cfg.Linux.Resources = containerResources(res)
+	}
+
+	for _, e := range info.Env {
+		k, v, _ := strings.Cut(e, "=")
+		cfg.Envs = append(cfg.Envs, &runtimeapi.KeyValue{Key: k, Value: v})
+	}
+	for _, b := range info.Binds {
+		if m := mountFromBind(b); m != nil {
+			cfg.Mounts = append(cfg.Mounts, m)
+		}
+	}
+	// CRI only has host path mounts.
+	for _, m := range info.Mounts {
+		if m.Type == runtime.MountTypeBind {
+			cfg.Mounts = append(cfg.Mounts, mountFromBind(m.String()))
+		}
+	}
+	for _, d := range info.Devices {
+		cfg.Devices = append(cfg.Devices, &runtimeapi.Device{
+			ContainerPath: d.ContainerPath(),
+			HostPath:      d.PathOnHost,
+			Permissions:   d.Permissions(),
+		})
+	}
+
+	return cfg, nil
+}
+
+// namespaceOptions returns the namespace options of the sandbox and container. The network
+// namespace is always the host's; the PID and IPC namespaces are the host's when info asks for it.
+func namespaceOptions(info runtime.ContainerInfo) *runtimeapi.NamespaceOption {
+	nsOpts := &runtimeapi.NamespaceOption{Network: runtimeapi.NamespaceMode_NODE}
+	if info.PidMode == "host" {
+		nsOpts.Pid = runtimeapi.NamespaceMode_NODE
+	}
+	if info.IpcMode == "host" {
+		nsOpts.Ipc = runtimeapi.NamespaceMode_NODE
+	}
+	return nsOpts
+}
+
+// namespaceMode returns "host" when the spec has no namespace of type ns, which means
+// the container shares the host namespace, and an empty string otherwise.
+func namespaceMode(linux *specs.Linux, ns specs.LinuxNamespaceType) string {
+	if slices.ContainsFunc(linux.Namespaces, func(n specs.LinuxNamespace) bool { return n.Type == ns }) {
+		return ""
+	}
+	return "host"
+}
+
+// containerResources converts OCI resources to CRI container resources. CRI has no pids limit
+// per container and no memory reservation.
+func containerResources(res *specs.LinuxResources) *runtimeapi.LinuxContainerResources {
+	out := &runtimeapi.LinuxContainerResources{}
+	if m := res.Memory; m != nil {
+		if m.Limit != nil {
+			out.MemoryLimitInBytes = *m.Limit
+		}
+		if m.Swap != nil {
+			out.MemorySwapLimitInBytes = *m.Swap
+		}
+	}
+	if c := res.CPU; c != nil {
+		if c.Shares != nil {
+			out.CpuShares = int64(*c.Shares) //nolint:gosec // shares fit in an int64.
+		}
+		if c.Quota != nil {
+			out.CpuQuota = *c.Quota
+		}
+		if c.Period != nil {
+			out.CpuPeriod = int64(*c.Period) //nolint:gosec // the period fits in an int64.
+		}
+		out.CpusetCpus = c.Cpus
+		out.CpusetMems = c.Mems
+	}
+	return out
+}
+
+// applySecurity sets the capabilities and security options of info on the security context.
+// CRI capability names have no "CAP_" prefix.
+func applySecurity(sc *runtimeapi.LinuxContainerSecurityContext, info runtime.ContainerInfo) error {
+	if !info.Privileged && (len(info.CapAdd) > 0 || len(info.CapDrop) > 0) {
+		sc.Capabilities = &runtimeapi.Capability{}
+		for _, c := range info.CapAdd {
+			sc.Capabilities.AddCapabilities = append(sc.Capabilities.AddCapabilities, strings.TrimPrefix(runtime.NormalizeCapability(c), "CAP_"))
+		}
+		for _, c := range info.CapDrop {
+			sc.Capabilities.DropCapabilities = append(sc.Capabilities.DropCapabilities, strings.TrimPrefix(runtime.NormalizeCapability(c), "CAP_"))
+		}
+	}
+	sec, err := runtime.ParseSecurityOpts(info.SecurityOpt)
+	if err != nil {
+		return err
+	}
+	sc.NoNewPrivs = sec.NoNewPrivileges
+	sc.Apparmor = profileFromSecurityOpt(sec.AppArmorProfile)
+	sc.Seccomp = profileFromSecurityOpt(sec.SeccompProfile)
+	for _, l := range sec.Labels {
+		// "disable" and other labels without a value have no CRI equivalent.
+		key, value, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		if sc.SelinuxOptions == nil {
+			sc.SelinuxOptions = &runtimeapi.SELinuxOption{}
+		}
+		switch key {
+		case "user":
+			sc.SelinuxOptions.User = value
+		case "role":
+			sc.SelinuxOptions.Role = value
+		case "type":
+			sc.SelinuxOptions.Type = value
+		case "level":
+			sc.SelinuxOptions.Level = value
+		}
+	}
+	return nil
+}
+
+// applyUser sets the user of a "user[:group]" string on the security context.
+// CRI takes a user name or ID but only a numeric group.
+func applyUser(sc *runtimeapi.LinuxContainerSecurityContext, user string) error {
+	if user == "" {
+		return nil
+	}
+	name, group, hasGroup := strings.Cut(user, ":")
+	if uid, err := strconv.ParseInt(name, 10, 64); err == nil {
+		sc.RunAsUser = &runtimeapi.Int64Value{Value: uid}
+	} else {
+		sc.RunAsUsername = name
+	}
+	if hasGroup {
+		gid, err := strconv.ParseInt(group, 10, 64)
+		if err != nil {
+			return fmt.Errorf("the cri runtime only supports a numeric group, got user %q", user)
+		}
+		sc.RunAsGroup = &runtimeapi.Int64Value{Value: gid}
+	}
+	return nil
+}
+
+// Logs follows the container's CRI log file until the container exits.
+// The log file must be readable at the path reported by the runtime, so
+// /var/log/pods has to be mounted into the waitdaemon container.
+func (c *CRI) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	resp, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id})
+	if err != nil {
+		return fmt.Errorf("getting container %q status: %w", id, err)
+	}
+	stopped := func(ctx context.Context) (bool, error) {
+		resp, err := c.runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id})
+		if err != nil {
+			return false, err
+		}
+		return resp.GetStatus().GetState() == runtimeapi.ContainerState_CONTAINER_EXITED, nil
+	}
+	return runtime.FollowFile(ctx, resp.GetStatus().GetLogPath(), pollInterval, stopped, func(line []byte) {
+		writeCRILogLine(line, stdout, stderr)
+	})
+}
+
+// writeCRILogLine writes the message of a CRI log line to stdout or stderr.
+// CRI log lines have the format "<timestamp> <stream> <P|F> <message>", where
+// P marks a partial line that continues in the next log line.
+func writeCRILogLine(line []byte, stdout, stderr io.Writer) {
+	fields := bytes.SplitN(line, []byte{' '}, 4) //nolint:mnd // timestamp, stream, tag, message.
+	if len(fields) < 4 {                         //nolint:mnd // malformed lines are skipped.
+		return
+	}
+	w := stdout
+	if string(fields[1]) == "stderr" {
+		w = stderr
+	}
+	msg := fields[3]
+	if string(fields[2]) != "P" {
+		msg = append(msg, '\n')
+	}
+	_, _ = w.Write(msg)
+}
+
+// ImageExists reports whether the given image reference exists locally and returns its metadata.
+func (c *CRI) ImageExists(ctx context.Context, imageRef string) (runtime.ImageInfo, bool) {
+	resp, err := c.image.ImageStatus(ctx, &runtimeapi.ImageStatusRequest{Image: &runtimeapi.ImageSpec{Image: imageRef}})
+	if err != nil || resp.GetImage() == nil {
+		return runtime.ImageInfo{}, false
+	}
+	return runtime.ImageInfo{ID: resp.GetImage().GetId(), RepoDigests: resp.GetImage().GetRepoDigests()}, true
+}
+
+// PullImage pulls the given image reference from a registry.
+func (c *CRI) PullImage(ctx context.Context, imageRef string, auth runtime.RegistryAuth) error {
+	req := &runtimeapi.PullImageRequest{Image: &runtimeapi.ImageSpec{Image: imageRef}}
+	if !auth.IsZero() {
+		req.Auth = &runtimeapi.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: auth.ServerAddress,
+		}
+	}
+	_, err := c.image.PullImage(ctx, req)
+	return err
+}
+
+// Close closes the gRPC connection.
+func (c *CRI) Close() error {
+	return c.conn.Close()
+}
+
+// bindFromMount converts a CRI mount to a "host:container[:opts]" bind string.
+func bindFromMount(m *runtimeapi.Mount) string {
+	bind := m.GetHostPath() + ":" + m.GetContainerPath()
+	var opts []string
+	if m.GetReadonly() {
+		opts = append(opts, "ro")
+	}
+	switch m.GetPropagation() {
+	case runtimeapi.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
+		opts = append(opts, "rslave")
+	case runtimeapi.MountPropagation_PROPAGATION_BIDIRECTIONAL:
+		opts = append(opts, "rshared")
+	case runtimeapi.MountPropagation_PROPAGATION_PRIVATE:
+	}
+	if len(opts) > 0 {
+		bind += ":" + strings.Join(opts, ",")
+	}
+	return bind
+}
+
+// mountFromBind converts a "host:container[:opts]" bind string to a CRI mount.
+// It returns nil for malformed bind strings.
+func mountFromBind(bind string) *runtimeapi.Mount {
+	parts := strings.SplitN(bind, ":", 3) //nolint:mnd // source, destination, options.
+	if len(parts) < 2 {                   //nolint:mnd // source and destination are required.
+		return nil
+	}
+	m := &runtimeapi.Mount{HostPath: parts[0], ContainerPath: parts[1]}
+	if len(parts) == 3 { //nolint:mnd // options are present.
+		for _, o := range strings.Split(parts[2], ",") {
+			switch o {
+			case "ro":
+				m.Readonly = true
+			case "rslave", "slave":
+				m.Propagation = runtimeapi.MountPropagation_PROPAGATION_HOST_TO_CONTAINER
+			case "rshared", "shared":
+				m.Propagation = runtimeapi.MountPropagation_PROPAGATION_BIDIRECTIONAL
+			case "z", "Z":
+				m.SelinuxRelabel = true
+			}
+		}
+	}
+	return m
+}
+
+// isInternalMount returns true for per-container mounts that the CRI runtime
+// manages and that must not be propagated to child containers.
+func isInternalMount(destination string) bool {
+	switch destination {
+	case "/etc/resolv.conf", "/etc/hosts", "/etc/hostname", "/dev/termination-log", "/dev/shm":
+		return true
+	}
+	return false
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating random ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,457 @@
+package cri_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	"github.com/jacobweinstock/waitdaemon/runtime/cri"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeContainer is a container created in fakeRuntime.
+type fakeContainer struct {
+	sandboxID string
+	config    *runtimeapi.ContainerConfig
+	state     runtimeapi.ContainerState
+}
+
+// fakeRuntime is an in-memory CRI RuntimeService.
+type fakeRuntime struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+
+	mu         sync.Mutex
+	sandboxes  map[string]*runtimeapi.PodSandboxConfig
+	stopped    []string
+	containers map[string]*fakeContainer
+	createErr  error
+	startErr   error
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{sandboxes: map[string]*runtimeapi.PodSandboxConfig{}, containers: map[string]*fakeContainer{}}
+}
+
+func (f *fakeRuntime) Version(context.Context, *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	return &runtimeapi.VersionResponse{RuntimeName: "fake"}, nil
+}
+
+func (f *fakeRuntime) RunPodSandbox(_ context.Context, req *runtimeapi.RunPodSandboxRequest) (*runtimeapi.RunPodSandboxResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("sandbox-%d", len(f.sandboxes)+1)
+	f.sandboxes[id] = req.GetConfig()
+	return &runtimeapi.RunPodSandboxResponse{PodSandboxId: id}, nil
+}
+
+func (f *fakeRuntime) StopPodSandbox(_ context.Context, req *runtimeapi.StopPodSandboxRequest) (*runtimeapi.StopPodSandboxResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = append(f.stopped, req.GetPodSandboxId())
+	return &runtimeapi.StopPodSandboxResponse{}, nil
+}
+
+func (f *fakeRuntime) RemovePodSandbox(_ context.Context, req *runtimeapi.RemovePodSandboxRequest) (*runtimeapi.RemovePodSandboxResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sandboxes, req.GetPodSandboxId())
+	return &runtimeapi.RemovePodSandboxResponse{}, nil
+}
+
+func (f *fakeRuntime) PodSandboxStatus(_ context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cfg, ok := f.sandboxes[req.GetPodSandboxId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "sandbox %q not found", req.GetPodSandboxId())
+	}
+	return &runtimeapi.PodSandboxStatusResponse{Status: &runtimeapi.PodSandboxStatus{Id: req.GetPodSandboxId(), Metadata: cfg.GetMetadata()}}, nil
+}
+
+func (f *fakeRuntime) CreateContainer(_ context.Context, req *runtimeapi.CreateContainerRequest) (*runtimeapi.CreateContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	if _, ok := f.sandboxes[req.GetPodSandboxId()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "sandbox %q not found", req.GetPodSandboxId())
+	}
+	id := fmt.Sprintf("container-%d", len(f.containers)+1)
+	f.containers[id] = &fakeContainer{
+		sandboxID: req.GetPodSandboxId(),
+		config:    req.GetConfig(),
+		state:     runtimeapi.ContainerState_CONTAINER_CREATED,
+	}
+	return &runtimeapi.CreateContainerResponse{ContainerId: id}, nil
+}
+
+func (f *fakeRuntime) StartContainer(_ context.Context, req *runtimeapi.StartContainerRequest) (*runtimeapi.StartContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.startErr != nil {
+		return nil, f.startErr
+	}
+	con, ok := f.containers[req.GetContainerId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetContainerId())
+	}
+	con.state = runtimeapi.ContainerState_CONTAINER_RUNNING
+	return &runtimeapi.StartContainerResponse{}, nil
+}
+
+func (f *fakeRuntime) RemoveContainer(_ context.Context, req *runtimeapi.RemoveContainerRequest) (*runtimeapi.RemoveContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.containers, req.GetContainerId())
+	return &runtimeapi.RemoveContainerResponse{}, nil
+}
+
+// ContainerStatus reports the verbose info like containerd, which includes the CRI container config.
+func (f *fakeRuntime) ContainerStatus(_ context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	con, ok := f.containers[req.GetContainerId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetContainerId())
+	}
+	resp := &runtimeapi.ContainerStatusResponse{Status: &runtimeapi.ContainerStatus{
+		Id:     req.GetContainerId(),
+		State:  con.state,
+		Image:  con.config.GetImage(),
+		Labels: con.config.GetLabels(),
+	}}
+	if req.GetVerbose() {
+		b, err := json.Marshal(map[string]any{"config": con.config})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Info = map[string]string{"info": string(b)}
+	}
+	return resp, nil
+}
+
+func (f *fakeRuntime) ListContainers(_ context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	filter := req.GetFilter()
+	var cons []*runtimeapi.Container
+	for id, con := range f.containers {
+		if filter.GetId() != "" && filter.GetId() != id {
+			continue
+		}
+		matches := true
+		for k, v := range filter.GetLabelSelector() {
+			if con.config.GetLabels()[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			cons = append(cons, &runtimeapi.Container{Id: id, PodSandboxId: con.sandboxID, Labels: con.config.GetLabels(), State: con.state})
+		}
+	}
+	return &runtimeapi.ListContainersResponse{Containers: cons}, nil
+}
+
+// relabel sets a label of a container, e.g. to make it the container the test process runs in.
+func (f *fakeRuntime) relabel(id, key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers[id].config.Labels[key] = value
+}
+
+// fakeImages is an in-memory CRI ImageService.
+type fakeImages struct {
+	runtimeapi.UnimplementedImageServiceServer
+
+	mu     sync.Mutex
+	images map[string]*runtimeapi.Image
+	pulls  []*runtimeapi.PullImageRequest
+}
+
+func (f *fakeImages) ImageStatus(_ context.Context, req *runtimeapi.ImageStatusRequest) (*runtimeapi.ImageStatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Like the CRI runtimes, a missing image is a nil image rather than an error.
+	return &runtimeapi.ImageStatusResponse{Image: f.images[req.GetImage().GetImage()]}, nil
+}
+
+func (f *fakeImages) PullImage(_ context.Context, req *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulls = append(f.pulls, req)
+	if req.GetImage().GetImage() == "private/app" && req.GetAuth() == nil {
+		return nil, status.Error(codes.Unauthenticated, "pull access denied")
+	}
+	ref := req.GetImage().GetImage()
+	f.images[ref] = &runtimeapi.Image{Id: "sha256:" + ref, RepoDigests: []string{ref + "@sha256:1111"}}
+	return &runtimeapi.PullImageResponse{ImageRef: "sha256:" + ref}, nil
+}
+
+// newTestCRI starts the fake services on an in-memory listener and returns a client connected to them.
+func newTestCRI(t *testing.T, rt *fakeRuntime, images *fakeImages) *cri.CRI {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(srv, rt)
+	runtimeapi.RegisterImageServiceServer(srv, images)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("connecting to the fake CRI services: %v", err)
+	}
+	c := cri.NewFromConn(conn)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestPing(t *testing.T) {
+	c := newTestCRI(t, newFakeRuntime(), &fakeImages{images: map[string]*runtimeapi.Image{}})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	tests := map[string]struct {
+		ref      string
+		auth     runtime.RegistryAuth
+		wantAuth *runtimeapi.AuthConfig
+		wantErr  codes.Code
+	}{
+		"anonymous": {
+			ref: "alpine",
+		},
+		"with credentials": {
+			ref:      "private/app",
+			auth:     runtime.RegistryAuth{ServerAddress: "docker.io", Username: "user", Password: "secret"},
+			wantAuth: &runtimeapi.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: "secret"},
+		},
+		"denied": {
+			ref:     "private/app",
+			wantErr: codes.Unauthenticated,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			images := &fakeImages{images: map[string]*runtimeapi.Image{}}
+			c := newTestCRI(t, newFakeRuntime(), images)
+
+			err := c.PullImage(context.Background(), tt.ref, tt.auth)
+			if status.Code(err) != tt.wantErr {
+				t.Fatalf("PullImage() error = %v, want code %v", err, tt.wantErr)
+			}
+			if len(images.pulls) != 1 {
+				t.Fatalf("got %d pull requests, want 1", len(images.pulls))
+			}
+			if got := images.pulls[0].GetAuth(); !reflect.DeepEqual(got, tt.wantAuth) {
+				t.Errorf("pull auth = %v, want %v", got, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestImageExists(t *testing.T) {
+	images := &fakeImages{images: map[string]*runtimeapi.Image{
+		"alpine": {Id: "sha256:2222", RepoDigests: []string{"docker.io/library/alpine@sha256:3333"}},
+	}}
+	c := newTestCRI(t, newFakeRuntime(), images)
+
+	img, ok := c.ImageExists(context.Background(), "alpine")
+	want := runtime.ImageInfo{ID: "sha256:2222", RepoDigests: []string{"docker.io/library/alpine@sha256:3333"}}
+	if !ok || !reflect.DeepEqual(img, want) {
+		t.Errorf("ImageExists() = %+v, %v, want %+v, true", img, ok, want)
+	}
+	if _, ok := c.ImageExists(context.Background(), "missing"); ok {
+		t.Error("ImageExists() = true for a missing image")
+	}
+}
+
+func TestRunContainerAndInspectSelf(t *testing.T) {
+	rt := newFakeRuntime()
+	c := newTestCRI(t, rt, &fakeImages{images: map[string]*runtimeapi.Image{}})
+	info := runtime.ContainerInfo{
+		Image:      "alpine",
+		Env:        []string{"FOO=bar"},
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"echo hi"},
+		WorkingDir: "/work",
+		User:       "1000:1000",
+		Labels:     map[string]string{"waitdaemon.phase": "user"},
+		PidMode:    "host",
+		Privileged: true,
+	}
+
+	id, err := c.RunContainer(context.Background(), info)
+	if err != nil {
+		t.Fatalf("RunContainer() error = %v", err)
+	}
+	if info.Labels[cri.HostnameLabel] != "" {
+		t.Error("RunContainer() modified info.Labels")
+	}
+
+	sandbox := rt.sandboxes[rt.containers[id].sandboxID]
+	hostname := rt.containers[id].config.GetLabels()[cri.HostnameLabel]
+	if hostname == "" || sandbox.GetHostname() != hostname {
+		t.Errorf("sandbox hostname = %q, container hostname label = %q, want the same non-empty hostname", sandbox.GetHostname(), hostname)
+	}
+	if got := sandbox.GetLinux().GetSecurityContext().GetNamespaceOptions(); got.GetNetwork() != runtimeapi.NamespaceMode_NODE || got.GetPid() != runtimeapi.NamespaceMode_NODE {
+		t.Errorf("sandbox namespace options = %v, want the node network and PID namespaces", got)
+	}
+	if state := rt.containers[id].state; state != runtimeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("container state = %v, want running", state)
+	}
+
+	// Pretend the test runs in the new container: its hostname is the one in the label.
+	self, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.relabel(id, cri.HostnameLabel, self)
+
+	got, err := c.InspectSelf(context.Background())
+	if err != nil {
+		t.Fatalf("InspectSelf() error = %v", err)
+	}
+	if got.ID != id || got.Image != info.Image {
+		t.Errorf("InspectSelf() ID, Image = %q, %q, want %q, %q", got.ID, got.Image, id, info.Image)
+	}
+	for name, pair := range map[string][2]any{
+		"Env":        {got.Env, info.Env},
+		"Entrypoint": {got.Entrypoint, info.Entrypoint},
+		"Cmd":        {got.Cmd, info.Cmd},
+		"WorkingDir": {got.WorkingDir, info.WorkingDir},
+		"User":       {got.User, info.User},
+	} {
+		if !reflect.DeepEqual(pair[0], pair[1]) {
+			t.Errorf("InspectSelf() %s = %v, want %v", name, pair[0], pair[1])
+		}
+	}
+}
+
+func TestInspectSelfNotFound(t *testing.T) {
+	c := newTestCRI(t, newFakeRuntime(), &fakeImages{images: map[string]*runtimeapi.Image{}})
+	if _, err := c.InspectSelf(context.Background()); err == nil {
+		t.Error("InspectSelf() error = nil without a container for this hostname")
+	}
+}
+
+func TestRunContainerCleanup(t *testing.T) {
+	tests := map[string]struct {
+		createErr error
+		startErr  error
+	}{
+		"create fails": {createErr: status.Error(codes.InvalidArgument, "bad config")},
+		"start fails":  {startErr: status.Error(codes.Unknown, "exec format error")},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			rt.createErr = tt.createErr
+			rt.startErr = tt.startErr
+			c := newTestCRI(t, rt, &fakeImages{images: map[string]*runtimeapi.Image{}})
+
+			_, err := c.RunContainer(context.Background(), runtime.ContainerInfo{Image: "alpine"})
+			want := tt.createErr
+			if want == nil {
+				want = tt.startErr
+			}
+			if status.Code(err) != status.Code(want) {
+				t.Errorf("RunContainer() error = %v, want %v", err, want)
+			}
+			if len(rt.sandboxes) != 0 || len(rt.containers) != 0 {
+				t.Errorf("left %d sandboxes and %d containers behind, want none", len(rt.sandboxes), len(rt.containers))
+			}
+			if len(rt.stopped) != 1 {
+				t.Errorf("stopped sandboxes = %q, want the one sandbox", rt.stopped)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	rt := newFakeRuntime()
+	c := newTestCRI(t, rt, &fakeImages{images: map[string]*runtimeapi.Image{}})
+	id, err := c.RunContainer(context.Background(), runtime.ContainerInfo{Image: "alpine"})
+	if err != nil {
+		t.Fatalf("RunContainer() error = %v", err)
+	}
+	if len(rt.sandboxes) != 1 {
+		t.Fatalf("RunContainer() created %d sandboxes, want 1", len(rt.sandboxes))
+	}
+
+	if err := c.Remove(context.Background(), id); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if len(rt.sandboxes) != 0 || len(rt.containers) != 0 {
+		t.Errorf("left %d sandboxes and %d containers behind, want none", len(rt.sandboxes), len(rt.containers))
+	}
+	if err := c.Remove(context.Background(), id); err == nil {
+		t.Error("Remove() of a removed container error = nil")
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	c := newTestCRI(t, newFakeRuntime(), &fakeImages{images: map[string]*runtimeapi.Image{}})
+	// The DNS settings are carried over to the sandbox, so only the network mode and extra hosts are dropped.
+	if got := c.Warnings(runtime.ContainerInfo{NetworkMode: "host", DNS: []string{"1.1.1.1"}}); len(got) != 0 {
+		t.Errorf("Warnings() = %q, want none", got)
+	}
+	if got := c.Warnings(runtime.ContainerInfo{NetworkMode: "bridge", ExtraHosts: []string{"tink:10.0.0.1"}}); len(got) != 2 {
+		t.Errorf("Warnings() = %q, want 2 warnings", got)
+	}
+	got := c.Warnings(runtime.ContainerInfo{Sysctls: map[string]string{"net.ipv4.ip_forward": "1", "kernel.shm_rmid_forced": "1"}})
+	if len(got) != 1 || !strings.Contains(got[0], "net.ipv4.ip_forward") || strings.Contains(got[0], "kernel.shm_rmid_forced") {
+		t.Errorf("Warnings() = %q, want a warning for the net sysctl only", got)
+	}
+	if got := c.Warnings(runtime.ContainerInfo{AutoRemove: true}); len(got) != 1 || !strings.Contains(got[0], "auto remove") {
+		t.Errorf("Warnings() = %q, want an auto remove warning", got)
+	}
+}
+
+func TestRunContainerSysctls(t *testing.T) {
+	sysctls := map[string]string{"net.ipv4.ip_forward": "1", "kernel.shm_rmid_forced": "1", "fs.mqueue.msg_max": "64"}
+	tests := map[string]struct {
+		ipcMode string
+		want    map[string]string
+	}{
+		// The sandbox always shares the host network namespace, so net sysctls are never set.
+		"private IPC": {want: map[string]string{"kernel.shm_rmid_forced": "1", "fs.mqueue.msg_max": "64"}},
+		"host IPC":    {ipcMode: "host", want: map[string]string{}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			c := newTestCRI(t, rt, &fakeImages{images: map[string]*runtimeapi.Image{}})
+			id, err := c.RunContainer(context.Background(), runtime.ContainerInfo{Image: "alpine", IpcMode: tt.ipcMode, Sysctls: sysctls})
+			if err != nil {
+				t.Fatalf("RunContainer() error = %v", err)
+			}
+			got := rt.sandboxes[rt.containers[id].sandboxID].GetLinux().GetSysctls()
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("sandbox sysctls = %v, want %v", got, tt.want)
+			}
+			if len(sysctls) != 3 {
+				t.Error("RunContainer() modified info.Sysctls")
+			}
+		})
+	}
+}
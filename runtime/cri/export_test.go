@@ -0,0 +1,7 @@
+package cri
+
+// NewFromConn exports newFromConn for the tests, which talk to fake CRI services over an in-memory connection.
+var NewFromConn = newFromConn
+
+// HostnameLabel exports hostnameLabel for the tests.
+const HostnameLabel = hostnameLabel
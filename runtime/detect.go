@@ -15,6 +15,14 @@ const (
 	RuntimeDocker = "docker"
 	// RuntimeNerdctl selects the nerdctl CLI runtime via the ctrctl wrapper.
 	RuntimeNerdctl = "nerdctl"
+	// RuntimeDockerCLI selects the docker CLI runtime via the ctrctl wrapper.
+	RuntimeDockerCLI = "docker-cli"
+	// RuntimeContainerd selects the native containerd client runtime.
+	RuntimeContainerd = "containerd"
+	// RuntimePodman selects the Podman runtime via the libpod REST API.
+	RuntimePodman = "podman"
+	// RuntimeCRI selects the Kubernetes CRI gRPC runtime.
+	RuntimeCRI = "cri"
 	// RuntimeAuto auto-detects the available runtime (Docker SDK preferred, then CLI auto-detection).
 	RuntimeAuto = "auto"
 )
@@ -31,49 +39,89 @@ type DockerRuntime func() (Runtime, error)
 // NerdctlRuntime creates a ctrctl-backed runtime client using the given CLI command.
 type NerdctlRuntime func(cli []string) (Runtime, error)
 
+// ContainerdRuntime creates a containerd client runtime scoped to the given namespace.
+type ContainerdRuntime func(namespace string) (Runtime, error)
+
+// PodmanRuntime creates a Podman runtime client using the libpod REST API.
+type PodmanRuntime func() (Runtime, error)
+
+// CRIRuntime creates a Kubernetes CRI gRPC runtime client.
+type CRIRuntime func() (Runtime, error)
+
+// Factories holds the constructors Detect uses to build runtime clients,
+// keeping Detect decoupled from the concrete implementations.
+type Factories struct {
+	Docker     DockerRuntime
+	Nerdctl    NerdctlRuntime
+	Containerd ContainerdRuntime
+	Podman     PodmanRuntime
+	CRI        CRIRuntime
+}
+
 // Detect selects and creates a runtime client based on the preference string.
 //
 // Preference values:
 //   - "docker": use Docker SDK, fail if unavailable
 //   - "nerdctl": use nerdctl via the ctrctl CLI wrapper
-//   - "auto" or "": auto-detect (Docker SDK preferred, then nerdctl)
+//   - "docker-cli": use the docker CLI via the ctrctl CLI wrapper
+//   - "containerd": use the containerd Go client, fail if unavailable
+//   - "podman": use the Podman REST API, fail if unavailable
+//   - "cri": use a Kubernetes CRI endpoint, fail if unavailable
+//   - "auto" or "": auto-detect (Docker SDK preferred, then Podman, then the docker CLI, then nerdctl)
 //
 // nerdctlNamespace is the namespace passed to nerdctl via --namespace.
-// It is only applied when the resolved CLI is nerdctl.
+// It is also the containerd namespace used by the containerd runtime.
 //
 // When nsenterHost is true, nerdctl CLI invocations are prefixed with
 // nsenter -t 1 -m -u -i -n -p -- so they execute inside all host namespaces.
 // nerdctl must already be installed on the host.
 // This has no effect on the Docker SDK path.
 //
-// The dockerFn and nerdctlFn factories construct the actual clients,
-// keeping this function decoupled from the concrete implementations.
-func Detect(preference string, dockerFn DockerRuntime, nerdctlFn NerdctlRuntime, nerdctlNamespace string, nsenterHost bool) (Runtime, error) {
+// The factories in f construct the actual clients.
+func Detect(preference string, f Factories, nerdctlNamespace string, nsenterHost bool) (Runtime, error) {
 	switch preference {
 	case RuntimeDocker:
-		return tryDocker(dockerFn)
+		return tryDocker(f.Docker)
 	case RuntimeNerdctl:
-		return tryNerdctl(nerdctlFn, nerdctlNamespace, nsenterHost)
+		return tryNerdctl(f.Nerdctl, nerdctlNamespace, nsenterHost)
+	case RuntimeDockerCLI:
+		return tryDockerCLI(f.Nerdctl)
+	case RuntimeContainerd:
+		return tryContainerd(f.Containerd, nerdctlNamespace)
+	case RuntimePodman:
+		return tryPodman(f.Podman)
+	case RuntimeCRI:
+		return tryCRI(f.CRI)
 	case RuntimeAuto, "":
-		return autoDetect(dockerFn, nerdctlFn, nerdctlNamespace, nsenterHost)
+		return autoDetect(f, nerdctlNamespace, nsenterHost)
 	default:
-		return nil, fmt.Errorf("unknown runtime %q: valid values are %q, %q, %q",
-			preference, RuntimeDocker, RuntimeNerdctl, RuntimeAuto)
+		return nil, fmt.Errorf("unknown runtime %q: valid values are %q, %q, %q, %q, %q, %q, %q",
+			preference, RuntimeDocker, RuntimeNerdctl, RuntimeDockerCLI, RuntimeContainerd, RuntimePodman, RuntimeCRI, RuntimeAuto)
 	}
 }
 
-func autoDetect(dockerFn DockerRuntime, nerdctlFn NerdctlRuntime, nerdctlNamespace string, nsenterHost bool) (Runtime, error) {
+func autoDetect(f Factories, nerdctlNamespace string, nsenterHost bool) (Runtime, error) {
 	// Prefer Docker SDK when the socket is available.
-	if rt, err := tryDocker(dockerFn); err == nil {
+	if rt, err := tryDocker(f.Docker); err == nil {
+		return rt, nil
+	}
+
+	// Then the Podman API socket.
+	if rt, err := tryPodman(f.Podman); err == nil {
 		return rt, nil
 	}
 
 	// Fall back to CLI auto-detection (docker > nerdctl).
-	if rt, err := tryNerdctl(nerdctlFn, nerdctlNamespace, nsenterHost); err == nil {
+	// The docker CLI covers daemons the SDK cannot talk to, e.g. API version
+	// negotiation failures or a socket behind a proxy.
+	if rt, err := tryDockerCLI(f.Nerdctl); err == nil {
+		return rt, nil
+	}
+	if rt, err := tryNerdctl(f.Nerdctl, nerdctlNamespace, nsenterHost); err == nil {
 		return rt, nil
 	}
 
-	return nil, fmt.Errorf("no container runtime found: checked Docker SDK (%s) and CLI auto-detection (docker, nerdctl)", dockerSocket)
+	return nil, fmt.Errorf("no container runtime found: checked Docker SDK (%s), Podman and CLI auto-detection (docker, nerdctl)", dockerSocket)
 }
 
 func tryDocker(dockerFn DockerRuntime) (Runtime, error) {
@@ -81,13 +129,8 @@ func tryDocker(dockerFn DockerRuntime) (Runtime, error) {
 	if err != nil {
 		return nil, fmt.Errorf("creating docker runtime: %w", err)
 	}
-	if p, ok := rt.(Pingable); ok {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second) //nolint:mnd // Using a magic number is fine here.
-		defer cancel()
-		if err := p.Ping(ctx); err != nil {
-			_ = rt.Close()
-			return nil, fmt.Errorf("docker daemon not responding: %w", err)
-		}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("docker daemon not responding: %w", err)
 	}
 	return rt, nil
 }
@@ -110,13 +153,71 @@ func tryNerdctl(nerdctlFn NerdctlRuntime, namespace string, useNsenter bool) (Ru
 	if err != nil {
 		return nil, fmt.Errorf("creating ctrctl runtime with %v: %w", cli, err)
 	}
-	if p, ok := rt.(Pingable); ok {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second) //nolint:mnd // Using a magic number is fine here.
-		defer cancel()
-		if err := p.Ping(ctx); err != nil {
-			_ = rt.Close()
-			return nil, fmt.Errorf("container CLI %v not responding: %w", cli, err)
-		}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("container CLI %v not responding: %w", cli, err)
+	}
+	return rt, nil
+}
+
+// tryDockerCLI will check if the docker CLI is available.
+// It reuses the ctrctl code path with the docker binary.
+func tryDockerCLI(nerdctlFn NerdctlRuntime) (Runtime, error) {
+	cli := []string{"docker"}
+	rt, err := nerdctlFn(cli)
+	if err != nil {
+		return nil, fmt.Errorf("creating ctrctl runtime with %v: %w", cli, err)
+	}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("container CLI %v not responding: %w", cli, err)
+	}
+	return rt, nil
+}
+
+func tryContainerd(containerdFn ContainerdRuntime, namespace string) (Runtime, error) {
+	rt, err := containerdFn(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("creating containerd runtime: %w", err)
+	}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("containerd daemon not responding: %w", err)
+	}
+	return rt, nil
+}
+
+func tryPodman(podmanFn PodmanRuntime) (Runtime, error) {
+	rt, err := podmanFn()
+	if err != nil {
+		return nil, fmt.Errorf("creating podman runtime: %w", err)
+	}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("podman service not responding: %w", err)
 	}
 	return rt, nil
 }
+
+func tryCRI(criFn CRIRuntime) (Runtime, error) {
+	rt, err := criFn()
+	if err != nil {
+		return nil, fmt.Errorf("creating CRI runtime: %w", err)
+	}
+	if err := ping(rt); err != nil {
+		return nil, fmt.Errorf("CRI runtime not responding: %w", err)
+	}
+	return rt, nil
+}
+
+// ping verifies connectivity for runtimes that implement Pingable.
+// The runtime is closed when it does not respond.
+func ping(rt Runtime) error {
+	p, ok := rt.(Pingable)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second) //nolint:mnd // Using a magic number is fine here.
+	defer cancel()
+	if err := p.Ping(ctx); err != nil {
+		_ = rt.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DeviceMapping is a host device made available in a container.
+type DeviceMapping struct {
+	// PathOnHost is the device path on the host, e.g. "/dev/sda".
+	PathOnHost string
+	// PathInContainer is the device path in the container. Empty means the same as PathOnHost.
+	PathInContainer string
+	// CgroupPermissions is the access the container has, any of "r", "w" and "m". Empty means "rwm".
+	CgroupPermissions string
+}
+
+// String returns the mapping in the "host:container:permissions" form of the --device flag.
+func (d DeviceMapping) String() string {
+	s := d.PathOnHost
+	if d.PathInContainer != "" || d.CgroupPermissions != "" {
+		s += ":" + d.ContainerPath()
+	}
+	if d.CgroupPermissions != "" {
+		s += ":" + d.CgroupPermissions
+	}
+	return s
+}
+
+// ContainerPath returns PathInContainer, or PathOnHost when it is empty.
+func (d DeviceMapping) ContainerPath() string {
+	if d.PathInContainer == "" {
+		return d.PathOnHost
+	}
+	return d.PathInContainer
+}
+
+// Permissions returns CgroupPermissions, or "rwm" when it is empty.
+func (d DeviceMapping) Permissions() string {
+	if d.CgroupPermissions == "" {
+		return "rwm"
+	}
+	return d.CgroupPermissions
+}
+
+// IsDefaultDevice reports whether path is one of the devices every container gets,
+// which must not be passed as an extra device.
+func IsDefaultDevice(path string) bool {
+	switch path {
+	case "/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty", "/dev/console", "/dev/ptmx", "/dev/fuse", "/dev/net/tun":
+		return true
+	}
+	return false
+}
+
+// ParseDeviceCgroupRule parses a device cgroup rule such as "c 1:3 rwm" or "b *:* r".
+func ParseDeviceCgroupRule(rule string) (specs.LinuxDeviceCgroup, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 3 { //nolint:mnd // type, major:minor and access.
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid device cgroup rule %q", rule)
+	}
+	switch fields[0] {
+	case "a", "b", "c":
+	default:
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid device type in device cgroup rule %q", rule)
+	}
+	major, minor, ok := strings.Cut(fields[1], ":")
+	if !ok {
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid major:minor in device cgroup rule %q", rule)
+	}
+	d := specs.LinuxDeviceCgroup{Allow: true, Type: fields[0], Access: fields[2]}
+	var err error
+	if d.Major, err = parseDeviceNumber(major); err != nil {
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid major in device cgroup rule %q: %w", rule, err)
+	}
+	if d.Minor, err = parseDeviceNumber(minor); err != nil {
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid minor in device cgroup rule %q: %w", rule, err)
+	}
+	return d, nil
+}
+
+// FormatDeviceCgroupRule returns an allow rule in the "c 1:3 rwm" form. It reports false for deny rules,
+// which the device cgroup rule form cannot express.
+func FormatDeviceCgroupRule(d specs.LinuxDeviceCgroup) (string, bool) {
+	if !d.Allow {
+		return "", false
+	}
+	typ := d.Type
+	if typ == "" {
+		typ = "a"
+	}
+	return fmt.Sprintf("%s %s:%s %s", typ, formatDeviceNumber(d.Major), formatDeviceNumber(d.Minor), d.Access), true
+}
+
+// parseDeviceNumber parses a device major or minor number, where "*" means any.
+func parseDeviceNumber(s string) (*int64, error) {
+	if s == "*" {
+		return nil, nil //nolint:nilnil // nil means any device number.
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func formatDeviceNumber(n *int64) string {
+	if n == nil {
+		return "*"
+	}
+	return strconv.FormatInt(*n, 10)
+}
@@ -5,12 +5,24 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/containerd/errdefs"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/jacobweinstock/waitdaemon/runtime"
+	"golang.org/x/sys/unix"
 )
 
 // Docker implements runtime.Runtime using the Docker Engine API.
@@ -35,57 +47,188 @@ func (d *Docker) Ping(ctx context.Context) error {
 }
 
 // InspectSelf returns the container configuration for the current container.
-// It uses os.Hostname() to get the container ID (Docker sets HOSTNAME to the container short ID).
+// The container is found by the IDs from runtime.SelfIDs: the container ID in the /etc/hostname
+// mount source, which also works with the host network, or else the hostname, which Docker sets
+// to the container short ID.
 func (d *Docker) InspectSelf(ctx context.Context) (runtime.ContainerInfo, error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return runtime.ContainerInfo{}, fmt.Errorf("getting hostname: %w", err)
-	}
-	con, err := d.client.ContainerInspect(ctx, hostname)
-	if err != nil {
-		return runtime.ContainerInfo{}, err
-	}
-	return containerInfoFromInspect(con), nil
+	return runtime.InspectFirst(ctx, runtime.SelfIDs(), func(ctx context.Context, id string) (runtime.ContainerInfo, error) {
+		con, err := d.client.ContainerInspect(ctx, id)
+		if err != nil {
+			return runtime.ContainerInfo{}, err
+		}
+		return containerInfoFromInspect(con), nil
+	})
 }
 
 // RunContainer creates and starts a new container with the given configuration.
-func (d *Docker) RunContainer(ctx context.Context, info runtime.ContainerInfo) error {
+func (d *Docker) RunContainer(ctx context.Context, info runtime.ContainerInfo) (string, error) {
 	config := &container.Config{
 		Image:        info.Image,
 		AttachStdout: info.AttachStdout,
 		AttachStderr: info.AttachStderr,
+		Entrypoint:   info.Entrypoint,
 		Cmd:          info.Cmd,
+		WorkingDir:   info.WorkingDir,
+		User:         info.User,
 		Tty:          info.Tty,
 		Env:          info.Env,
+		Labels:       info.Labels,
 	}
 
 	hostConfig := &container.HostConfig{
-		Privileged: info.Privileged,
-		Binds:      info.Binds,
-		PidMode:    container.PidMode(info.PidMode),
+		Privileged:  info.Privileged,
+		CapAdd:      info.CapAdd,
+		CapDrop:     info.CapDrop,
+		SecurityOpt: info.SecurityOpt,
+		UsernsMode:  container.UsernsMode(info.UsernsMode),
+		Binds:       info.Binds,
+		PidMode:     container.PidMode(info.PidMode),
+		AutoRemove:  info.AutoRemove,
+		NetworkMode: container.NetworkMode(info.NetworkMode),
+		DNS:         info.DNS,
+		DNSSearch:   info.DNSSearch,
+		ExtraHosts:  info.ExtraHosts,
+
+		ReadonlyRootfs: info.ReadonlyRootfs,
+		IpcMode:        container.IpcMode(info.IpcMode),
+		UTSMode:        container.UTSMode(info.UTSMode),
+		CgroupnsMode:   container.CgroupnsMode(info.CgroupnsMode),
+		Sysctls:        info.Sysctls,
+		ShmSize:        info.ShmSize,
+		Resources:      hostResources(info),
+	}
+	applyMounts(hostConfig, info.Mounts)
+	for _, d := range info.Devices {
+		hostConfig.Devices = append(hostConfig.Devices, container.DeviceMapping{
+			PathOnHost:        d.PathOnHost,
+			PathInContainer:   d.ContainerPath(),
+			CgroupPermissions: d.Permissions(),
+		})
 	}
 
-	c, err := d.client.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	c, err := d.client.ContainerCreate(ctx, config, hostConfig, nil, nil, info.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.client.ContainerStart(ctx, c.ID, container.StartOptions{}); err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+// Wait blocks until the container exits and returns its exit code.
+func (d *Docker) Wait(ctx context.Context, id string) (int, error) {
+	statusCh, errCh := d.client.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return -1, fmt.Errorf("waiting for container %q: %w", id, err)
+	case status := <-statusCh:
+		if status.Error != nil && status.Error.Message != "" {
+			return -1, fmt.Errorf("waiting for container %q: %s", id, status.Error.Message)
+		}
+		return int(status.StatusCode), nil
+	}
+}
+
+// WaitForExit blocks until the container is no longer running or no longer exists.
+func (d *Docker) WaitForExit(ctx context.Context, id string) error {
+	statusCh, errCh := d.client.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("waiting for container %q: %w", id, err)
+	case <-statusCh:
+		return nil
+	}
+}
+
+// Stop sends signal to the container and kills it if it is still running after timeout.
+func (d *Docker) Stop(ctx context.Context, id string, signal syscall.Signal, timeout time.Duration) error {
+	secs := int(timeout.Seconds())
+	return d.client.ContainerStop(ctx, id, container.StopOptions{Signal: unix.SignalName(signal), Timeout: &secs})
+}
+
+// Kill sends signal to the container.
+func (d *Docker) Kill(ctx context.Context, id string, signal syscall.Signal) error {
+	return d.client.ContainerKill(ctx, id, unix.SignalName(signal))
+}
+
+// List returns the containers whose labels match selector.
+func (d *Docker) List(ctx context.Context, selector map[string]string) ([]runtime.Container, error) {
+	args := filters.NewArgs()
+	for _, f := range runtime.LabelFilters(selector) {
+		args.Add("label", f)
+	}
+	cons, err := d.client.ContainerList(ctx, container.ListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]runtime.Container, 0, len(cons))
+	for _, c := range cons {
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		out = append(out, runtime.Container{ID: c.ID, Name: name, Labels: c.Labels, Running: c.State == container.StateRunning})
+	}
+	return out, nil
+}
+
+// Remove removes the container and its anonymous volumes.
+func (d *Docker) Remove(ctx context.Context, id string) error {
+	return d.client.ContainerRemove(ctx, id, container.RemoveOptions{RemoveVolumes: true})
+}
+
+// Logs streams the container's stdout and stderr until the container exits.
+func (d *Docker) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	con, err := d.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	out, err := d.client.ContainerLogs(ctx, id, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
 	if err != nil {
 		return err
 	}
+	defer out.Close()
 
-	return d.client.ContainerStart(ctx, c.ID, container.StartOptions{})
+	// With a TTY the output is a single raw stream; otherwise it is multiplexed.
+	if con.Config.Tty {
+		_, err = io.Copy(stdout, out)
+		return err
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, out)
+	return err
 }
 
-// ImageExists reports whether the given image reference exists locally.
-func (d *Docker) ImageExists(ctx context.Context, imageRef string) bool {
-	_, err := d.client.ImageInspect(ctx, imageRef)
+// ImageExists reports whether the given image reference exists locally and returns its metadata.
+func (d *Docker) ImageExists(ctx context.Context, imageRef string) (runtime.ImageInfo, bool) {
+	img, err := d.client.ImageInspect(ctx, imageRef)
 	if err != nil {
 		// Any error means the image is not available locally (or the daemon is unreachable).
-		return false
+		return runtime.ImageInfo{}, false
 	}
-	return true
+	return runtime.ImageInfo{ID: img.ID, RepoDigests: img.RepoDigests}, true
 }
 
 // PullImage pulls the given image reference from a registry.
-func (d *Docker) PullImage(ctx context.Context, imageRef string) error {
-	out, err := d.client.ImagePull(ctx, imageRef, image.PullOptions{})
+func (d *Docker) PullImage(ctx context.Context, imageRef string, auth runtime.RegistryAuth) error {
+	var opts image.PullOptions
+	if !auth.IsZero() {
+		encoded, err := registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: auth.ServerAddress,
+		})
+		if err != nil {
+			return fmt.Errorf("encoding registry credentials: %w", err)
+		}
+		opts.RegistryAuth = encoded
+	}
+	out, err := d.client.ImagePull(ctx, imageRef, opts)
 	if err != nil {
 		return err
 	}
@@ -102,15 +245,161 @@ func (d *Docker) Close() error {
 
 // containerInfoFromInspect converts a Docker InspectResponse to a runtime.ContainerInfo.
 func containerInfoFromInspect(con container.InspectResponse) runtime.ContainerInfo {
+	var devices []runtime.DeviceMapping
+	for _, d := range con.HostConfig.Devices {
+		devices = append(devices, runtime.DeviceMapping{
+			PathOnHost:        d.PathOnHost,
+			PathInContainer:   d.PathInContainer,
+			CgroupPermissions: d.CgroupPermissions,
+		})
+	}
+	var ulimits []runtime.Ulimit
+	for _, u := range con.HostConfig.Ulimits {
+		ulimits = append(ulimits, runtime.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
 	return runtime.ContainerInfo{
+		ID:           con.ID,
 		Image:        con.Config.Image,
 		Env:          con.Config.Env,
+		Entrypoint:   con.Config.Entrypoint,
 		Cmd:          con.Config.Cmd,
+		WorkingDir:   con.Config.WorkingDir,
+		User:         con.Config.User,
 		Tty:          con.Config.Tty,
 		AttachStdout: con.Config.AttachStdout,
 		AttachStderr: con.Config.AttachStderr,
 		Privileged:   con.HostConfig.Privileged,
 		Binds:        con.HostConfig.Binds,
+		Mounts:       mountsFromHostConfig(con.HostConfig),
 		PidMode:      string(con.HostConfig.PidMode),
+		Devices:      devices,
+		IpcMode:      string(con.HostConfig.IpcMode),
+		UTSMode:      string(con.HostConfig.UTSMode),
+		CgroupnsMode: string(con.HostConfig.CgroupnsMode),
+		Resources:    resourcesFromHost(con.HostConfig.Resources),
+		Ulimits:      ulimits,
+		Sysctls:      con.HostConfig.Sysctls,
+		ShmSize:      con.HostConfig.ShmSize,
+
+		CapAdd:            con.HostConfig.CapAdd,
+		CapDrop:           con.HostConfig.CapDrop,
+		SecurityOpt:       con.HostConfig.SecurityOpt,
+		UsernsMode:        string(con.HostConfig.UsernsMode),
+		ReadonlyRootfs:    con.HostConfig.ReadonlyRootfs,
+		DeviceCgroupRules: con.HostConfig.DeviceCgroupRules,
+		NetworkMode:       string(con.HostConfig.NetworkMode),
+		DNS:               con.HostConfig.DNS,
+		DNSSearch:         con.HostConfig.DNSSearch,
+		ExtraHosts:        con.HostConfig.ExtraHosts,
+	}
+}
+
+// hostResources returns the Docker resources of info.
+func hostResources(info runtime.ContainerInfo) container.Resources {
+	r := info.Resources
+	res := container.Resources{
+		Memory:            r.Memory,
+		MemoryReservation: r.MemoryReservation,
+		MemorySwap:        r.MemorySwap,
+		NanoCPUs:          r.NanoCPUs,
+		CPUShares:         r.CPUShares,
+		CPUPeriod:         r.CPUPeriod,
+		CPUQuota:          r.CPUQuota,
+		CpusetCpus:        r.CpusetCpus,
+		CpusetMems:        r.CpusetMems,
+		DeviceCgroupRules: info.DeviceCgroupRules,
+	}
+	if r.PidsLimit != 0 {
+		res.PidsLimit = &r.PidsLimit
+	}
+	for _, u := range info.Ulimits {
+		res.Ulimits = append(res.Ulimits, &container.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+	return res
+}
+
+// resourcesFromHost returns the resource limits of Docker resources.
+func resourcesFromHost(res container.Resources) runtime.Resources {
+	r := runtime.Resources{
+		Memory:            res.Memory,
+		MemoryReservation: res.MemoryReservation,
+		MemorySwap:        res.MemorySwap,
+		NanoCPUs:          res.NanoCPUs,
+		CPUShares:         res.CPUShares,
+		CPUPeriod:         res.CPUPeriod,
+		CPUQuota:          res.CPUQuota,
+		CpusetCpus:        res.CpusetCpus,
+		CpusetMems:        res.CpusetMems,
+	}
+	if res.PidsLimit != nil {
+		r.PidsLimit = *res.PidsLimit
+	}
+	return r
+}
+
+// mountsFromHostConfig returns the --mount and --tmpfs mounts of a container.
+// Volumes given with --volume are in HostConfig.Binds and are not returned.
+func mountsFromHostConfig(hc *container.HostConfig) []runtime.Mount {
+	var mounts []runtime.Mount
+	for _, m := range hc.Mounts {
+		rm := runtime.Mount{
+			Type:     string(m.Type),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+		if m.BindOptions != nil {
+			rm.Propagation = string(m.BindOptions.Propagation)
+		}
+		if m.VolumeOptions != nil && m.VolumeOptions.NoCopy {
+			rm.Options = append(rm.Options, "nocopy")
+		}
+		if o := m.TmpfsOptions; o != nil {
+			if o.SizeBytes > 0 {
+				rm.Options = append(rm.Options, "size="+strconv.FormatInt(o.SizeBytes, 10))
+			}
+			if o.Mode != 0 {
+				rm.Options = append(rm.Options, "mode="+strconv.FormatUint(uint64(o.Mode.Perm()), 8))
+			}
+			for _, kv := range o.Options {
+				rm.Options = append(rm.Options, strings.Join(kv, "="))
+			}
+		}
+		mounts = append(mounts, rm)
+	}
+	for _, target := range slices.Sorted(maps.Keys(hc.Tmpfs)) {
+		mounts = append(mounts, runtime.TmpfsMount(target, hc.Tmpfs[target]))
+	}
+	return mounts
+}
+
+// applyMounts adds mounts to the host config. A tmpfs is added to HostConfig.Tmpfs and a bind
+// or volume to HostConfig.Mounts, except when it needs an SELinux relabel, which only the
+// --volume form in HostConfig.Binds supports.
+func applyMounts(hc *container.HostConfig, mounts []runtime.Mount) {
+	for _, m := range mounts {
+		switch {
+		case m.Type == runtime.MountTypeTmpfs:
+			if hc.Tmpfs == nil {
+				hc.Tmpfs = map[string]string{}
+			}
+			hc.Tmpfs[m.Target] = strings.Join(m.AllOptions(), ",")
+		case m.Relabel != "":
+			hc.Binds = append(hc.Binds, m.String())
+		default:
+			dm := mount.Mount{
+				Type:     mount.Type(m.Type),
+				Source:   m.Source,
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+			}
+			if m.Propagation != "" && m.Type == runtime.MountTypeBind {
+				dm.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(m.Propagation)}
+			}
+			if slices.Contains(m.Options, "nocopy") && m.Type == runtime.MountTypeVolume {
+				dm.VolumeOptions = &mount.VolumeOptions{NoCopy: true}
+			}
+			hc.Mounts = append(hc.Mounts, dm)
+		}
 	}
 }
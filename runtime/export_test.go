@@ -0,0 +1,8 @@
+package runtime
+
+// Export the parsers behind SelfIDs for the tests, which use sample files instead of the real /proc.
+var (
+	SelfIDsFrom  = selfIDs
+	MountinfoIDs = mountinfoIDs
+	CgroupIDs    = cgroupIDs
+)
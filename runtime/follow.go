@@ -0,0 +1,90 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FollowFile reads the file at path line by line, like tail -f, and passes
+// each complete line (without the trailing newline) to handle. The line is
+// only valid for the duration of the call.
+// When the end of the file is reached, stopped is called; once it reports true
+// the remaining lines are read and FollowFile returns. Otherwise it polls for
+// new data every interval. It is used by runtimes whose container output is
+// written to log files rather than served over an API.
+func FollowFile(ctx context.Context, path string, interval time.Duration, stopped func(context.Context) (bool, error), handle func(line []byte)) error {
+	f, err := openWhenExists(ctx, path, interval, stopped)
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var partial []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		partial = append(partial, line...)
+		if err == nil {
+			handle(partial[:len(partial)-1])
+			partial = partial[:0]
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading %q: %w", path, err)
+		}
+
+		done, err := stopped(ctx)
+		if err != nil {
+			return err
+		}
+		if done {
+			// Drain anything written between the last read and the stop check.
+			rest, _ := io.ReadAll(r)
+			partial = append(partial, rest...)
+			for len(partial) > 0 {
+				var line []byte
+				line, partial, _ = bytes.Cut(partial, []byte{'\n'})
+				handle(line)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// openWhenExists opens the file at path, waiting for it to be created.
+// It returns a nil file and no error when the container stops before the file exists.
+func openWhenExists(ctx context.Context, path string, interval time.Duration, stopped func(context.Context) (bool, error)) (*os.File, error) {
+	for {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("opening %q: %w", path, err)
+		}
+		done, err := stopped(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return nil, nil //nolint:nilnil // no file and no error means there is nothing to follow.
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package runtime
+
+import (
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// ImageInfo is the metadata of a local image, returned by Runtime.ImageExists.
+type ImageInfo struct {
+	// ID is the image ID: the digest of the image config, or of the manifest for containerd.
+	ID string
+	// RepoDigests are the repository digests of the image in "name@sha256:..." form.
+	// They are empty for an image that was not pulled from a registry.
+	RepoDigests []string
+}
+
+// Digest returns the digest of the first repository digest, e.g. "sha256:...",
+// or an empty string when the image has none.
+func (i ImageInfo) Digest() string {
+	for _, rd := range i.RepoDigests {
+		if _, d, ok := strings.Cut(rd, "@"); ok {
+			return d
+		}
+	}
+	return ""
+}
+
+// HasDigest reports whether one of the repository digests of the image is digest.
+func (i ImageInfo) HasDigest(digest string) bool {
+	for _, rd := range i.RepoDigests {
+		if _, d, ok := strings.Cut(rd, "@"); ok && d == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// PinnedDigest returns the digest an image reference is pinned to, e.g. "sha256:..." for
+// "alpine@sha256:...", or an empty string when the reference has no digest.
+func PinnedDigest(imageRef string) string {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return ""
+	}
+	if d, ok := named.(reference.Digested); ok {
+		return d.Digest().String()
+	}
+	return ""
+}
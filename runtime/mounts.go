@@ -0,0 +1,89 @@
+package runtime
+
+import (
+	"strings"
+)
+
+// Mount types.
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// Mount is a mount that is not a plain host bind, e.g. a named or anonymous volume, a tmpfs,
+// or a mount given with --mount. Plain "host:container" binds are kept in ContainerInfo.Binds.
+type Mount struct {
+	// Type is MountTypeBind, MountTypeVolume or MountTypeTmpfs.
+	Type string
+	// Source is the host path of a bind or the name of a volume. It is empty for a tmpfs
+	// and for an anonymous volume, which gets a new volume in every container.
+	Source string
+	// Target is the path in the container.
+	Target string
+	// ReadOnly mounts the source read-only.
+	ReadOnly bool
+	// Propagation is the bind propagation, e.g. "rprivate" or "rshared". Empty means the runtime default.
+	Propagation string
+	// Relabel is the SELinux relabel option of a bind or volume: "z" (shared) or "Z" (private).
+	Relabel string
+	// Options are the remaining mount options, e.g. "nocopy" for a volume or "size=64m" for a tmpfs.
+	Options []string
+}
+
+// String returns the mount in the "[source:]target[:options]" form of the --volume flag,
+// or the "target[:options]" form of the --tmpfs flag for a tmpfs.
+func (m Mount) String() string {
+	s := m.Target
+	if m.Type != MountTypeTmpfs && m.Source != "" {
+		s = m.Source + ":" + s
+	}
+	if opts := m.AllOptions(); len(opts) > 0 {
+		s += ":" + strings.Join(opts, ",")
+	}
+	return s
+}
+
+// AllOptions returns ReadOnly, Propagation, Relabel and Options as a single option list.
+func (m Mount) AllOptions() []string {
+	var opts []string
+	if m.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	if m.Propagation != "" {
+		opts = append(opts, m.Propagation)
+	}
+	if m.Relabel != "" {
+		opts = append(opts, m.Relabel)
+	}
+	return append(opts, m.Options...)
+}
+
+// ParseMountOptions splits an option list, such as the options of a --volume or --tmpfs flag,
+// into the ReadOnly, Propagation, Relabel and Options fields of m.
+func (m *Mount) ParseMountOptions(opts []string) {
+	for _, o := range opts {
+		switch o {
+		case "":
+		case "ro", "readonly":
+			m.ReadOnly = true
+		case "rw":
+			m.ReadOnly = false
+		case "shared", "rshared", "slave", "rslave", "private", "rprivate":
+			m.Propagation = o
+		case "z", "Z":
+			m.Relabel = o
+		default:
+			m.Options = append(m.Options, o)
+		}
+	}
+}
+
+// TmpfsMount returns the tmpfs mount for a --tmpfs target and its comma separated options.
+func TmpfsMount(target, opts string) Mount {
+	m := Mount{Type: MountTypeTmpfs, Target: target}
+	if opts != "" {
+		m.ParseMountOptions(strings.Split(opts, ","))
+	}
+	return m
+}
@@ -0,0 +1,23 @@
+package nerdctl
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+// WriteDockerConfig exports writeDockerConfig for the tests.
+func (c *Nerdctl) WriteDockerConfig(auth runtime.RegistryAuth) (string, error) {
+	return c.writeDockerConfig(auth)
+}
+
+// HostPath exports hostPath for the tests.
+func (c *Nerdctl) HostPath(path string) string {
+	return c.hostPath(path)
+}
+
+// Command exports command for the tests.
+func (c *Nerdctl) Command(ctx context.Context) *exec.Cmd {
+	return c.command(ctx)
+}
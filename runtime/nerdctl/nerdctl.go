@@ -1,29 +1,58 @@
 // Package nerdctl implements the runtime.Runtime interface using the ctrctl CLI wrapper.
-// This supports the nerdctl CLI.
+// This supports the nerdctl and docker CLIs.
 package nerdctl
 
 import (
+	"cmp"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jacobweinstock/waitdaemon/runtime"
+	"golang.org/x/sys/unix"
 	"lesiw.io/ctrctl"
 )
 
+// exitPollInterval is how often WaitForExit checks whether a container is still running.
+const exitPollInterval = time.Second
+
 // Nerdctl implements runtime.Runtime by shelling out to a container CLI.
 type Nerdctl struct {
 	cli []string
+	// docker is true when the CLI is docker rather than nerdctl.
+	// The docker CLI reports a complete inspect output, so the nerdctl fallbacks are skipped.
+	docker bool
 }
 
 // New creates a Ctrctl runtime using the specified CLI command.
 // cli is the command prefix, e.g. []string{"nerdctl"} or []string{"docker"}.
 func New(cli []string) (*Nerdctl, error) {
 	ctrctl.Cli = cli
-	return &Nerdctl{cli: cli}, nil
+	return &Nerdctl{cli: cli, docker: isDockerCLI(cli)}, nil
+}
+
+// isDockerCLI reports whether the CLI binary in the command prefix is docker.
+// The binary is the first element, or the first element after "--" when the
+// command is wrapped (e.g. by nsenter).
+func isDockerCLI(cli []string) bool {
+	if i := slices.Index(cli, "--"); i >= 0 {
+		cli = cli[i+1:]
+	}
+	if len(cli) == 0 {
+		return false
+	}
+	return filepath.Base(cli[0]) == "docker"
 }
 
 // Ping verifies the CLI is available and responsive.
@@ -35,6 +64,7 @@ func (c *Nerdctl) Ping(_ context.Context) error {
 // inspectResponse is the subset of the JSON returned by `<cli> container inspect`.
 // This is compatible across docker and nerdctl.
 type inspectResponse struct {
+	ID string `json:"Id"`
 	// Path is the top-level process binary path (e.g. the resolved entrypoint).
 	// nerdctl reliably populates this even when Config.Cmd is empty.
 	Path string `json:"Path"`
@@ -48,17 +78,57 @@ type inspectResponse struct {
 		Env          []string `json:"Env"`
 		Cmd          []string `json:"Cmd"`
 		Entrypoint   []string `json:"Entrypoint"`
+		WorkingDir   string   `json:"WorkingDir"`
+		User         string   `json:"User"`
 		Tty          bool     `json:"Tty"`
 		AttachStdout bool     `json:"AttachStdout"`
 		AttachStderr bool     `json:"AttachStderr"`
+		// Labels holds the nerdctl/* labels nerdctl records its run settings in.
+		Labels map[string]string `json:"Labels"`
 	} `json:"Config"`
 	HostConfig struct {
-		Privileged bool     `json:"Privileged"`
-		Binds      []string `json:"Binds"`
-		PidMode    string   `json:"PidMode"`
+		Privileged        bool              `json:"Privileged"`
+		CapAdd            []string          `json:"CapAdd"`
+		CapDrop           []string          `json:"CapDrop"`
+		SecurityOpt       []string          `json:"SecurityOpt"`
+		UsernsMode        string            `json:"UsernsMode"`
+		ReadonlyRootfs    bool              `json:"ReadonlyRootfs"`
+		Binds             []string          `json:"Binds"`
+		Mounts            hostConfigMounts  `json:"Mounts"`
+		Tmpfs             map[string]string `json:"Tmpfs"`
+		PidMode           string            `json:"PidMode"`
+		IpcMode           string            `json:"IpcMode"`
+		UTSMode           string            `json:"UTSMode"`
+		CgroupnsMode      string            `json:"CgroupnsMode"`
+		Memory            int64             `json:"Memory"`
+		MemoryReservation int64             `json:"MemoryReservation"`
+		MemorySwap        int64             `json:"MemorySwap"`
+		NanoCPUs          int64             `json:"NanoCpus"`
+		CPUShares         int64             `json:"CpuShares"`
+		CPUPeriod         int64             `json:"CpuPeriod"`
+		CPUQuota          int64             `json:"CpuQuota"`
+		CpusetCpus        string            `json:"CpusetCpus"`
+		CpusetMems        string            `json:"CpusetMems"`
+		PidsLimit         *int64            `json:"PidsLimit"`
+		Ulimits           []runtime.Ulimit  `json:"Ulimits"`
+		Sysctls           map[string]string `json:"Sysctls"`
+		ShmSize           int64             `json:"ShmSize"`
+		NetworkMode       string            `json:"NetworkMode"`
+		DNS               []string          `json:"Dns"`
+		DNSSearch         []string          `json:"DnsSearch"`
+		ExtraHosts        []string          `json:"ExtraHosts"`
+		Devices           []deviceMapping   `json:"Devices"`
+		DeviceCgroupRules []string          `json:"DeviceCgroupRules"`
 	} `json:"HostConfig"`
 }
 
+// deviceMapping is a single entry of the inspect HostConfig.Devices array.
+type deviceMapping struct {
+	PathOnHost        string `json:"PathOnHost"`
+	PathInContainer   string `json:"PathInContainer"`
+	CgroupPermissions string `json:"CgroupPermissions"`
+}
+
 // mountEntry represents a single mount from the inspect Mounts array.
 // nerdctl populates Mounts instead of HostConfig.Binds.
 type mountEntry struct {
@@ -72,21 +142,70 @@ type mountEntry struct {
 	// Propagation holds mount propagation settings (e.g. "rprivate").
 	// Docker separates this from Mode; nerdctl may put it in either field.
 	Propagation string `json:"Propagation"`
+	// Name is the volume name of a volume mount.
+	Name string `json:"Name"`
 }
 
-// InspectSelf inspects the current container using os.Hostname() as the container ID.
-func (c *Nerdctl) InspectSelf(_ context.Context) (runtime.ContainerInfo, error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return runtime.ContainerInfo{}, fmt.Errorf("getting hostname: %w", err)
+// hostConfigMounts is the inspect HostConfig.Mounts array of mounts given with --mount.
+// Only docker populates it.
+type hostConfigMounts []struct {
+	Type        string `json:"Type"`
+	Source      string `json:"Source"`
+	Target      string `json:"Target"`
+	ReadOnly    bool   `json:"ReadOnly"`
+	BindOptions *struct {
+		Propagation string `json:"Propagation"`
+	} `json:"BindOptions"`
+	VolumeOptions *struct {
+		NoCopy bool `json:"NoCopy"`
+	} `json:"VolumeOptions"`
+	TmpfsOptions *struct {
+		SizeBytes int64       `json:"SizeBytes"`
+		Mode      os.FileMode `json:"Mode"`
+	} `json:"TmpfsOptions"`
+}
+
+// toRuntime converts the mounts to runtime.Mount.
+func (hm hostConfigMounts) toRuntime() []runtime.Mount {
+	var mounts []runtime.Mount
+	for _, m := range hm {
+		rm := runtime.Mount{Type: m.Type, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+		if m.BindOptions != nil {
+			rm.Propagation = m.BindOptions.Propagation
+		}
+		if m.VolumeOptions != nil && m.VolumeOptions.NoCopy {
+			rm.Options = append(rm.Options, "nocopy")
+		}
+		if o := m.TmpfsOptions; o != nil {
+			if o.SizeBytes > 0 {
+				rm.Options = append(rm.Options, "size="+strconv.FormatInt(o.SizeBytes, 10))
+			}
+			if o.Mode != 0 {
+				rm.Options = append(rm.Options, "mode="+strconv.FormatUint(uint64(o.Mode.Perm()), 8))
+			}
+		}
+		mounts = append(mounts, rm)
 	}
+	return mounts
+}
+
+// InspectSelf inspects the current container. It is found by the IDs from runtime.SelfIDs: the
+// container ID in the /etc/hostname mount source, which also works with the host network, or else
+// the hostname, which nerdctl and docker set to the container short ID.
+func (c *Nerdctl) InspectSelf(ctx context.Context) (runtime.ContainerInfo, error) {
+	return runtime.InspectFirst(ctx, runtime.SelfIDs(), func(_ context.Context, id string) (runtime.ContainerInfo, error) {
+		return c.inspect(id)
+	})
+}
 
+// inspect returns the container configuration of the container with the given ID or name.
+func (c *Nerdctl) inspect(id string) (runtime.ContainerInfo, error) {
 	out, err := ctrctl.ContainerInspect(
 		&ctrctl.ContainerInspectOpts{Format: "{{json .}}"},
-		hostname,
+		id,
 	)
 	if err != nil {
-		return runtime.ContainerInfo{}, fmt.Errorf("inspecting container %q: %w", hostname, err)
+		return runtime.ContainerInfo{}, fmt.Errorf("inspecting container %q: %w", id, err)
 	}
 
 	var info runtime.ContainerInfo
@@ -94,20 +213,24 @@ func (c *Nerdctl) InspectSelf(_ context.Context) (runtime.ContainerInfo, error)
 	// nerdctl may return an array; try array first, then single object.
 	var responses []inspectResponse
 	if err := json.Unmarshal([]byte(out), &responses); err == nil && len(responses) > 0 {
-		info = infoFromInspect(responses[0])
+		info = infoFromInspect(responses[0], c.docker)
 	} else {
 		var resp inspectResponse
 		if err := json.Unmarshal([]byte(out), &resp); err != nil {
 			return runtime.ContainerInfo{}, fmt.Errorf("parsing inspect output: %w", err)
 		}
-		info = infoFromInspect(resp)
+		info = infoFromInspect(resp, c.docker)
 	}
 
-	// nerdctl does not populate HostConfig.Privileged or HostConfig.PidMode.
-	// Detect them from /proc as a fallback.
-	if !info.Privileged {
-		info.Privileged = detectPrivileged()
+	// Docker's HostConfig is authoritative, so no fallback is needed.
+	if c.docker {
+		return info, nil
 	}
+
+	// nerdctl does not populate HostConfig.Privileged, the capabilities, the
+	// security options, HostConfig.ReadonlyRootfs or HostConfig.PidMode.
+	// Detect them from /proc as a fallback.
+	detectSecurity(&info)
 	if info.PidMode == "" {
 		info.PidMode = detectPidMode()
 	}
@@ -115,140 +238,555 @@ func (c *Nerdctl) InspectSelf(_ context.Context) (runtime.ContainerInfo, error)
 	return info, nil
 }
 
-func infoFromInspect(resp inspectResponse) runtime.ContainerInfo { //nolint:gocognit // fine for now.
-	// Use Config.Cmd as the command (CMD portion only, without entrypoint).
-	// The container runtime applies the image's entrypoint automatically,
-	// so merging entrypoint into cmd here would cause it to be doubled
-	// when RunContainer creates a new container.
-	cmd := resp.Config.Cmd
-
-	// Fallback: nerdctl may not populate Config.Cmd reliably (similar to how
-	// it omits HostConfig.Privileged and HostConfig.PidMode). Use the top-level
-	// Args field which nerdctl always populates from the OCI process spec.
-	if len(cmd) == 0 && len(resp.Args) > 0 {
-		cmd = resp.Args
+// infoFromInspect converts inspect output to a runtime.ContainerInfo.
+// docker selects the docker CLI behaviour: Config.Cmd and HostConfig.Binds are
+// authoritative and the nerdctl fallbacks for Cmd and Binds are not applied.
+// Docker's top-level Args include the entrypoint arguments, and its Mounts also
+// list anonymous and named volumes that must not become bind mounts.
+func infoFromInspect(resp inspectResponse, docker bool) runtime.ContainerInfo { //nolint:gocognit // fine for now.
+	// Use Config.Entrypoint and Config.Cmd as the entrypoint and command.
+	entrypoint, cmd := resp.Config.Entrypoint, resp.Config.Cmd
+	workdir := resp.Config.WorkingDir
+
+	// Fallback: nerdctl may not populate Config.Entrypoint and Config.Cmd reliably
+	// (similar to how it omits HostConfig.Privileged and HostConfig.PidMode). Split the
+	// top-level Path and Args, which nerdctl always populates from the OCI process spec.
+	// nerdctl also reports the OCI default working directory "/" when none is set.
+	if !docker {
+		entrypoint, cmd = splitProcessArgs(resp.Path, resp.Args, entrypoint, cmd)
+		if workdir == "/" {
+			workdir = ""
+		}
 	}
 
-	// Use HostConfig.Binds if available (Docker), otherwise build from Mounts (nerdctl).
+	// Use HostConfig.Binds and HostConfig.Mounts if available (Docker), otherwise build from Mounts (nerdctl).
 	binds := resp.HostConfig.Binds
-	if len(binds) == 0 && len(resp.Mounts) > 0 { //nolint:nestif // fine for now.
-		for _, m := range resp.Mounts {
-			if !strings.EqualFold(m.Type, "bind") {
-				continue
-			}
-			// Resolve destination: some nerdctl versions use
-			// "Target" instead of "Destination".
-			dest := m.Destination
-			if dest == "" {
-				dest = m.Target
-			}
-			if dest == "" {
-				continue
-			}
-			// Skip nerdctl-internal mounts. nerdctl creates per-container temp
-			// directories (e.g. /tmp/tink-dns-XXXXX/) for /etc/resolv.conf,
-			// /etc/hosts, and /etc/hostname. These sources won't exist for a
-			// new container and nerdctl will create its own.
-			if isNerdctlInternalMount(dest) {
-				continue
-			}
-			bind := m.Source + ":" + dest
-			opts := mountOptions(m)
-			if len(opts) > 0 {
-				bind += ":" + strings.Join(opts, ",")
-			}
-			binds = append(binds, bind)
+	mounts := resp.HostConfig.Mounts.toRuntime()
+	if !docker && len(binds) == 0 && len(resp.Mounts) > 0 {
+		binds, mounts = mountsFromEntries(resp.Mounts)
+	}
+	for _, target := range slices.Sorted(maps.Keys(resp.HostConfig.Tmpfs)) {
+		if !slices.ContainsFunc(mounts, func(m runtime.Mount) bool { return m.Target == target }) {
+			mounts = append(mounts, runtime.TmpfsMount(target, resp.HostConfig.Tmpfs[target]))
 		}
 	}
 
-	return runtime.ContainerInfo{
+	info := runtime.ContainerInfo{
+		ID:           resp.ID,
 		Image:        resp.Config.Image,
 		Env:          resp.Config.Env,
+		Entrypoint:   entrypoint,
 		Cmd:          cmd,
+		WorkingDir:   workdir,
+		User:         resp.Config.User,
 		Tty:          resp.Config.Tty,
 		AttachStdout: resp.Config.AttachStdout,
 		AttachStderr: resp.Config.AttachStderr,
 		Privileged:   resp.HostConfig.Privileged,
 		Binds:        binds,
-		PidMode:      resp.HostConfig.PidMode,
+		Mounts:       mounts,
+		IpcMode:      resp.HostConfig.IpcMode,
+		UTSMode:      resp.HostConfig.UTSMode,
+		CgroupnsMode: resp.HostConfig.CgroupnsMode,
+		Resources: runtime.Resources{
+			Memory:            resp.HostConfig.Memory,
+			MemoryReservation: resp.HostConfig.MemoryReservation,
+			MemorySwap:        resp.HostConfig.MemorySwap,
+			NanoCPUs:          resp.HostConfig.NanoCPUs,
+			CPUShares:         resp.HostConfig.CPUShares,
+			CPUPeriod:         resp.HostConfig.CPUPeriod,
+			CPUQuota:          resp.HostConfig.CPUQuota,
+			CpusetCpus:        resp.HostConfig.CpusetCpus,
+			CpusetMems:        resp.HostConfig.CpusetMems,
+		},
+		Ulimits:     resp.HostConfig.Ulimits,
+		Sysctls:     resp.HostConfig.Sysctls,
+		ShmSize:     resp.HostConfig.ShmSize,
+		PidMode:     resp.HostConfig.PidMode,
+		NetworkMode: resp.HostConfig.NetworkMode,
+		DNS:         resp.HostConfig.DNS,
+		DNSSearch:   resp.HostConfig.DNSSearch,
+		ExtraHosts:  resp.HostConfig.ExtraHosts,
+
+		CapAdd:            resp.HostConfig.CapAdd,
+		CapDrop:           resp.HostConfig.CapDrop,
+		SecurityOpt:       resp.HostConfig.SecurityOpt,
+		UsernsMode:        resp.HostConfig.UsernsMode,
+		ReadonlyRootfs:    resp.HostConfig.ReadonlyRootfs,
+		DeviceCgroupRules: resp.HostConfig.DeviceCgroupRules,
+	}
+	for _, d := range resp.HostConfig.Devices {
+		info.Devices = append(info.Devices, runtime.DeviceMapping(d))
+	}
+	if resp.HostConfig.PidsLimit != nil {
+		info.Resources.PidsLimit = *resp.HostConfig.PidsLimit
+	}
+	if !docker {
+		networkFromLabels(&info, resp.Config.Labels)
+	}
+	return info
+}
+
+// Labels nerdctl records network settings in. Each holds a JSON value.
+const (
+	networksLabel   = "nerdctl/networks"
+	extraHostsLabel = "nerdctl/extraHosts"
+	dnsLabel        = "nerdctl/dns"
+)
+
+// networkFromLabels fills the network settings nerdctl leaves out of HostConfig from its nerdctl/* labels.
+// Settings that are already set, or labels that cannot be parsed, are left alone.
+func networkFromLabels(info *runtime.ContainerInfo, labels map[string]string) {
+	var networks []string
+	if info.NetworkMode == "" && json.Unmarshal([]byte(labels[networksLabel]), &networks) == nil && len(networks) > 0 {
+		info.NetworkMode = networks[0]
+	}
+	var hosts []string
+	if len(info.ExtraHosts) == 0 && json.Unmarshal([]byte(labels[extraHostsLabel]), &hosts) == nil {
+		info.ExtraHosts = hosts
+	}
+	var dns struct {
+		DNSServers       []string `json:"DNSServers"`
+		DNSSearchDomains []string `json:"DNSSearchDomains"`
+	}
+	if json.Unmarshal([]byte(labels[dnsLabel]), &dns) == nil {
+		if len(info.DNS) == 0 {
+			info.DNS = dns.DNSServers
+		}
+		if len(info.DNSSearch) == 0 {
+			info.DNSSearch = dns.DNSSearchDomains
+		}
 	}
 }
 
 // RunContainer creates and starts a detached container with the given configuration.
-func (c *Nerdctl) RunContainer(_ context.Context, info runtime.ContainerInfo) error {
+func (c *Nerdctl) RunContainer(_ context.Context, info runtime.ContainerInfo) (string, error) {
 	opts := &ctrctl.ContainerRunOpts{
 		Detach:     true,
 		Env:        info.Env,
 		Volume:     info.Binds,
 		Tty:        info.Tty,
 		Privileged: info.Privileged,
+		CapAdd:     info.CapAdd,
+		CapDrop:    info.CapDrop,
+		Userns:     info.UsernsMode,
+		ReadOnly:   info.ReadonlyRootfs,
+		Name:       info.Name,
+		Rm:         info.AutoRemove,
+		Network:    info.NetworkMode,
+		Dns:        info.DNS,
+		DnsSearch:  info.DNSSearch,
+		AddHost:    info.ExtraHosts,
+
+		SecurityOpt:      info.SecurityOpt,
+		DeviceCgroupRule: info.DeviceCgroupRules,
+	}
+	for _, m := range info.Mounts {
+		if m.Type == runtime.MountTypeTmpfs {
+			opts.Tmpfs = append(opts.Tmpfs, m.String())
+			continue
+		}
+		opts.Volume = append(opts.Volume, m.String())
+	}
+	for _, d := range info.Devices {
+		opts.Device = append(opts.Device, d.String())
+	}
+	applyResources(opts, info)
+	for k, v := range info.Labels {
+		opts.Label = append(opts.Label, k+"="+v)
 	}
 
 	if info.PidMode != "" {
 		opts.Pid = info.PidMode
 	}
 
+	opts.Workdir = info.WorkingDir
+	opts.User = info.User
+
+	// --entrypoint takes a single executable, so the rest of the entrypoint is
+	// passed ahead of the command.
+	argv := info.Cmd
+	if len(info.Entrypoint) > 0 {
+		opts.Entrypoint = info.Entrypoint[0]
+		argv = append(slices.Clone(info.Entrypoint[1:]), info.Cmd...)
+	}
 	var command string
 	var args []string
-	if len(info.Cmd) > 0 {
-		command = info.Cmd[0]
-		if len(info.Cmd) > 1 {
-			args = info.Cmd[1:]
+	if len(argv) > 0 {
+		command = argv[0]
+		if len(argv) > 1 {
+			args = argv[1:]
 		}
 	}
 
-	_, err := ctrctl.ContainerRun(opts, info.Image, command, args...)
+	// In detached mode the CLI prints the new container ID.
+	out, err := ctrctl.ContainerRun(opts, info.Image, command, args...)
 	if err != nil {
-		return fmt.Errorf("running container with image %q: %w", info.Image, err)
+		return "", fmt.Errorf("running container with image %q: %w", info.Image, err)
 	}
-	return nil
+	return strings.TrimSpace(out), nil
 }
 
-// ImageExists reports whether the given image reference exists locally.
-func (c *Nerdctl) ImageExists(_ context.Context, imageRef string) bool {
-	_, err := ctrctl.ImageInspect(&ctrctl.ImageInspectOpts{}, imageRef)
+// splitProcessArgs returns the entrypoint and command of a container whose process is
+// path followed by args. A known entrypoint or command is kept; otherwise path is
+// reported as the entrypoint and args as the command.
+func splitProcessArgs(path string, args, entrypoint, cmd []string) ([]string, []string) {
+	if path == "" || len(entrypoint) > 0 {
+		return entrypoint, cmd
+	}
+	argv := append([]string{path}, args...)
+	switch {
+	case len(cmd) == 0:
+		return []string{path}, args
+	case slices.Equal(argv, cmd):
+		// The image has no entrypoint.
+		return nil, cmd
+	case len(argv) > len(cmd) && slices.Equal(argv[len(argv)-len(cmd):], cmd):
+		return argv[:len(argv)-len(cmd)], cmd
+	}
+	return entrypoint, cmd
+}
 
-	return err == nil
+// applyResources sets the resource limits, ulimits, sysctls, shm size and IPC, UTS and
+// cgroup namespace modes of info on opts. The CLI wrapper takes a single --sysctl value, so
+// only the first sysctl by name is set; Warnings reports the others.
+func applyResources(opts *ctrctl.ContainerRunOpts, info runtime.ContainerInfo) {
+	formatInt := func(n int64) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	r := info.Resources
+	opts.Memory = formatInt(r.Memory)
+	opts.MemoryReservation = formatInt(r.MemoryReservation)
+	opts.MemorySwap = formatInt(r.MemorySwap)
+	if r.NanoCPUs != 0 {
+		opts.Cpus = strconv.FormatFloat(float64(r.NanoCPUs)/1e9, 'f', -1, 64)
+	}
+	opts.CpuShares = formatInt(r.CPUShares)
+	opts.CpuPeriod = formatInt(r.CPUPeriod)
+	opts.CpuQuota = formatInt(r.CPUQuota)
+	opts.CpusetCpus = r.CpusetCpus
+	opts.CpusetMems = r.CpusetMems
+	opts.PidsLimit = formatInt(r.PidsLimit)
+	for _, u := range info.Ulimits {
+		opts.Ulimit = append(opts.Ulimit, u.String())
+	}
+	if keys := slices.Sorted(maps.Keys(info.Sysctls)); len(keys) > 0 {
+		opts.Sysctl = keys[0] + "=" + info.Sysctls[keys[0]]
+	}
+	opts.ShmSize = formatInt(info.ShmSize)
+	opts.Ipc = info.IpcMode
+	opts.Uts = info.UTSMode
+	opts.Cgroupns = info.CgroupnsMode
 }
 
-// PullImage pulls the given image reference from a registry.
-func (c *Nerdctl) PullImage(_ context.Context, imageRef string) error {
-	_, err := ctrctl.ImagePull(
-		&ctrctl.ImagePullOpts{
-			Cmd: &exec.Cmd{
-				Stdout: os.Stdout,
-				Stderr: os.Stderr,
-			},
+// Warnings reports the sysctls of info after the first by name, which RunContainer drops.
+func (c *Nerdctl) Warnings(info runtime.ContainerInfo) []string {
+	keys := slices.Sorted(maps.Keys(info.Sysctls))
+	if len(keys) <= 1 {
+		return nil
+	}
+	return []string{fmt.Sprintf("only one sysctl is supported by the nerdctl runtime, %q is set and %q are not", keys[0], keys[1:])}
+}
+
+// Wait blocks until the container exits or ctx is done and returns its exit code.
+func (c *Nerdctl) Wait(ctx context.Context, id string) (int, error) {
+	out, err := ctrctl.ContainerWait(&ctrctl.ContainerWaitOpts{Cmd: c.command(ctx)}, id)
+	if err := cmp.Or(ctx.Err(), err); err != nil {
+		return -1, fmt.Errorf("waiting for container %q: %w", id, err)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return -1, fmt.Errorf("parsing exit code of container %q: %w", id, err)
+	}
+	return code, nil
+}
+
+// WaitForExit polls the container until it is no longer running or no longer exists.
+// `wait` is not used because it fails when the container is removed while waiting,
+// which is what happens to Tinkerbell action containers once they exit.
+func (c *Nerdctl) WaitForExit(ctx context.Context, id string) error {
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+	for {
+		out, err := ctrctl.ContainerInspect(&ctrctl.ContainerInspectOpts{Format: "{{.State.Running}}"}, id)
+		if err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("inspecting container %q: %w", id, err)
+		}
+		if strings.TrimSpace(out) != "true" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// isNotFound reports whether a CLI error says the container does not exist.
+// The CLIs only report this in their error output: docker prints "No such container"
+// and nerdctl prints "no such container" or "not found".
+func isNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such") || strings.Contains(msg, "not found")
+}
+
+// Stop sends signal to the container and kills it if it is still running after timeout.
+func (c *Nerdctl) Stop(_ context.Context, id string, signal syscall.Signal, timeout time.Duration) error {
+	_, err := ctrctl.ContainerStop(
+		&ctrctl.ContainerStopOpts{
+			Signal: unix.SignalName(signal),
+			Time:   strconv.Itoa(int(timeout.Seconds())),
 		},
-		imageRef,
+		id,
 	)
 	return err
 }
 
+// Kill sends signal to the container.
+func (c *Nerdctl) Kill(_ context.Context, id string, signal syscall.Signal) error {
+	_, err := ctrctl.ContainerKill(&ctrctl.ContainerKillOpts{Signal: unix.SignalName(signal)}, id)
+	return err
+}
+
+// psEntry is a line of `<cli> container ls --format '{{json .}}'` output.
+type psEntry struct {
+	ID    string `json:"ID"`
+	Names string `json:"Names"`
+	// Labels is a "key=value,key=value" string; some nerdctl versions print an object instead.
+	Labels json.RawMessage `json:"Labels"`
+	// State is set by docker ("running"); nerdctl only sets Status ("Up", "Exited (0) ...").
+	State  string `json:"State"`
+	Status string `json:"Status"`
+}
+
+// List returns the containers whose labels match selector.
+func (c *Nerdctl) List(_ context.Context, selector map[string]string) ([]runtime.Container, error) {
+	filters := make([]string, 0, len(selector))
+	for _, f := range runtime.LabelFilters(selector) {
+		filters = append(filters, "label="+f)
+	}
+	out, err := ctrctl.ContainerLs(&ctrctl.ContainerLsOpts{All: true, Filter: filters, Format: "{{json .}}", NoTrunc: true})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	var cons []runtime.Container
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		var e psEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("parsing container list output: %w", err)
+		}
+		con := runtime.Container{
+			ID:      e.ID,
+			Name:    e.Names,
+			Labels:  parseLabels(e.Labels),
+			Running: e.State == "running" || strings.HasPrefix(e.Status, "Up"),
+		}
+		// Not every nerdctl version applies label filters, so match again here.
+		if runtime.MatchLabels(con.Labels, selector) {
+			cons = append(cons, con)
+		}
+	}
+	return cons, nil
+}
+
+// parseLabels parses the labels of a container list entry.
+func parseLabels(raw json.RawMessage) map[string]string {
+	labels := map[string]string{}
+	if err := json.Unmarshal(raw, &labels); err == nil {
+		return labels
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil || s == "" {
+		return labels
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		labels[k] = v
+	}
+	return labels
+}
+
+// Remove removes the container and its anonymous volumes.
+func (c *Nerdctl) Remove(_ context.Context, id string) error {
+	_, err := ctrctl.ContainerRm(&ctrctl.ContainerRmOpts{Volumes: true}, id)
+	return err
+}
+
+// Logs streams the container's stdout and stderr until the container exits or ctx is done.
+func (c *Nerdctl) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	cmd := c.command(ctx)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	_, err := ctrctl.ContainerLogs(&ctrctl.ContainerLogsOpts{Cmd: cmd, Follow: true}, id)
+	return cmp.Or(ctx.Err(), err)
+}
+
+// command returns a base command for a ctrctl call whose process is killed when ctx is done.
+// ctrctl sets the Path and Args of the command and keeps the rest, including the context.
+func (c *Nerdctl) command(ctx context.Context) *exec.Cmd {
+	if len(c.cli) == 0 {
+		return &exec.Cmd{}
+	}
+	return exec.CommandContext(ctx, c.cli[0])
+}
+
+// ImageExists reports whether the given image reference exists locally and returns its metadata.
+// The metadata is left empty when the inspect output cannot be parsed.
+func (c *Nerdctl) ImageExists(_ context.Context, imageRef string) (runtime.ImageInfo, bool) {
+	out, err := ctrctl.ImageInspect(&ctrctl.ImageInspectOpts{}, imageRef)
+	if err != nil {
+		return runtime.ImageInfo{}, false
+	}
+	var resp []struct {
+		ID          string   `json:"Id"`
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || len(resp) == 0 {
+		return runtime.ImageInfo{}, true
+	}
+	return runtime.ImageInfo{ID: resp[0].ID, RepoDigests: resp[0].RepoDigests}, true
+}
+
+// PullImage pulls the given image reference from a registry.
+// Credentials are written to a temporary docker config.json that DOCKER_CONFIG points
+// nerdctl and the docker CLI to.
+func (c *Nerdctl) PullImage(_ context.Context, imageRef string, auth runtime.RegistryAuth) error {
+	cmd := &exec.Cmd{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if !auth.IsZero() {
+		dir, err := c.writeDockerConfig(auth)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+c.hostPath(dir))
+	}
+	_, err := ctrctl.ImagePull(&ctrctl.ImagePullOpts{Cmd: cmd}, imageRef)
+	return err
+}
+
+// writeDockerConfig writes a docker config.json holding auth to a new temporary directory
+// and returns the directory.
+func (c *Nerdctl) writeDockerConfig(auth runtime.RegistryAuth) (string, error) {
+	b, err := auth.DockerConfig()
+	if err != nil {
+		return "", fmt.Errorf("encoding registry credentials: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "waitdaemon-auth-")
+	if err != nil {
+		return "", fmt.Errorf("creating registry config directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), b, 0o600); err != nil { //nolint:mnd // owner only.
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("writing registry config: %w", err)
+	}
+	return dir, nil
+}
+
+// hostPath returns the path the CLI sees for path in this container. In nsenter mode the CLI
+// runs in the host mount namespace, where the container's files are under /proc/<pid>/root.
+// The container shares the host PID namespace, so the PID is the host PID.
+func (c *Nerdctl) hostPath(path string) string {
+	if len(c.cli) > 0 && c.cli[0] == "nsenter" {
+		return "/proc/" + strconv.Itoa(os.Getpid()) + "/root" + path
+	}
+	return path
+}
+
 // Close is a no-op for CLI-based runtimes.
 func (c *Nerdctl) Close() error {
 	return nil
 }
 
-// detectPrivileged checks if the current process has full capabilities,
-// which indicates it is running in a privileged container.
-// nerdctl does not populate HostConfig.Privileged in its inspect output.
-func detectPrivileged() bool {
+// detectSecurity fills in the privileged flag, capabilities, security options and
+// read-only rootfs setting of info from /proc for the settings nerdctl leaves out of
+// its inspect output. Settings that are already set are left alone.
+func detectSecurity(info *runtime.ContainerInfo) {
+	status := readProcStatus()
+	// The bounding set is the container's capability set whichever user the process runs as;
+	// the effective set of a non-root process is empty.
+	capBnd, err := strconv.ParseUint(status["CapBnd"], 16, 64)
+	if err != nil {
+		return
+	}
+	// A privileged container has every capability the kernel knows about.
+	if !info.Privileged {
+		info.Privileged = capBnd == allCapabilities()
+	}
+	if info.Privileged {
+		return
+	}
+
+	if len(info.CapAdd) == 0 && len(info.CapDrop) == 0 {
+		info.CapAdd, info.CapDrop = runtime.CapabilityChanges(runtime.CapabilitiesFromMask(capBnd))
+	}
+	if len(info.SecurityOpt) == 0 {
+		if status["NoNewPrivs"] == "1" {
+			info.SecurityOpt = append(info.SecurityOpt, "no-new-privileges")
+		}
+		// Seccomp mode 0 means no filter; the profile of a filtered process cannot be recovered.
+		if status["Seccomp"] == "0" {
+			info.SecurityOpt = append(info.SecurityOpt, "seccomp=unconfined")
+		}
+		if profile := detectAppArmorProfile(); profile != "" && profile != "nerdctl-default" {
+			info.SecurityOpt = append(info.SecurityOpt, "apparmor="+profile)
+		}
+	}
+	if !info.ReadonlyRootfs {
+		var st unix.Statfs_t
+		info.ReadonlyRootfs = unix.Statfs("/", &st) == nil && st.Flags&unix.ST_RDONLY != 0
+	}
+}
+
+// readProcStatus returns the "Key: value" fields of /proc/self/status.
+func readProcStatus() map[string]string {
 	data, err := os.ReadFile("/proc/self/status")
 	if err != nil {
-		return false
+		return nil
 	}
+	fields := map[string]string{}
 	for _, line := range strings.Split(string(data), "\n") {
-		if strings.HasPrefix(line, "CapEff:") {
-			capHex := strings.TrimSpace(strings.TrimPrefix(line, "CapEff:"))
-			// A privileged container has all capabilities enabled.
-			// Full capability sets end with at least 9 'f' hex digits:
-			//   Kernel 4.x: 0000003fffffffff
-			//   Kernel 5.x+: 000001ffffffffff
-			return strings.HasSuffix(capHex, "fffffffff")
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = strings.TrimSpace(v)
 		}
 	}
-	return false
+	return fields
+}
+
+// allCapabilities returns the capability mask with every capability the kernel supports set.
+func allCapabilities() uint64 {
+	lastCap := runtime.LastCapability
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			lastCap = n
+		}
+	}
+	return 1<<(lastCap+1) - 1
+}
+
+// detectAppArmorProfile returns the AppArmor profile of the current process, e.g. "unconfined",
+// or an empty string when AppArmor is not enabled.
+func detectAppArmorProfile() string {
+	data, err := os.ReadFile("/proc/self/attr/current")
+	if err != nil {
+		return ""
+	}
+	// The file holds "profile (mode)" or "unconfined".
+	profile, _, _ := strings.Cut(strings.TrimSpace(string(data)), " (")
+	return profile
 }
 
 // detectPidMode checks if the current process is in the host PID namespace.
@@ -274,6 +812,64 @@ func detectPidMode() string {
 	return ""
 }
 
+// mountsFromEntries converts the inspect Mounts array of nerdctl to binds and to the
+// volume and tmpfs mounts that are not binds.
+func mountsFromEntries(entries []mountEntry) ([]string, []runtime.Mount) {
+	var binds []string
+	var mounts []runtime.Mount
+	for _, m := range entries {
+		// Resolve destination: some nerdctl versions use
+		// "Target" instead of "Destination".
+		dest := m.Destination
+		if dest == "" {
+			dest = m.Target
+		}
+		if dest == "" {
+			continue
+		}
+		// Skip nerdctl-internal mounts. nerdctl creates per-container temp
+		// directories (e.g. /tmp/tink-dns-XXXXX/) for /etc/resolv.conf,
+		// /etc/hosts, and /etc/hostname. These sources won't exist for a
+		// new container and nerdctl will create its own.
+		if isNerdctlInternalMount(dest) {
+			continue
+		}
+		typ := strings.ToLower(m.Type)
+		// A volume without a name can only be carried over as a bind of its data directory.
+		if typ == runtime.MountTypeVolume && m.Name == "" {
+			typ = runtime.MountTypeBind
+		}
+		switch typ {
+		case runtime.MountTypeBind:
+			bind := m.Source + ":" + dest
+			opts := mountOptions(m)
+			if len(opts) > 0 {
+				bind += ":" + strings.Join(opts, ",")
+			}
+			binds = append(binds, bind)
+		case runtime.MountTypeVolume, runtime.MountTypeTmpfs:
+			rm := runtime.Mount{Type: typ, Target: dest}
+			// An anonymous volume is not shared; the new container gets its own.
+			if typ == runtime.MountTypeVolume && !isAnonymousVolume(m.Name) {
+				rm.Source = m.Name
+			}
+			rm.ParseMountOptions(mountOptions(m))
+			mounts = append(mounts, rm)
+		}
+	}
+	return binds, mounts
+}
+
+// isAnonymousVolume reports whether name is a generated volume name, which is 64 hex characters.
+func isAnonymousVolume(name string) bool {
+	const anonymousNameLen = 64
+	if len(name) != anonymousNameLen {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
 // mountOptions builds the volume option string from a mount entry's Mode,
 // Propagation, and RW fields. It normalises the output to be compatible
 // with the --volume flag of both Docker and nerdctl CLIs.
@@ -0,0 +1,111 @@
+package nerdctl_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	"github.com/jacobweinstock/waitdaemon/runtime/nerdctl"
+)
+
+func TestWarnings(t *testing.T) {
+	c, err := nerdctl.New([]string{"nerdctl"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if got := c.Warnings(runtime.ContainerInfo{Sysctls: map[string]string{"net.ipv4.ip_forward": "1"}}); len(got) != 0 {
+		t.Errorf("Warnings() with one sysctl = %q, want none", got)
+	}
+
+	got := c.Warnings(runtime.ContainerInfo{Sysctls: map[string]string{
+		"net.ipv4.ip_forward":    "1",
+		"kernel.shm_rmid_forced": "1",
+		"net.core.somaxconn":     "1024",
+	}})
+	if len(got) != 1 || !strings.Contains(got[0], `"kernel.shm_rmid_forced" is set`) {
+		t.Errorf("Warnings() with three sysctls = %q, want one warning setting kernel.shm_rmid_forced", got)
+	}
+}
+
+func TestWriteDockerConfig(t *testing.T) {
+	c, err := nerdctl.New([]string{"nerdctl"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	auth := runtime.RegistryAuth{ServerAddress: "docker.io", Username: "hub", Password: "hubpass"}
+	dir, err := c.WriteDockerConfig(auth)
+	if err != nil {
+		t.Fatalf("WriteDockerConfig() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("config.json not written: %v", err)
+	}
+	// The file holds credentials, so only the owner may read it.
+	const ownerOnly = 0o600
+	if perm := st.Mode().Perm(); perm != ownerOnly {
+		t.Errorf("config.json mode = %v, want -rw-------", perm)
+	}
+	got, err := runtime.RegistryAuthFromConfig(path, "docker.io")
+	if err != nil || got != auth {
+		t.Errorf("RegistryAuthFromConfig() = %+v, %v, want %+v", got, err, auth)
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	local, err := nerdctl.New([]string{"nerdctl"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if got := local.HostPath("/tmp/auth"); got != "/tmp/auth" {
+		t.Errorf("HostPath() = %q, want %q", got, "/tmp/auth")
+	}
+
+	// In nsenter mode the CLI runs in the host mount namespace and reads the file through this process's root.
+	host, err := nerdctl.New([]string{"nsenter", "-t", "1", "-m", "--", "nerdctl"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	want := "/proc/" + strconv.Itoa(os.Getpid()) + "/root/tmp/auth"
+	if got := host.HostPath("/tmp/auth"); got != want {
+		t.Errorf("HostPath() = %q, want %q", got, want)
+	}
+}
+
+func TestCommandCanceled(t *testing.T) {
+	const (
+		timeout = 100 * time.Millisecond
+		maxWait = 5 * time.Second
+	)
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not installed")
+	}
+	c, err := nerdctl.New([]string{sleep})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// ctrctl replaces the Path and Args of the base command; the context must still kill the process.
+	cmd := c.Command(ctx)
+	cmd.Path = sleep
+	cmd.Args = []string{sleep, "10"}
+	start := time.Now()
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Run() error = nil, want the process to be killed")
+	}
+	if elapsed := time.Since(start); elapsed > maxWait {
+		t.Errorf("Run() took %v, want it to stop when the context is done", elapsed)
+	}
+}
@@ -0,0 +1,686 @@
+// Package podman implements the runtime.Runtime interface using the Podman (libpod) REST API.
+package podman
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultSocket is the default rootful Podman API socket path.
+	DefaultSocket = "/run/podman/podman.sock"
+	// apiPrefix is the versioned libpod API path prefix.
+	apiPrefix = "/v4.0.0/libpod"
+)
+
+// Podman implements runtime.Runtime using the libpod REST API over a unix socket.
+type Podman struct {
+	client  *http.Client
+	baseURL string
+}
+
+// New creates a new Podman runtime client that talks to the API socket at socketPath.
+func New(socketPath string) (*Podman, error) {
+	if socketPath == "" {
+		socketPath = DefaultSocket
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return NewWithClient(&http.Client{Transport: transport}, "http://d"), nil
+}
+
+// NewWithClient creates a Podman runtime client that sends requests to baseURL
+// using the given HTTP client. This allows talking to a libpod API that is not
+// behind the default unix socket, such as a local test server.
+func NewWithClient(client *http.Client, baseURL string) *Podman {
+	return &Podman{client: client, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Ping checks if the Podman service is responsive.
+func (p *Podman) Ping(ctx context.Context) error {
+	resp, err := p.do(ctx, http.MethodGet, "/_ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// inspectResponse is the subset of the JSON returned by the libpod container inspect endpoint.
+type inspectResponse struct {
+	ID        string `json:"Id"`
+	ImageName string `json:"ImageName"`
+	Config    struct {
+		Env          []string   `json:"Env"`
+		Entrypoint   entrypoint `json:"Entrypoint"`
+		Cmd          []string   `json:"Cmd"`
+		WorkingDir   string     `json:"WorkingDir"`
+		User         string     `json:"User"`
+		Tty          bool       `json:"Tty"`
+		AttachStdout bool       `json:"AttachStdout"`
+		AttachStderr bool       `json:"AttachStderr"`
+	} `json:"Config"`
+	HostConfig struct {
+		Privileged     bool              `json:"Privileged"`
+		CapAdd         []string          `json:"CapAdd"`
+		CapDrop        []string          `json:"CapDrop"`
+		SecurityOpt    []string          `json:"SecurityOpt"`
+		UsernsMode     string            `json:"UsernsMode"`
+		ReadonlyRootfs bool              `json:"ReadonlyRootfs"`
+		Binds          []string          `json:"Binds"`
+		Tmpfs          map[string]string `json:"Tmpfs"`
+		IpcMode        string            `json:"IpcMode"`
+		UTSMode        string            `json:"UTSMode"`
+		// CgroupMode is the cgroup namespace mode.
+		CgroupMode        string            `json:"CgroupMode"`
+		Memory            int64             `json:"Memory"`
+		MemoryReservation int64             `json:"MemoryReservation"`
+		MemorySwap        int64             `json:"MemorySwap"`
+		NanoCPUs          int64             `json:"NanoCpus"`
+		CPUShares         int64             `json:"CpuShares"`
+		CPUPeriod         int64             `json:"CpuPeriod"`
+		CPUQuota          int64             `json:"CpuQuota"`
+		CpusetCpus        string            `json:"CpusetCpus"`
+		CpusetMems        string            `json:"CpusetMems"`
+		PidsLimit         int64             `json:"PidsLimit"`
+		Sysctls           map[string]string `json:"Sysctls"`
+		ShmSize           int64             `json:"ShmSize"`
+		// Ulimits names are rlimit types such as "RLIMIT_NOFILE".
+		Ulimits []struct {
+			Name string `json:"Name"`
+			Soft int64  `json:"Soft"`
+			Hard int64  `json:"Hard"`
+		} `json:"Ulimits"`
+		PidMode     string   `json:"PidMode"`
+		NetworkMode string   `json:"NetworkMode"`
+		DNS         []string `json:"Dns"`
+		DNSSearch   []string `json:"DnsSearch"`
+		ExtraHosts  []string `json:"ExtraHosts"`
+		Devices     []struct {
+			PathOnHost        string `json:"PathOnHost"`
+			PathInContainer   string `json:"PathInContainer"`
+			CgroupPermissions string `json:"CgroupPermissions"`
+		} `json:"Devices"`
+		DeviceCgroupRules []string `json:"DeviceCgroupRules"`
+	} `json:"HostConfig"`
+}
+
+// entrypoint is the inspect Config.Entrypoint. Podman 4 reports it as a space separated
+// string and Podman 5 as an array.
+type entrypoint []string
+
+// UnmarshalJSON accepts both the string and the array form.
+func (e *entrypoint) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*e = strings.Fields(s)
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(e))
+}
+
+// InspectSelf returns the container configuration for the current container.
+// The container is found by the IDs from runtime.SelfIDs: the container ID in the /etc/hostname
+// mount source, which also works with the host network, or else the hostname, which Podman sets
+// to the short container ID and libpod accepts as a container name.
+func (p *Podman) InspectSelf(ctx context.Context) (runtime.ContainerInfo, error) {
+	return runtime.InspectFirst(ctx, runtime.SelfIDs(), p.inspect)
+}
+
+// inspect returns the container configuration of the container with the given ID or name.
+func (p *Podman) inspect(ctx context.Context, id string) (runtime.ContainerInfo, error) {
+	var resp inspectResponse
+	if err := p.doJSON(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, nil, &resp); err != nil {
+		return runtime.ContainerInfo{}, fmt.Errorf("inspecting container %q: %w", id, err)
+	}
+
+	info := runtime.ContainerInfo{
+		ID:           resp.ID,
+		Image:        resp.ImageName,
+		Env:          resp.Config.Env,
+		Entrypoint:   resp.Config.Entrypoint,
+		Cmd:          resp.Config.Cmd,
+		User:         resp.Config.User,
+		Tty:          resp.Config.Tty,
+		AttachStdout: resp.Config.AttachStdout,
+		AttachStderr: resp.Config.AttachStderr,
+		Privileged:   resp.HostConfig.Privileged,
+		Binds:        resp.HostConfig.Binds,
+		PidMode:      resp.HostConfig.PidMode,
+		NetworkMode:  resp.HostConfig.NetworkMode,
+		DNS:          resp.HostConfig.DNS,
+		DNSSearch:    resp.HostConfig.DNSSearch,
+		ExtraHosts:   resp.HostConfig.ExtraHosts,
+
+		CapAdd:            resp.HostConfig.CapAdd,
+		CapDrop:           resp.HostConfig.CapDrop,
+		SecurityOpt:       resp.HostConfig.SecurityOpt,
+		UsernsMode:        resp.HostConfig.UsernsMode,
+		ReadonlyRootfs:    resp.HostConfig.ReadonlyRootfs,
+		DeviceCgroupRules: resp.HostConfig.DeviceCgroupRules,
+
+		IpcMode:      resp.HostConfig.IpcMode,
+		UTSMode:      resp.HostConfig.UTSMode,
+		CgroupnsMode: resp.HostConfig.CgroupMode,
+		Resources: runtime.Resources{
+			Memory:            resp.HostConfig.Memory,
+			MemoryReservation: resp.HostConfig.MemoryReservation,
+			MemorySwap:        resp.HostConfig.MemorySwap,
+			NanoCPUs:          resp.HostConfig.NanoCPUs,
+			CPUShares:         resp.HostConfig.CPUShares,
+			CPUPeriod:         resp.HostConfig.CPUPeriod,
+			CPUQuota:          resp.HostConfig.CPUQuota,
+			CpusetCpus:        resp.HostConfig.CpusetCpus,
+			CpusetMems:        resp.HostConfig.CpusetMems,
+			PidsLimit:         resp.HostConfig.PidsLimit,
+		},
+		Sysctls: resp.HostConfig.Sysctls,
+		ShmSize: resp.HostConfig.ShmSize,
+	}
+	// Podman reports "/" when neither the image nor the container sets a working directory.
+	if resp.Config.WorkingDir != "/" {
+		info.WorkingDir = resp.Config.WorkingDir
+	}
+	for _, u := range resp.HostConfig.Ulimits {
+		info.Ulimits = append(info.Ulimits, runtime.UlimitFromRlimit(u.Name, u.Soft, u.Hard))
+	}
+	for _, d := range resp.HostConfig.Devices {
+		info.Devices = append(info.Devices, runtime.DeviceMapping(d))
+	}
+	for _, target := range slices.Sorted(maps.Keys(resp.HostConfig.Tmpfs)) {
+		info.Mounts = append(info.Mounts, runtime.TmpfsMount(target, resp.HostConfig.Tmpfs[target]))
+	}
+	return info, nil
+}
+
+// specGenerator is the subset of the libpod SpecGenerator used to create containers.
+type specGenerator struct {
+	Name       string            `json:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Image      string            `json:"image"`
+	Remove     bool              `json:"remove,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Command    []string          `json:"command,omitempty"`
+	WorkDir    string            `json:"work_dir,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Terminal   bool              `json:"terminal,omitempty"`
+	Privileged bool              `json:"privileged,omitempty"`
+	CapAdd     []string          `json:"cap_add,omitempty"`
+	CapDrop    []string          `json:"cap_drop,omitempty"`
+	// NoNewPrivileges, ApparmorProfile, SeccompProfilePath and SelinuxOpts are the --security-opt settings.
+	NoNewPrivileges    bool                  `json:"no_new_privileges,omitempty"`
+	ApparmorProfile    string                `json:"apparmor_profile,omitempty"`
+	SeccompProfilePath string                `json:"seccomp_profile_path,omitempty"`
+	SelinuxOpts        []string              `json:"selinux_opts,omitempty"`
+	UserNS             *namespace            `json:"userns,omitempty"`
+	ReadOnlyFilesystem bool                  `json:"read_only_filesystem,omitempty"`
+	Mounts             []mount               `json:"mounts,omitempty"`
+	Volumes            []namedVolume         `json:"volumes,omitempty"`
+	IpcNS              *namespace            `json:"ipcns,omitempty"`
+	UtsNS              *namespace            `json:"utsns,omitempty"`
+	CgroupNS           *namespace            `json:"cgroupns,omitempty"`
+	ResourceLimits     *specs.LinuxResources `json:"resource_limits,omitempty"`
+	Rlimits            []specs.POSIXRlimit   `json:"r_limits,omitempty"`
+	Sysctl             map[string]string     `json:"sysctl,omitempty"`
+	ShmSize            *int64                `json:"shm_size,omitempty"`
+	PidNS              *namespace            `json:"pidns,omitempty"`
+	NetNS              *namespace            `json:"netns,omitempty"`
+	Networks           map[string]any        `json:"Networks,omitempty"`
+	DNSServer          []string              `json:"dns_server,omitempty"`
+	DNSSearch          []string              `json:"dns_search,omitempty"`
+	HostAdd            []string              `json:"hostadd,omitempty"`
+	Devices            []device              `json:"devices,omitempty"`
+	// DeviceCgroupRule is the list of extra device cgroup rules.
+	DeviceCgroupRule []specs.LinuxDeviceCgroup `json:"device_cgroup_rule,omitempty"`
+}
+
+// device is a libpod device. Path takes the "host:container:permissions" form of --device.
+type device struct {
+	Path string `json:"path"`
+}
+
+// mount is a libpod OCI-style mount.
+type mount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// namedVolume is a libpod volume mount. An empty Name creates an anonymous volume.
+type namedVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+// namespace is a libpod namespace setting, e.g. {"nsmode": "host"}.
+type namespace struct {
+	NSMode string `json:"nsmode"`
+	Value  string `json:"value,omitempty"`
+}
+
+// RunContainer creates and starts a new container with the given configuration.
+func (p *Podman) RunContainer(ctx context.Context, info runtime.ContainerInfo) (string, error) {
+	spec, err := specFromInfo(info)
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := p.doJSON(ctx, http.MethodPost, "/containers/create", nil, spec, &created); err != nil {
+		return "", fmt.Errorf("creating container with image %q: %w", info.Image, err)
+	}
+
+	resp, err := p.do(ctx, http.MethodPost, "/containers/"+created.ID+"/start", nil, nil)
+	if err != nil {
+		// The container never ran, so remove it rather than leave it behind. The removal must
+		// happen even when ctx is what made the start fail.
+		_ = p.Remove(context.WithoutCancel(ctx), created.ID)
+		return "", fmt.Errorf("starting container %q: %w", created.ID, err)
+	}
+	_ = resp.Body.Close()
+	return created.ID, nil
+}
+
+// Wait blocks until the container stops and returns its exit code.
+func (p *Podman) Wait(ctx context.Context, id string) (int, error) {
+	var code int
+	if err := p.doJSON(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/wait", nil, nil, &code); err != nil {
+		return -1, fmt.Errorf("waiting for container %q: %w", id, err)
+	}
+	return code, nil
+}
+
+// WaitForExit blocks until the container stops. A container that does not exist counts as exited.
+func (p *Podman) WaitForExit(ctx context.Context, id string) error {
+	var code int
+	err := p.doJSON(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/wait", nil, nil, &code)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return fmt.Errorf("waiting for container %q: %w", id, err)
+	}
+	return nil
+}
+
+// Stop sends signal to the container and kills it if it is still running after timeout.
+// The libpod stop endpoint always uses the container's stop signal, so Kill is used instead.
+func (p *Podman) Stop(ctx context.Context, id string, signal syscall.Signal, timeout time.Duration) error {
+	return runtime.StopWithKill(ctx, p, id, signal, timeout)
+}
+
+// Kill sends signal to the container.
+func (p *Podman) Kill(ctx context.Context, id string, signal syscall.Signal) error {
+	q := url.Values{"signal": {unix.SignalName(signal)}}
+	resp, err := p.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/kill", q, nil)
+	if err != nil {
+		return fmt.Errorf("sending %s to container %q: %w", unix.SignalName(signal), id, err)
+	}
+	return resp.Body.Close()
+}
+
+// listEntry is an element of the libpod container list response.
+type listEntry struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+}
+
+// List returns the containers whose labels match selector.
+func (p *Podman) List(ctx context.Context, selector map[string]string) ([]runtime.Container, error) {
+	q := url.Values{"all": {"true"}}
+	if len(selector) > 0 {
+		f, err := json.Marshal(map[string][]string{"label": runtime.LabelFilters(selector)})
+		if err != nil {
+			return nil, fmt.Errorf("encoding filters: %w", err)
+		}
+		q.Set("filters", string(f))
+	}
+	var entries []listEntry
+	if err := p.doJSON(ctx, http.MethodGet, "/containers/json", q, nil, &entries); err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	cons := make([]runtime.Container, 0, len(entries))
+	for _, e := range entries {
+		var name string
+		if len(e.Names) > 0 {
+			name = e.Names[0]
+		}
+		cons = append(cons, runtime.Container{ID: e.ID, Name: name, Labels: e.Labels, Running: e.State == "running"})
+	}
+	return cons, nil
+}
+
+// Remove removes the container and its anonymous volumes.
+func (p *Podman) Remove(ctx context.Context, id string) error {
+	resp, err := p.do(ctx, http.MethodDelete, "/containers/"+url.PathEscape(id), url.Values{"v": {"true"}}, nil)
+	if err != nil {
+		return fmt.Errorf("removing container %q: %w", id, err)
+	}
+	return resp.Body.Close()
+}
+
+// Logs streams the container's stdout and stderr until the container exits.
+func (p *Podman) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	var con inspectResponse
+	if err := p.doJSON(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, nil, &con); err != nil {
+		return fmt.Errorf("inspecting container %q: %w", id, err)
+	}
+
+	q := url.Values{"follow": {"true"}, "stdout": {"true"}, "stderr": {"true"}}
+	resp, err := p.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// With a TTY the output is a single raw stream; otherwise it is multiplexed like Docker's.
+	if con.Config.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, resp.Body)
+	return err
+}
+
+// specFromInfo maps a runtime.ContainerInfo to a libpod create spec.
+func specFromInfo(info runtime.ContainerInfo) (specGenerator, error) {
+	spec := specGenerator{
+		Name:       info.Name,
+		Labels:     info.Labels,
+		Image:      info.Image,
+		Remove:     info.AutoRemove,
+		Entrypoint: info.Entrypoint,
+		Command:    info.Cmd,
+		WorkDir:    info.WorkingDir,
+		User:       info.User,
+		Terminal:   info.Tty,
+		Privileged: info.Privileged,
+	}
+
+	if len(info.Env) > 0 {
+		spec.Env = make(map[string]string, len(info.Env))
+		for _, e := range info.Env {
+			k, v, _ := strings.Cut(e, "=")
+			spec.Env[k] = v
+		}
+	}
+
+	for _, b := range info.Binds {
+		parts := strings.SplitN(b, ":", 3) //nolint:mnd // source, destination, options.
+		if len(parts) < 2 {                //nolint:mnd // source and destination are required.
+			continue
+		}
+		var opts []string
+		if len(parts) == 3 { //nolint:mnd // options are present.
+			opts = strings.Split(parts[2], ",")
+		}
+		// A source that is not a path is a volume name.
+		if !strings.HasPrefix(parts[0], "/") {
+			v := namedVolume{Name: parts[0], Dest: parts[1], Options: opts}
+			if isAnonymousVolume(v.Name) {
+				v.Name = ""
+			}
+			spec.Volumes = append(spec.Volumes, v)
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, mount{Type: "bind", Source: parts[0], Destination: parts[1], Options: opts})
+	}
+	for _, m := range info.Mounts {
+		switch m.Type {
+		case runtime.MountTypeVolume:
+			spec.Volumes = append(spec.Volumes, namedVolume{Name: m.Source, Dest: m.Target, Options: m.AllOptions()})
+		case runtime.MountTypeTmpfs:
+			spec.Mounts = append(spec.Mounts, mount{Type: "tmpfs", Source: "tmpfs", Destination: m.Target, Options: m.AllOptions()})
+		default:
+			spec.Mounts = append(spec.Mounts, mount{Type: m.Type, Source: m.Source, Destination: m.Target, Options: m.AllOptions()})
+		}
+	}
+
+	spec.PidNS = namespaceFromMode(info.PidMode)
+	spec.IpcNS = namespaceFromMode(info.IpcMode)
+	spec.UtsNS = namespaceFromMode(info.UTSMode)
+	spec.CgroupNS = namespaceFromMode(info.CgroupnsMode)
+	spec.ResourceLimits = info.Resources.LinuxResources()
+	for _, u := range info.Ulimits {
+		spec.Rlimits = append(spec.Rlimits, specs.POSIXRlimit{
+			Type: u.RlimitType(),
+			Hard: uint64(u.Hard), //nolint:gosec // -1 wraps to unlimited.
+			Soft: uint64(u.Soft), //nolint:gosec // -1 wraps to unlimited.
+		})
+	}
+	spec.Sysctl = info.Sysctls
+	if info.ShmSize > 0 {
+		spec.ShmSize = &info.ShmSize
+	}
+
+	spec.CapAdd = info.CapAdd
+	spec.CapDrop = info.CapDrop
+	sec, err := runtime.ParseSecurityOpts(info.SecurityOpt)
+	if err != nil {
+		return specGenerator{}, err
+	}
+	spec.NoNewPrivileges = sec.NoNewPrivileges
+	spec.ApparmorProfile = sec.AppArmorProfile
+	spec.SeccompProfilePath = sec.SeccompProfile
+	spec.SelinuxOpts = sec.Labels
+	spec.UserNS = namespaceFromMode(info.UsernsMode)
+	spec.ReadOnlyFilesystem = info.ReadonlyRootfs
+
+	// Inspect reports "host", "none", "bridge", "slirp4netns" etc. as the mode, or the name of a network.
+	switch mode := info.NetworkMode; mode {
+	case "":
+	case "host", "none", "bridge", "private", "slirp4netns", "pasta":
+		spec.NetNS = &namespace{NSMode: mode}
+	default:
+		if ctr, ok := strings.CutPrefix(mode, "container:"); ok {
+			spec.NetNS = &namespace{NSMode: "container", Value: ctr}
+			break
+		}
+		spec.NetNS = &namespace{NSMode: "bridge"}
+		spec.Networks = map[string]any{mode: struct{}{}}
+	}
+	spec.DNSServer = info.DNS
+	spec.DNSSearch = info.DNSSearch
+	spec.HostAdd = info.ExtraHosts
+
+	for _, d := range info.Devices {
+		spec.Devices = append(spec.Devices, device{Path: d.String()})
+	}
+	for _, rule := range info.DeviceCgroupRules {
+		d, err := runtime.ParseDeviceCgroupRule(rule)
+		if err != nil {
+			return specGenerator{}, err
+		}
+		spec.DeviceCgroupRule = append(spec.DeviceCgroupRule, d)
+	}
+
+	return spec, nil
+}
+
+// namespaceFromMode converts a namespace mode as reported by inspect, e.g. "host", "private",
+// "container:<id>" or "ns:<path>", to a libpod namespace setting. An empty mode returns nil.
+func namespaceFromMode(mode string) *namespace {
+	if mode == "" {
+		return nil
+	}
+	if ctr, ok := strings.CutPrefix(mode, "container:"); ok {
+		return &namespace{NSMode: "container", Value: ctr}
+	}
+	if path, ok := strings.CutPrefix(mode, "ns:"); ok {
+		return &namespace{NSMode: "path", Value: path}
+	}
+	return &namespace{NSMode: mode}
+}
+
+// isAnonymousVolume reports whether name is a generated volume name, which is 64 hex characters.
+// An anonymous volume is not shared; the new container gets its own.
+func isAnonymousVolume(name string) bool {
+	const anonymousNameLen = 64
+	if len(name) != anonymousNameLen {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// ImageExists reports whether the given image reference exists locally and returns its metadata.
+func (p *Podman) ImageExists(ctx context.Context, imageRef string) (runtime.ImageInfo, bool) {
+	var resp struct {
+		ID          string   `json:"Id"`
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	if err := p.doJSON(ctx, http.MethodGet, "/images/"+url.PathEscape(imageRef)+"/json", nil, nil, &resp); err != nil {
+		return runtime.ImageInfo{}, false
+	}
+	return runtime.ImageInfo{ID: resp.ID, RepoDigests: resp.RepoDigests}, true
+}
+
+// pullReport is a single line of the libpod image pull progress stream.
+type pullReport struct {
+	Stream string `json:"stream"`
+	Error  string `json:"error"`
+}
+
+// PullImage pulls the given image reference from a registry.
+// Credentials are passed in the X-Registry-Auth header, like with the Docker API.
+func (p *Podman) PullImage(ctx context.Context, imageRef string, auth runtime.RegistryAuth) error {
+	q := url.Values{"reference": {imageRef}}
+	var header http.Header
+	if !auth.IsZero() {
+		encoded, err := auth.EncodedAuth()
+		if err != nil {
+			return fmt.Errorf("encoding registry credentials: %w", err)
+		}
+		header = http.Header{"X-Registry-Auth": {encoded}}
+	}
+	resp, err := p.doWithHeader(ctx, http.MethodPost, "/images/pull", q, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pull endpoint always answers 200 and reports failures in the stream.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r pullReport
+		if err := dec.Decode(&r); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading pull progress: %w", err)
+		}
+		if r.Error != "" {
+			return errors.New(r.Error)
+		}
+		if r.Stream != "" {
+			_, _ = io.WriteString(os.Stdout, r.Stream)
+		}
+	}
+}
+
+// Close releases idle connections held by the HTTP client.
+func (p *Podman) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// errNotFound is wrapped by errors for requests that the API answered with 404 Not Found.
+var errNotFound = errors.New("not found")
+
+// apiError is the error body returned by the libpod API.
+type apiError struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+// do sends a request to the libpod API and returns the response when the status is 2xx.
+// The caller must close the response body.
+func (p *Podman) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	return p.doWithHeader(ctx, method, path, query, body, nil)
+}
+
+// doWithHeader is do with extra request headers.
+func (p *Podman) doWithHeader(ctx context.Context, method, path string, query url.Values, body any, header http.Header) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("encoding request body: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	u := p.baseURL + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg := fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err == nil && e.Message != "" {
+			msg = fmt.Sprintf("%s (status %d)", e.Message, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s %s: %s: %w", method, path, msg, errNotFound)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, msg)
+	}
+	return resp, nil
+}
+
+// doJSON sends a request to the libpod API and decodes the JSON response into out.
+func (p *Podman) doJSON(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := p.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package podman_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+	"github.com/jacobweinstock/waitdaemon/runtime/podman"
+)
+
+// apiPrefix is the versioned libpod API path prefix the client sends requests to.
+const apiPrefix = "/v4.0.0/libpod"
+
+// apiError is the error body returned by the libpod API.
+type apiError struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+// newTestPodman returns a Podman client for a test server that serves mux under the libpod API prefix.
+func newTestPodman(t *testing.T, mux *http.ServeMux) *podman.Podman {
+	t.Helper()
+	srv := httptest.NewServer(http.StripPrefix(apiPrefix, mux))
+	t.Cleanup(srv.Close)
+	return podman.NewWithClient(srv.Client(), srv.URL)
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(t *testing.T, w http.ResponseWriter, status int, v any) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("encoding response: %v", err)
+	}
+}
+
+func TestInspectSelf(t *testing.T) {
+	const body = `{
+		"Id": "abc123",
+		"ImageName": "quay.io/podman/hello:latest",
+		"Config": {
+			"Env": ["PATH=/usr/bin", "FOO=bar"],
+			"Entrypoint": "/bin/sh -c",
+			"Cmd": ["echo", "hi"],
+			"WorkingDir": "/",
+			"User": "1000:1000",
+			"Tty": true
+		},
+		"HostConfig": {
+			"Privileged": true,
+			"PidMode": "host",
+			"NetworkMode": "host",
+			"Tmpfs": {"/run": "size=64m", "/tmp": ""},
+			"Ulimits": [{"Name": "RLIMIT_NOFILE", "Soft": 1024, "Hard": 2048}],
+			"Devices": [{"PathOnHost": "/dev/sda", "PathInContainer": "/dev/xvda", "CgroupPermissions": "rwm"}],
+			"Memory": 1048576
+		}
+	}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/{name}/json", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	})
+
+	info, err := newTestPodman(t, mux).InspectSelf(context.Background())
+	if err != nil {
+		t.Fatalf("InspectSelf() error = %v", err)
+	}
+	want := runtime.ContainerInfo{
+		ID:          "abc123",
+		Image:       "quay.io/podman/hello:latest",
+		Env:         []string{"PATH=/usr/bin", "FOO=bar"},
+		Entrypoint:  []string{"/bin/sh", "-c"},
+		Cmd:         []string{"echo", "hi"},
+		User:        "1000:1000",
+		Tty:         true,
+		Privileged:  true,
+		PidMode:     "host",
+		NetworkMode: "host",
+		Resources:   runtime.Resources{Memory: 1048576},
+		Ulimits:     []runtime.Ulimit{runtime.UlimitFromRlimit("RLIMIT_NOFILE", 1024, 2048)},
+		Devices:     []runtime.DeviceMapping{{PathOnHost: "/dev/sda", PathInContainer: "/dev/xvda", CgroupPermissions: "rwm"}},
+		Mounts:      []runtime.Mount{runtime.TmpfsMount("/run", "size=64m"), runtime.TmpfsMount("/tmp", "")},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("InspectSelf() =\n%+v\nwant\n%+v", info, want)
+	}
+}
+
+func TestInspectSelfEntrypointArray(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/{name}/json", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(t, w, http.StatusOK, map[string]any{
+			"Id":     "abc123",
+			"Config": map[string]any{"Entrypoint": []string{"/bin/sh", "-c"}, "WorkingDir": "/work"},
+		})
+	})
+
+	info, err := newTestPodman(t, mux).InspectSelf(context.Background())
+	if err != nil {
+		t.Fatalf("InspectSelf() error = %v", err)
+	}
+	if want := []string{"/bin/sh", "-c"}; !reflect.DeepEqual(info.Entrypoint, want) {
+		t.Errorf("Entrypoint = %q, want %q", info.Entrypoint, want)
+	}
+	if info.WorkingDir != "/work" {
+		t.Errorf("WorkingDir = %q, want %q", info.WorkingDir, "/work")
+	}
+}
+
+func TestRunContainer(t *testing.T) {
+	var got map[string]any
+	var started string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding create request: %v", err)
+		}
+		writeJSON(t, w, http.StatusCreated, map[string]string{"Id": "new123"})
+	})
+	mux.HandleFunc("POST /containers/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		started = r.PathValue("id")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	id, err := newTestPodman(t, mux).RunContainer(context.Background(), runtime.ContainerInfo{
+		Name:        "waitdaemon-user",
+		Image:       "alpine",
+		Env:         []string{"FOO=bar", "EMPTY="},
+		Cmd:         []string{"echo", "hi"},
+		Binds:       []string{"/data:/data:ro", "cache:/cache"},
+		PidMode:     "host",
+		NetworkMode: "mynet",
+		AutoRemove:  true,
+	})
+	if err != nil {
+		t.Fatalf("RunContainer() error = %v", err)
+	}
+	if id != "new123" || started != "new123" {
+		t.Errorf("RunContainer() = %q, started %q, want %q", id, started, "new123")
+	}
+	want := map[string]any{
+		"name":     "waitdaemon-user",
+		"image":    "alpine",
+		"remove":   true,
+		"env":      map[string]any{"FOO": "bar", "EMPTY": ""},
+		"command":  []any{"echo", "hi"},
+		"mounts":   []any{map[string]any{"type": "bind", "source": "/data", "destination": "/data", "options": []any{"ro"}}},
+		"volumes":  []any{map[string]any{"Name": "cache", "Dest": "/cache"}},
+		"pidns":    map[string]any{"nsmode": "host"},
+		"netns":    map[string]any{"nsmode": "bridge"},
+		"Networks": map[string]any{"mynet": map[string]any{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("create request =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestRunContainerCreateError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(t, w, http.StatusInternalServerError, apiError{Cause: "boom", Message: "image not known", Response: 500})
+	})
+	mux.HandleFunc("POST /containers/{id}/start", func(http.ResponseWriter, *http.Request) {
+		t.Error("start called after a failed create")
+	})
+
+	_, err := newTestPodman(t, mux).RunContainer(context.Background(), runtime.ContainerInfo{Image: "alpine"})
+	if err == nil || !strings.Contains(err.Error(), "image not known (status 500)") {
+		t.Errorf("RunContainer() error = %v, want the API error message", err)
+	}
+}
+
+func TestRunContainerStartError(t *testing.T) {
+	var removed string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(t, w, http.StatusCreated, map[string]string{"Id": "new123"})
+	})
+	mux.HandleFunc("POST /containers/{id}/start", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(t, w, http.StatusInternalServerError, apiError{Cause: "boom", Message: "OCI runtime error", Response: 500})
+	})
+	mux.HandleFunc("DELETE /containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		removed = r.PathValue("id")
+		writeJSON(t, w, http.StatusOK, []any{})
+	})
+
+	_, err := newTestPodman(t, mux).RunContainer(context.Background(), runtime.ContainerInfo{Image: "alpine"})
+	if err == nil || !strings.Contains(err.Error(), "OCI runtime error (status 500)") {
+		t.Errorf("RunContainer() error = %v, want the API error message", err)
+	}
+	if removed != "new123" {
+		t.Errorf("removed container %q after the failed start, want %q", removed, "new123")
+	}
+}
+
+func TestWait(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("id") {
+		case "exited":
+			writeJSON(t, w, http.StatusOK, 3)
+		default:
+			writeJSON(t, w, http.StatusNotFound, apiError{Message: "no such container", Response: 404})
+		}
+	})
+	p := newTestPodman(t, mux)
+
+	code, err := p.Wait(context.Background(), "exited")
+	if err != nil || code != 3 {
+		t.Errorf("Wait() = %d, %v, want 3, nil", code, err)
+	}
+	if _, err := p.Wait(context.Background(), "missing"); err == nil || !strings.Contains(err.Error(), "no such container (status 404)") {
+		t.Errorf("Wait() error = %v, want the not found error", err)
+	}
+	if err := p.WaitForExit(context.Background(), "missing"); err != nil {
+		t.Errorf("WaitForExit() error = %v, want nil for a missing container", err)
+	}
+}
+
+func TestImageExists(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/{ref}/json", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("ref") != "alpine:3" {
+			writeJSON(t, w, http.StatusNotFound, apiError{Message: "image not known", Response: 404})
+			return
+		}
+		writeJSON(t, w, http.StatusOK, map[string]any{
+			"Id":          "sha256:1111",
+			"RepoDigests": []string{"docker.io/library/alpine@sha256:2222"},
+		})
+	})
+	p := newTestPodman(t, mux)
+
+	img, ok := p.ImageExists(context.Background(), "alpine:3")
+	want := runtime.ImageInfo{ID: "sha256:1111", RepoDigests: []string{"docker.io/library/alpine@sha256:2222"}}
+	if !ok || !reflect.DeepEqual(img, want) {
+		t.Errorf("ImageExists() = %+v, %v, want %+v, true", img, ok, want)
+	}
+	if _, ok := p.ImageExists(context.Background(), "missing"); ok {
+		t.Error("ImageExists() = true for a missing image")
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	tests := map[string]struct {
+		auth    runtime.RegistryAuth
+		stream  string
+		wantErr string
+	}{
+		"anonymous": {
+			stream: `{"stream":"Trying to pull quay.io/podman/hello...\n"}` + "\n" + `{"id":"sha256:1111"}`,
+		},
+		"with credentials": {
+			auth:   runtime.RegistryAuth{ServerAddress: "quay.io", Username: "user", Password: "secret"},
+			stream: `{"id":"sha256:1111"}`,
+		},
+		"error in stream": {
+			stream:  `{"stream":"Trying to pull...\n"}` + "\n" + `{"error":"unauthorized: access denied"}`,
+			wantErr: "unauthorized: access denied",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /images/pull", func(w http.ResponseWriter, r *http.Request) {
+				if ref := r.URL.Query().Get("reference"); ref != "quay.io/podman/hello" {
+					t.Errorf("reference = %q, want %q", ref, "quay.io/podman/hello")
+				}
+				header := r.Header.Get("X-Registry-Auth")
+				switch {
+				case tt.auth.IsZero() && header != "":
+					t.Errorf("X-Registry-Auth = %q, want none", header)
+				case !tt.auth.IsZero():
+					b, err := base64.URLEncoding.DecodeString(header)
+					if err != nil {
+						t.Fatalf("decoding X-Registry-Auth: %v", err)
+					}
+					var got map[string]string
+					if err := json.Unmarshal(b, &got); err != nil {
+						t.Fatalf("parsing X-Registry-Auth: %v", err)
+					}
+					if got["username"] != tt.auth.Username || got["password"] != tt.auth.Password || got["serveraddress"] != tt.auth.ServerAddress {
+						t.Errorf("X-Registry-Auth = %v, want %+v", got, tt.auth)
+					}
+				}
+				_, _ = w.Write([]byte(tt.stream))
+			})
+
+			err := newTestPodman(t, mux).PullImage(context.Background(), "quay.io/podman/hello", tt.auth)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("PullImage() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("PullImage() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPullImageRegistryAuth(t *testing.T) {
+	tests := map[string]struct {
+		auth    runtime.RegistryAuth
+		wantErr bool
+	}{
+		"credentials":    {auth: runtime.RegistryAuth{ServerAddress: "registry.local", Username: "user", Password: "secret"}},
+		"anonymous":      {wantErr: true},
+		"wrong password": {auth: runtime.RegistryAuth{ServerAddress: "registry.local", Username: "user", Password: "wrong"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The registry serves the manifest only with basic auth credentials.
+			var authorized bool
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				authorized = true
+				w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				_, _ = w.Write([]byte(`{"schemaVersion":2}`))
+			}))
+			t.Cleanup(registry.Close)
+
+			// Like Podman, the pull endpoint fetches the manifest with the X-Registry-Auth credentials.
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /images/pull", func(w http.ResponseWriter, r *http.Request) {
+				req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, registry.URL+"/v2/podman/hello/manifests/latest", nil)
+				if err != nil {
+					t.Errorf("creating registry request: %v", err)
+					return
+				}
+				if header := r.Header.Get("X-Registry-Auth"); header != "" {
+					b, err := base64.URLEncoding.DecodeString(header)
+					if err != nil {
+						t.Errorf("decoding X-Registry-Auth: %v", err)
+						return
+					}
+					var creds map[string]string
+					if err := json.Unmarshal(b, &creds); err != nil {
+						t.Errorf("parsing X-Registry-Auth: %v", err)
+						return
+					}
+					req.SetBasicAuth(creds["username"], creds["password"])
+				}
+				resp, err := registry.Client().Do(req)
+				if err != nil {
+					t.Errorf("fetching manifest: %v", err)
+					return
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					_, _ = w.Write([]byte(`{"error":"unauthorized: authentication required"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"id":"sha256:1111"}`))
+			})
+
+			err := newTestPodman(t, mux).PullImage(context.Background(), "registry.local/podman/hello", tt.auth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PullImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if authorized == tt.wantErr {
+				t.Errorf("registry received the credentials = %v, want %v", authorized, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		wantErr string
+	}{
+		"api error": {
+			status:  http.StatusConflict,
+			body:    `{"cause":"in use","message":"container is running","response":409}`,
+			wantErr: `sending SIGTERM to container "x": POST /containers/x/kill: container is running (status 409)`,
+		},
+		"not found": {
+			status:  http.StatusNotFound,
+			body:    `{"cause":"no such container","message":"no container with name or ID \"x\" found","response":404}`,
+			wantErr: `sending SIGTERM to container "x": POST /containers/x/kill: no container with name or ID "x" found (status 404): not found`,
+		},
+		"undecodable body": {
+			status:  http.StatusInternalServerError,
+			body:    "internal error",
+			wantErr: `sending SIGTERM to container "x": POST /containers/x/kill: unexpected status 500`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /containers/x/kill", func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			err := newTestPodman(t, mux).Kill(context.Background(), "x", syscall.SIGTERM)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Kill() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// cpuPeriod is the CFS period NanoCPUs are converted with, the default of docker and the kernel.
+const cpuPeriod = 100000
+
+// Resources are the cgroup resource limits of a container. Zero values are not set.
+type Resources struct {
+	// Memory is the memory limit in bytes.
+	Memory int64
+	// MemoryReservation is the memory soft limit in bytes.
+	MemoryReservation int64
+	// MemorySwap is the memory plus swap limit in bytes. -1 means unlimited swap.
+	MemorySwap int64
+	// NanoCPUs is the CPU quota in units of 1e-9 CPUs, e.g. 1500000000 for --cpus 1.5.
+	NanoCPUs int64
+	// CPUShares is the relative CPU weight.
+	CPUShares int64
+	// CPUPeriod is the CFS period in microseconds.
+	CPUPeriod int64
+	// CPUQuota is the CFS quota in microseconds per CPUPeriod.
+	CPUQuota int64
+	// CpusetCpus are the CPUs the container may use, e.g. "0-2,4".
+	CpusetCpus string
+	// CpusetMems are the memory nodes the container may use.
+	CpusetMems string
+	// PidsLimit is the maximum number of processes. -1 means unlimited.
+	PidsLimit int64
+}
+
+// IsZero reports whether no limit is set.
+func (r Resources) IsZero() bool {
+	return r == Resources{}
+}
+
+// LinuxResources returns the limits as OCI resources. NanoCPUs is converted to a CFS quota
+// unless CPUQuota is set. It returns nil when no limit is set.
+func (r Resources) LinuxResources() *specs.LinuxResources {
+	if r.IsZero() {
+		return nil
+	}
+	res := &specs.LinuxResources{}
+	if r.Memory != 0 || r.MemoryReservation != 0 || r.MemorySwap != 0 {
+		res.Memory = &specs.LinuxMemory{}
+		if r.Memory != 0 {
+			res.Memory.Limit = &r.Memory
+		}
+		if r.MemoryReservation != 0 {
+			res.Memory.Reservation = &r.MemoryReservation
+		}
+		if r.MemorySwap != 0 {
+			res.Memory.Swap = &r.MemorySwap
+		}
+	}
+	quota, period := r.CPUQuota, r.CPUPeriod
+	if quota == 0 && r.NanoCPUs != 0 {
+		period = cpuPeriod
+		quota = r.NanoCPUs * cpuPeriod / 1e9
+	}
+	if r.CPUShares != 0 || quota != 0 || period != 0 || r.CpusetCpus != "" || r.CpusetMems != "" {
+		res.CPU = &specs.LinuxCPU{Cpus: r.CpusetCpus, Mems: r.CpusetMems}
+		if r.CPUShares != 0 {
+			shares := uint64(r.CPUShares) //nolint:gosec // shares are never negative.
+			res.CPU.Shares = &shares
+		}
+		if quota != 0 {
+			res.CPU.Quota = &quota
+		}
+		if period != 0 {
+			p := uint64(period) //nolint:gosec // the period is never negative.
+			res.CPU.Period = &p
+		}
+	}
+	if r.PidsLimit != 0 {
+		res.Pids = &specs.LinuxPids{Limit: r.PidsLimit}
+	}
+	return res
+}
+
+// ResourcesFromLinux returns the limits of OCI resources. A CFS quota is returned as
+// CPUQuota and CPUPeriod, not as NanoCPUs.
+func ResourcesFromLinux(res *specs.LinuxResources) Resources {
+	var r Resources
+	if res == nil {
+		return r
+	}
+	if m := res.Memory; m != nil {
+		r.Memory = derefInt64(m.Limit)
+		r.MemoryReservation = derefInt64(m.Reservation)
+		r.MemorySwap = derefInt64(m.Swap)
+	}
+	if c := res.CPU; c != nil {
+		if c.Shares != nil {
+			r.CPUShares = int64(*c.Shares) //nolint:gosec // shares fit in an int64.
+		}
+		// A quota of -1 means no quota.
+		if q := derefInt64(c.Quota); q > 0 {
+			r.CPUQuota = q
+			if c.Period != nil {
+				r.CPUPeriod = int64(*c.Period) //nolint:gosec // the period fits in an int64.
+			}
+		}
+		r.CpusetCpus = c.Cpus
+		r.CpusetMems = c.Mems
+	}
+	if res.Pids != nil {
+		r.PidsLimit = res.Pids.Limit
+	}
+	return r
+}
+
+func derefInt64(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// Ulimit is a process resource limit.
+type Ulimit struct {
+	// Name is the limit name in the --ulimit form, e.g. "nofile".
+	Name string
+	// Soft is the soft limit.
+	Soft int64
+	// Hard is the hard limit.
+	Hard int64
+}
+
+// String returns the limit in the "name=soft:hard" form of the --ulimit flag.
+func (u Ulimit) String() string {
+	return fmt.Sprintf("%s=%d:%d", u.Name, u.Soft, u.Hard)
+}
+
+// RlimitType returns the OCI rlimit type of the limit, e.g. "RLIMIT_NOFILE".
+func (u Ulimit) RlimitType() string {
+	return "RLIMIT_" + strings.ToUpper(u.Name)
+}
+
+// UlimitFromRlimit returns the ulimit of an OCI rlimit type such as "RLIMIT_NOFILE".
+// Names without the prefix are accepted too.
+func UlimitFromRlimit(typ string, soft, hard int64) Ulimit {
+	return Ulimit{Name: strings.ToLower(strings.TrimPrefix(strings.ToUpper(typ), "RLIMIT_")), Soft: soft, Hard: hard}
+}
@@ -1,17 +1,36 @@
-// Package runtime provides an abstraction over container runtimes (Docker, nerdctl).
+// Package runtime provides an abstraction over container runtimes (Docker, nerdctl, containerd, Podman, CRI).
 package runtime //nolint:revive // this name is fine.
 
-import "context"
+import (
+	"context"
+	"io"
+	"maps"
+	"slices"
+	"syscall"
+	"time"
+)
 
 // ContainerInfo holds runtime-agnostic container configuration.
 // It is used to inspect the current container and to create new containers.
 type ContainerInfo struct {
+	// ID is the container ID. It is set by InspectSelf and ignored by RunContainer.
+	ID string
 	// Image is the container image reference.
 	Image string
 	// Env is the list of environment variables in "KEY=VALUE" format.
 	Env []string
-	// Cmd is the command to run in the container.
+	// Entrypoint is the executable and leading arguments of the container process.
+	// Nil means the image entrypoint.
+	Entrypoint []string
+	// Cmd is the command to run in the container: the arguments passed to Entrypoint.
+	// Runtimes that only know the full process arguments report their first element as
+	// Entrypoint and the rest as Cmd, so that Cmd never holds the entrypoint.
 	Cmd []string
+	// WorkingDir is the working directory of the container process. Empty means the image default.
+	WorkingDir string
+	// User is the user the container process runs as, in "user[:group]" form with names or IDs.
+	// Empty means the image default.
+	User string
 	// Tty indicates whether a TTY is allocated.
 	Tty bool
 	// AttachStdout indicates whether stdout is attached.
@@ -20,25 +39,137 @@ type ContainerInfo struct {
 	AttachStderr bool
 	// Privileged indicates whether the container runs in privileged mode.
 	Privileged bool
+	// CapAdd are the capabilities added to the default set, e.g. "CAP_NET_ADMIN".
+	CapAdd []string
+	// CapDrop are the capabilities dropped from the default set.
+	CapDrop []string
+	// SecurityOpt are the security options, e.g. "no-new-privileges" or "apparmor=unconfined".
+	SecurityOpt []string
+	// UsernsMode is the user namespace mode (e.g., "host"). Empty means the runtime default.
+	UsernsMode string
+	// ReadonlyRootfs mounts the container's root filesystem read-only.
+	ReadonlyRootfs bool
 	// Binds is the list of volume bind mounts in "host:container" format.
 	Binds []string
+	// Mounts are the volumes, tmpfs mounts and --mount mounts that are not in Binds.
+	Mounts []Mount
 	// PidMode is the PID namespace mode (e.g., "host").
 	PidMode string
-	// Snapshotter is the containerd snapshotter name (e.g., "overlayfs"). Only used by nerdctl runtime.
+	// IpcMode is the IPC namespace mode (e.g., "host" or "shareable").
+	IpcMode string
+	// UTSMode is the UTS namespace mode (e.g., "host").
+	UTSMode string
+	// CgroupnsMode is the cgroup namespace mode ("host" or "private").
+	CgroupnsMode string
+	// Devices are the host devices made available in the container.
+	Devices []DeviceMapping
+	// DeviceCgroupRules are the device cgroup rules in "type major:minor access" format, e.g. "c 1:3 rwm".
+	DeviceCgroupRules []string
+	// Resources are the cgroup resource limits.
+	Resources Resources
+	// Ulimits are the process resource limits.
+	Ulimits []Ulimit
+	// Sysctls are the namespaced kernel parameters, e.g. "net.ipv4.ip_forward": "1".
+	Sysctls map[string]string
+	// ShmSize is the size of /dev/shm in bytes. Zero means the runtime default.
+	ShmSize int64
+	// NetworkMode is the network mode (e.g., "host", "bridge" or a network name).
+	NetworkMode string
+	// DNS is the list of DNS server addresses.
+	DNS []string
+	// DNSSearch is the list of DNS search domains.
+	DNSSearch []string
+	// ExtraHosts is the list of extra /etc/hosts entries in "hostname:ip" format.
+	ExtraHosts []string
+	// Name is the name of the container to create. Empty means the runtime picks one.
+	// It is not set by InspectSelf.
+	Name string
+	// Labels are the labels of the container to create. They are not set by InspectSelf.
+	Labels map[string]string
+	// AutoRemove removes the container once it exits. Runtimes that cannot do this
+	// leave the container behind and report it through Warner. It is not set by InspectSelf.
+	AutoRemove bool
+	// Snapshotter is the containerd snapshotter name (e.g., "overlayfs"). Only used by the nerdctl and containerd runtimes.
 	Snapshotter string
 }
 
+// Container is a container returned by Runtime.List.
+type Container struct {
+	// ID is the container ID.
+	ID string
+	// Name is the container name, if the runtime has one.
+	Name string
+	// Labels are the container labels.
+	Labels map[string]string
+	// Running indicates whether the container is running.
+	Running bool
+}
+
+// MatchLabels reports whether labels has every key in selector and, for non-empty
+// selector values, the same value.
+func MatchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		got, ok := labels[k]
+		if !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelFilters returns selector as "key" and "key=value" label filters, the form
+// the Docker API and the docker, nerdctl and Podman CLIs and APIs accept.
+func LabelFilters(selector map[string]string) []string {
+	filters := make([]string, 0, len(selector))
+	for _, k := range slices.Sorted(maps.Keys(selector)) {
+		if v := selector[k]; v != "" {
+			filters = append(filters, k+"="+v)
+			continue
+		}
+		filters = append(filters, k)
+	}
+	return filters
+}
+
 // Runtime is the interface that container runtimes must implement.
 type Runtime interface {
 	// InspectSelf returns the container configuration for the current container.
 	// The runtime is responsible for detecting which container it is running in.
 	InspectSelf(ctx context.Context) (ContainerInfo, error)
 	// RunContainer creates and starts a new container with the given configuration.
-	RunContainer(ctx context.Context, info ContainerInfo) error
-	// ImageExists checks if the given image reference exists locally.
-	ImageExists(ctx context.Context, imageRef string) bool
-	// PullImage pulls the given image reference from a registry.
-	PullImage(ctx context.Context, imageRef string) error
+	// It returns the ID of the created container.
+	RunContainer(ctx context.Context, info ContainerInfo) (string, error)
+	// Wait blocks until the container with the given ID exits and returns its exit code.
+	Wait(ctx context.Context, id string) (int, error)
+	// WaitForExit blocks until the container with the given ID is no longer running.
+	// Unlike Wait, a container that does not exist, e.g. because it was already
+	// removed, counts as exited.
+	WaitForExit(ctx context.Context, id string) error
+	// Stop sends signal to the container with the given ID and, if it is still
+	// running after timeout, kills it.
+	Stop(ctx context.Context, id string, signal syscall.Signal, timeout time.Duration) error
+	// Kill sends signal to the container with the given ID without waiting for it to exit.
+	Kill(ctx context.Context, id string, signal syscall.Signal) error
+	// List returns the containers, running or not, whose labels match selector.
+	// A selector key with an empty value matches any value.
+	List(ctx context.Context, selector map[string]string) ([]Container, error)
+	// Remove removes the stopped container with the given ID.
+	Remove(ctx context.Context, id string) error
+	// Logs streams the stdout and stderr of the container with the given ID to the
+	// given writers. It follows the output and returns once the container has exited.
+	Logs(ctx context.Context, id string, stdout, stderr io.Writer) error
+	// ImageExists checks if the given image reference exists locally and returns its metadata.
+	ImageExists(ctx context.Context, imageRef string) (ImageInfo, bool)
+	// PullImage pulls the given image reference from a registry, with the given credentials
+	// unless they are zero.
+	PullImage(ctx context.Context, imageRef string, auth RegistryAuth) error
 	// Close cleans up the runtime client resources.
 	Close() error
 }
+
+// Warner is an optional interface that runtime implementations can satisfy to report
+// the settings of a container configuration that RunContainer cannot apply.
+type Warner interface {
+	// Warnings returns a message for each setting of info that RunContainer drops.
+	Warnings(info ContainerInfo) []string
+}
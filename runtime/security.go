@@ -0,0 +1,130 @@
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LastCapability is the bit number of CAP_CHECKPOINT_RESTORE, the last capability with a name in this package.
+const LastCapability = 40
+
+// capabilityNames are the Linux capabilities indexed by their bit number.
+var capabilityNames = []string{ //nolint:gochecknoglobals // lookup table.
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK",
+	"CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE", "CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE", "CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL", "CAP_SETFCAP", "CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG",
+	"CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// DefaultCapabilities are the capabilities docker, nerdctl and containerd give an unprivileged container.
+var DefaultCapabilities = []string{ //nolint:gochecknoglobals // lookup table.
+	"CAP_AUDIT_WRITE", "CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_MKNOD", "CAP_NET_BIND_SERVICE", "CAP_NET_RAW", "CAP_SETFCAP",
+	"CAP_SETGID", "CAP_SETPCAP", "CAP_SETUID", "CAP_SYS_CHROOT",
+}
+
+// NormalizeCapability returns a capability name in the "CAP_NET_ADMIN" form.
+// "ALL" is returned as is.
+func NormalizeCapability(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "ALL" || strings.HasPrefix(name, "CAP_") {
+		return name
+	}
+	return "CAP_" + name
+}
+
+// ExpandCapabilities normalizes the capability names and replaces "ALL" with every named capability.
+func ExpandCapabilities(caps []string) []string {
+	var expanded []string
+	for _, c := range caps {
+		if c = NormalizeCapability(c); c == "ALL" {
+			expanded = append(expanded, capabilityNames...)
+			continue
+		}
+		expanded = append(expanded, c)
+	}
+	return expanded
+}
+
+// CapabilitiesFromMask returns the names of the capabilities set in mask, e.g. the
+// CapBnd value of /proc/self/status. Bits without a known name, e.g. capabilities of a
+// newer kernel, are skipped, as the runtimes reject capability names they do not know.
+func CapabilitiesFromMask(mask uint64) []string {
+	var caps []string
+	for mask != 0 {
+		bit := bits.TrailingZeros64(mask)
+		mask &^= 1 << bit
+		if bit < len(capabilityNames) {
+			caps = append(caps, capabilityNames[bit])
+		}
+	}
+	return caps
+}
+
+// CapabilityChanges returns the capabilities to add to and drop from DefaultCapabilities to get caps.
+func CapabilityChanges(caps []string) (add, drop []string) {
+	for _, c := range caps {
+		if c = NormalizeCapability(c); !slices.Contains(DefaultCapabilities, c) {
+			add = append(add, c)
+		}
+	}
+	for _, c := range DefaultCapabilities {
+		if !slices.ContainsFunc(caps, func(s string) bool { return NormalizeCapability(s) == c }) {
+			drop = append(drop, c)
+		}
+	}
+	return add, drop
+}
+
+// SecurityOptions are the parsed --security-opt values of a container.
+type SecurityOptions struct {
+	// NoNewPrivileges stops processes from gaining privileges, e.g. through setuid binaries.
+	NoNewPrivileges bool
+	// AppArmorProfile is the AppArmor profile name, "unconfined" or empty for the default.
+	AppArmorProfile string
+	// SeccompProfile is the path of a seccomp profile, "unconfined" or empty for the default.
+	SeccompProfile string
+	// Labels are the SELinux "label" options, e.g. "type:spc_t" or "disable".
+	Labels []string
+	// Other are the options this package does not know, e.g. "systempaths=unconfined", as given.
+	Other []string
+}
+
+// ParseSecurityOpts parses --security-opt values such as "no-new-privileges",
+// "apparmor=unconfined", "seccomp=/profile.json" and "label=disable".
+// Both "key=value" and the older "key:value" forms are accepted. Unknown options are kept in Other.
+func ParseSecurityOpts(opts []string) (SecurityOptions, error) {
+	var s SecurityOptions
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			key, value, _ = strings.Cut(opt, ":")
+		}
+		switch key {
+		case "no-new-privileges":
+			b, err := strconv.ParseBool(cmp.Or(value, "true"))
+			if err != nil {
+				return SecurityOptions{}, fmt.Errorf("invalid security option %q: %w", opt, err)
+			}
+			s.NoNewPrivileges = b
+		case "apparmor":
+			s.AppArmorProfile = value
+		case "seccomp":
+			s.SeccompProfile = value
+		case "label":
+			s.Labels = append(s.Labels, value)
+		default:
+			s.Other = append(s.Other, opt)
+		}
+	}
+	return s, nil
+}
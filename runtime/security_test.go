@@ -0,0 +1,45 @@
+package runtime_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+func TestCapabilityChangesFromMask(t *testing.T) {
+	// defaultBounding is the CapBnd of a default docker container, also for a non-root user.
+	const (
+		defaultBounding = 0xa80425fb
+		sysAdmin        = 1 << 21
+		netRaw          = 1 << 13
+		unnamed         = 1 << 63
+	)
+	tests := map[string]struct {
+		mask     uint64
+		wantAdd  []string
+		wantDrop []string
+	}{
+		"default":     {mask: defaultBounding},
+		"added":       {mask: defaultBounding | sysAdmin, wantAdd: []string{"CAP_SYS_ADMIN"}},
+		"dropped":     {mask: defaultBounding &^ netRaw, wantDrop: []string{"CAP_NET_RAW"}},
+		"unnamed bit": {mask: defaultBounding | unnamed},
+		"none":        {mask: 0, wantDrop: runtime.DefaultCapabilities},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			add, drop := runtime.CapabilityChanges(runtime.CapabilitiesFromMask(tt.mask))
+			if !slices.Equal(add, tt.wantAdd) || !slices.Equal(drop, tt.wantDrop) {
+				t.Errorf("CapabilityChanges(%#x) = %q, %q, want %q, %q", tt.mask, add, drop, tt.wantAdd, tt.wantDrop)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesFromMaskUnnamed(t *testing.T) {
+	// Bit 0 is CAP_CHOWN; bits 62 and 63 have no name yet and must not be passed to the runtimes.
+	const mask = 1 | 1<<62 | 1<<63
+	if got, want := runtime.CapabilitiesFromMask(mask), []string{"CAP_CHOWN"}; !slices.Equal(got, want) {
+		t.Errorf("CapabilitiesFromMask(%#x) = %q, want %q", uint64(mask), got, want)
+	}
+}
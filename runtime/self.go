@@ -0,0 +1,112 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// containerIDPattern matches the 64 character hex container IDs of Docker, nerdctl, Podman and the CRI runtimes.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`) //nolint:gochecknoglobals // compiled once.
+
+// selfMountpoints are the files the runtimes bind mount from a per-container directory that is named after the container ID.
+var selfMountpoints = []string{"/etc/hostname", "/etc/hosts", "/etc/resolv.conf"} //nolint:gochecknoglobals // lookup table.
+
+// SelfIDs returns the IDs and names the current container may be known by to its runtime, most
+// specific first: the container IDs in the sources of the /etc/hostname, /etc/hosts and
+// /etc/resolv.conf bind mounts and in /proc/self/cgroup, then the content of /etc/hostname and
+// the hostname. The hostname alone does not identify the container when it shares the host's
+// network or UTS namespace, as it is the host's hostname then.
+func SelfIDs() []string {
+	hostname, _ := os.Hostname()
+	return selfIDs(os.DirFS("/"), hostname)
+}
+
+// selfIDs is SelfIDs with the root filesystem and hostname given.
+func selfIDs(root fs.FS, hostname string) []string {
+	var ids []string
+	if b, err := fs.ReadFile(root, "proc/self/mountinfo"); err == nil {
+		ids = append(ids, mountinfoIDs(b)...)
+	}
+	if b, err := fs.ReadFile(root, "proc/self/cgroup"); err == nil {
+		ids = append(ids, cgroupIDs(b)...)
+	}
+	if b, err := fs.ReadFile(root, "etc/hostname"); err == nil {
+		ids = append(ids, strings.TrimSpace(string(b)))
+	}
+	ids = append(ids, hostname)
+
+	ids = slices.DeleteFunc(ids, func(id string) bool { return id == "" })
+	var unique []string
+	for _, id := range ids {
+		if !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// mountinfoIDs returns the container IDs in the root paths of the selfMountpoints mounts of a
+// /proc/self/mountinfo file, e.g. the ID in "/var/lib/docker/containers/<id>/hostname".
+func mountinfoIDs(mountinfo []byte) []string {
+	var ids []string
+	s := bufio.NewScanner(bytes.NewReader(mountinfo))
+	for s.Scan() {
+		// The fields are: mount ID, parent ID, major:minor, root, mount point, ...
+		const rootField, mountPointField = 3, 4
+		fields := strings.Fields(s.Text())
+		if len(fields) <= mountPointField || !slices.Contains(selfMountpoints, fields[mountPointField]) {
+			continue
+		}
+		for _, part := range strings.Split(fields[rootField], "/") {
+			if part != "" && containerIDPattern.FindString(part) == part {
+				ids = append(ids, part)
+			}
+		}
+	}
+	return ids
+}
+
+// cgroupIDs returns the container IDs in the cgroup paths of a /proc/self/cgroup file, e.g. the ID in
+// "0::/system.slice/docker-<id>.scope". The paths only show this when the container shares the
+// host's cgroup namespace or uses cgroup v1.
+func cgroupIDs(cgroup []byte) []string {
+	var ids []string
+	s := bufio.NewScanner(bytes.NewReader(cgroup))
+	for s.Scan() {
+		// The fields are: hierarchy ID, controllers, path. The last ID in the path is the most specific.
+		const numFields = 3
+		fields := strings.SplitN(s.Text(), ":", numFields)
+		if len(fields) != numFields {
+			continue
+		}
+		if found := containerIDPattern.FindAllString(fields[2], -1); len(found) > 0 {
+			ids = append(ids, found[len(found)-1])
+		}
+	}
+	return ids
+}
+
+// InspectFirst calls inspect with each of ids in turn and returns the first container it finds.
+// Runtimes use it with SelfIDs to implement InspectSelf.
+func InspectFirst(ctx context.Context, ids []string, inspect func(ctx context.Context, id string) (ContainerInfo, error)) (ContainerInfo, error) {
+	if len(ids) == 0 {
+		return ContainerInfo{}, errors.New("unable to determine the current container ID")
+	}
+	var errs []error
+	for _, id := range ids {
+		info, err := inspect(ctx, id)
+		if err == nil {
+			return info, nil
+		}
+		errs = append(errs, err)
+	}
+	return ContainerInfo{}, fmt.Errorf("finding the current container: %w", errors.Join(errs...))
+}
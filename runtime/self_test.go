@@ -0,0 +1,129 @@
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobweinstock/waitdaemon/runtime"
+)
+
+// The container IDs used in the sample files.
+const (
+	idA = "a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1"
+	idB = "b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2"
+)
+
+func TestMountinfoIDs(t *testing.T) {
+	tests := map[string]struct {
+		mountinfo string
+		want      []string
+	}{
+		"docker": {
+			mountinfo: "1234 1200 0:31 / / rw,relatime - overlay overlay rw\n" +
+				"1240 1234 259:2 /var/lib/docker/containers/" + idA + "/resolv.conf /etc/resolv.conf rw - ext4 /dev/nvme0n1p2 rw\n" +
+				"1241 1234 259:2 /var/lib/docker/containers/" + idA + "/hostname /etc/hostname rw - ext4 /dev/nvme0n1p2 rw\n",
+			want: []string{idA, idA},
+		},
+		"nerdctl": {
+			mountinfo: "601 590 259:2 /var/lib/nerdctl/1935db59/containers/default/" + idA + "/hosts /etc/hosts rw - ext4 /dev/root rw\n",
+			want:      []string{idA},
+		},
+		"podman": {
+			mountinfo: "702 690 0:50 /containers/storage/overlay-containers/" + idA + "/userdata/hostname /etc/hostname rw - tmpfs tmpfs rw\n",
+			want:      []string{idA},
+		},
+		"cri": {
+			mountinfo: "803 790 259:2 /var/lib/containerd/io.containerd.grpc.v1.cri/sandboxes/" + idB + "/hostname /etc/hostname rw - ext4 /dev/root rw\n",
+			want:      []string{idB},
+		},
+		"other mounts are ignored": {
+			mountinfo: "900 890 259:2 /var/lib/data/" + idA + " /data rw - ext4 /dev/root rw\n",
+		},
+		"host files without an ID": {
+			mountinfo: "901 890 259:2 /etc/resolv.conf /etc/resolv.conf rw - ext4 /dev/root rw\n",
+		},
+		"partial IDs are ignored": {
+			mountinfo: "902 890 259:2 /var/run/" + idA + "-extra/hostname /etc/hostname rw - ext4 /dev/root rw\n",
+		},
+		"short lines": {
+			mountinfo: "903 890 259:2\n",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := runtime.MountinfoIDs([]byte(tt.mountinfo)); !slices.Equal(got, tt.want) {
+				t.Errorf("MountinfoIDs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCgroupIDs(t *testing.T) {
+	tests := map[string]struct {
+		cgroup string
+		want   []string
+	}{
+		"cgroup v2 with systemd":       {cgroup: "0::/system.slice/docker-" + idA + ".scope\n", want: []string{idA}},
+		"cgroup v2 with cgroupfs":      {cgroup: "0::/docker/" + idA + "\n", want: []string{idA}},
+		"cgroup v2 private":            {cgroup: "0::/\n"},
+		"cgroup v1":                    {cgroup: "12:memory:/docker/" + idA + "\n11:cpu,cpuacct:/docker/" + idA + "\n", want: []string{idA, idA}},
+		"kubernetes pod and container": {cgroup: "0::/kubepods/besteffort/pod" + idB + "/" + idA + "\n", want: []string{idA}},
+		"malformed":                    {cgroup: "garbage\n"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := runtime.CgroupIDs([]byte(tt.cgroup)); !slices.Equal(got, tt.want) {
+				t.Errorf("CgroupIDs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfIDs(t *testing.T) {
+	root := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("1241 1234 259:2 /var/lib/docker/containers/" + idA + "/hostname /etc/hostname rw - ext4 /dev/root rw\n")},
+		"proc/self/cgroup":    {Data: []byte("0::/system.slice/docker-" + idA + ".scope\n")},
+		"etc/hostname":        {Data: []byte("waitdaemon-1\n")},
+	}
+	want := []string{idA, "waitdaemon-1", "host"}
+	if got := runtime.SelfIDsFrom(root, "host"); !slices.Equal(got, want) {
+		t.Errorf("selfIDs() = %q, want %q", got, want)
+	}
+
+	// Without the files only the hostname is left, and a missing hostname leaves nothing.
+	if got := runtime.SelfIDsFrom(fstest.MapFS{}, "host"); !slices.Equal(got, []string{"host"}) {
+		t.Errorf("selfIDs() without files = %q, want %q", got, []string{"host"})
+	}
+	if got := runtime.SelfIDsFrom(fstest.MapFS{}, ""); len(got) != 0 {
+		t.Errorf("selfIDs() without files and hostname = %q, want none", got)
+	}
+}
+
+func TestInspectFirst(t *testing.T) {
+	var tried []string
+	inspect := func(_ context.Context, id string) (runtime.ContainerInfo, error) {
+		tried = append(tried, id)
+		if id != "b" {
+			return runtime.ContainerInfo{}, errors.New("not found: " + id)
+		}
+		return runtime.ContainerInfo{ID: id}, nil
+	}
+
+	info, err := runtime.InspectFirst(context.Background(), []string{"a", "b", "c"}, inspect)
+	if err != nil || info.ID != "b" || !slices.Equal(tried, []string{"a", "b"}) {
+		t.Errorf("InspectFirst() = %q, %v after trying %q, want b after trying a and b", info.ID, err, tried)
+	}
+
+	_, err = runtime.InspectFirst(context.Background(), []string{"a", "c"}, inspect)
+	if err == nil || !strings.Contains(err.Error(), "not found: a") || !strings.Contains(err.Error(), "not found: c") {
+		t.Errorf("InspectFirst() error = %v, want both errors", err)
+	}
+
+	if _, err := runtime.InspectFirst(context.Background(), nil, inspect); err == nil {
+		t.Error("InspectFirst() without IDs error = nil, want an error")
+	}
+}
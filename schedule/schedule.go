@@ -0,0 +1,212 @@
+// Package schedule decides when the second fork runs the user image: at an absolute
+// time, inside a recurring maintenance window, or both, with optional random jitter.
+// All times are UTC.
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock tells the time and waits. It allows a schedule to be tested without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the system time.
+type SystemClock struct{}
+
+// Now returns the current time.
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time on the returned channel.
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Window is a recurring daily maintenance window.
+type Window struct {
+	// Start is the start of the window as an offset from midnight UTC.
+	Start time.Duration
+	// End is the end of the window as an offset from midnight UTC.
+	// When End is not after Start the window ends on the next day.
+	End time.Duration
+	// Days are the days of the week the window starts on. Empty means every day.
+	Days []time.Weekday
+}
+
+// Schedule is when the user image should run.
+type Schedule struct {
+	// RunAt is the earliest time to run. The zero value means now.
+	RunAt time.Time
+	// Window, when set, restricts the run to the maintenance window.
+	Window *Window
+	// Jitter is the maximum random delay added to the run time. When a window is set,
+	// the delay is capped so that the run time stays inside the window.
+	Jitter time.Duration
+}
+
+// IsZero reports whether the schedule has no settings.
+func (s Schedule) IsZero() bool {
+	return s.RunAt.IsZero() && s.Window == nil && s.Jitter == 0
+}
+
+// HasRunTime reports whether the schedule sets when to run, with RunAt or a Window.
+// A schedule with only Jitter delays a run from whenever it would otherwise happen.
+func (s Schedule) HasRunTime() bool {
+	return !s.RunAt.IsZero() || s.Window != nil
+}
+
+// Parse parses the schedule settings. runAt is an RFC3339 time, windowStart and windowEnd
+// are "HH:MM" times of day, windowDays is a comma separated list of weekdays (e.g. "mon,tue")
+// and jitterSeconds is a number of seconds. Empty values are not set.
+func Parse(runAt, windowStart, windowEnd, windowDays, jitterSeconds string) (Schedule, error) {
+	var s Schedule
+	if runAt != "" {
+		t, err := time.Parse(time.RFC3339, runAt)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("invalid run at time %q: %w", runAt, err)
+		}
+		s.RunAt = t
+	}
+
+	if windowStart != "" || windowEnd != "" || windowDays != "" {
+		w, err := parseWindow(windowStart, windowEnd, windowDays)
+		if err != nil {
+			return Schedule{}, err
+		}
+		s.Window = w
+	}
+
+	if jitterSeconds != "" {
+		i, err := strconv.Atoi(jitterSeconds)
+		if err != nil || i < 0 {
+			return Schedule{}, fmt.Errorf("invalid jitter %q, must be a non-negative number of seconds", jitterSeconds)
+		}
+		s.Jitter = time.Duration(i) * time.Second
+	}
+	return s, nil
+}
+
+func parseWindow(start, end, days string) (*Window, error) {
+	if start == "" || end == "" {
+		return nil, errors.New("a maintenance window needs both a start and an end")
+	}
+	w := &Window{}
+	var err error
+	if w.Start, err = parseTimeOfDay(start); err != nil {
+		return nil, err
+	}
+	if w.End, err = parseTimeOfDay(end); err != nil {
+		return nil, err
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("maintenance window start and end are both %q", start)
+	}
+	if days != "" {
+		for _, d := range strings.Split(days, ",") {
+			wd, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return nil, fmt.Errorf("invalid day of week %q", d)
+			}
+			w.Days = append(w.Days, wd)
+		}
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, must be HH:MM: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// weekdays maps the accepted day names to weekdays.
+var weekdays = map[string]time.Weekday{ //nolint:gochecknoglobals // lookup table.
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Next returns when the user image should run given the current time.
+// jitter picks the random delay in [0, limit); it is only called when limit is positive.
+func (s Schedule) Next(now time.Time, jitter func(limit time.Duration) time.Duration) time.Time {
+	next := now.UTC()
+	if s.RunAt.After(next) {
+		next = s.RunAt.UTC()
+	}
+
+	limit := s.Jitter
+	if s.Window != nil {
+		start, end := s.Window.next(next)
+		next = start
+		if remaining := end.Sub(start); remaining < limit {
+			limit = remaining
+		}
+	}
+	if limit > 0 {
+		next = next.Add(jitter(limit))
+	}
+	return next
+}
+
+// next returns the earliest time at or after t inside the window, and the end of that window.
+func (w *Window) next(t time.Time) (time.Time, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	// Start a day early to catch a window that began yesterday and ends today.
+	// A week later every allowed weekday has been seen.
+	for offset := -1; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		if !w.allows(day.Weekday()) {
+			continue
+		}
+		start := day.Add(w.Start)
+		end := day.Add(w.End)
+		if !end.After(start) {
+			end = end.Add(24 * time.Hour) //nolint:mnd // the window ends the next day.
+		}
+		if t.Before(end) {
+			if t.After(start) {
+				return t, end
+			}
+			return start, end
+		}
+	}
+	// Unreachable: every window that starts within the next week ends after t.
+	return t, t
+}
+
+func (w *Window) allows(d time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, d)
+}
+
+// SleepUntil blocks until the clock reaches t or ctx is done.
+func SleepUntil(ctx context.Context, clock Clock, t time.Time) error {
+	d := t.Sub(clock.Now())
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
+
+// RandomJitter returns a random duration in [0, limit). It is the jitter function used with Next outside of tests.
+func RandomJitter(limit time.Duration) time.Duration {
+	return time.Duration(rand.Int64N(int64(limit))) //nolint:gosec // jitter does not need a secure random source.
+}
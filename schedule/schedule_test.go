@@ -0,0 +1,271 @@
+package schedule_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/waitdaemon/schedule"
+)
+
+// at returns the UTC time on the given day of June 2025. June 2, 2025 is a Monday.
+func at(day, hour, minute int) time.Time {
+	return time.Date(2025, time.June, day, hour, minute, 0, 0, time.UTC)
+}
+
+// maxJitter is a jitter function that always picks the largest delay allowed, so the tests see the cap.
+func maxJitter(limit time.Duration) time.Duration {
+	return limit
+}
+
+func TestNext(t *testing.T) {
+	tests := map[string]struct {
+		runAt                             string
+		winStart, winEnd, winDays, jitter string
+		now                               time.Time
+		want                              time.Time
+	}{
+		"empty schedule runs now": {
+			now:  at(2, 10, 0),
+			want: at(2, 10, 0),
+		},
+		"run at in the future": {
+			runAt: "2025-06-03T08:30:00Z",
+			now:   at(2, 10, 0),
+			want:  at(3, 8, 30),
+		},
+		"run at in the past runs now": {
+			runAt: "2025-06-01T08:30:00Z",
+			now:   at(2, 10, 0),
+			want:  at(2, 10, 0),
+		},
+		"run at in another time zone": {
+			runAt: "2025-06-03T08:30:00+02:00",
+			now:   at(2, 10, 0),
+			want:  at(3, 6, 30),
+		},
+		"before the window": {
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 1, 0),
+			want: at(2, 2, 0),
+		},
+		"inside the window": {
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 3, 0),
+			want: at(2, 3, 0),
+		},
+		"after the window waits for the next day": {
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 4, 0),
+			want: at(3, 2, 0),
+		},
+		"window past midnight before it starts": {
+			winStart: "22:00", winEnd: "02:00",
+			now:  at(2, 12, 0),
+			want: at(2, 22, 0),
+		},
+		"window past midnight before midnight": {
+			winStart: "22:00", winEnd: "02:00",
+			now:  at(2, 23, 0),
+			want: at(2, 23, 0),
+		},
+		"window past midnight after midnight": {
+			winStart: "22:00", winEnd: "02:00",
+			now:  at(3, 1, 0),
+			want: at(3, 1, 0),
+		},
+		"window past midnight after it ends": {
+			winStart: "22:00", winEnd: "02:00",
+			now:  at(3, 2, 0),
+			want: at(3, 22, 0),
+		},
+		"window days later in the week": {
+			winStart: "02:00", winEnd: "04:00", winDays: "sat,sun",
+			now:  at(2, 3, 0),
+			want: at(7, 2, 0),
+		},
+		"window days today": {
+			winStart: "02:00", winEnd: "04:00", winDays: "Monday",
+			now:  at(2, 3, 0),
+			want: at(2, 3, 0),
+		},
+		"window days next week": {
+			winStart: "02:00", winEnd: "04:00", winDays: "mon",
+			now:  at(2, 5, 0),
+			want: at(9, 2, 0),
+		},
+		"window past midnight from an allowed day": {
+			winStart: "22:00", winEnd: "02:00", winDays: "sun",
+			now:  at(2, 1, 0),
+			want: at(2, 1, 0),
+		},
+		"window past midnight only starts on allowed days": {
+			winStart: "22:00", winEnd: "02:00", winDays: "sun",
+			now:  at(2, 23, 0),
+			want: at(8, 22, 0),
+		},
+		"run at before the window": {
+			runAt:    "2025-06-04T01:00:00Z",
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 10, 0),
+			want: at(4, 2, 0),
+		},
+		"run at inside the window": {
+			runAt:    "2025-06-04T02:30:00Z",
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 10, 0),
+			want: at(4, 2, 30),
+		},
+		"run at after the window": {
+			runAt:    "2025-06-04T05:00:00Z",
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 10, 0),
+			want: at(5, 2, 0),
+		},
+		"run at in the past inside the window": {
+			runAt:    "2025-06-01T02:30:00Z",
+			winStart: "02:00", winEnd: "04:00",
+			now:  at(2, 3, 0),
+			want: at(2, 3, 0),
+		},
+		"jitter alone": {
+			jitter: "600",
+			now:    at(2, 10, 0),
+			want:   at(2, 10, 10),
+		},
+		"jitter after run at": {
+			runAt:  "2025-06-03T08:30:00Z",
+			jitter: "600",
+			now:    at(2, 10, 0),
+			want:   at(3, 8, 40),
+		},
+		"jitter inside the window": {
+			winStart: "02:00", winEnd: "04:00", jitter: "1800",
+			now:  at(2, 1, 0),
+			want: at(2, 2, 30),
+		},
+		"jitter capped at the window end": {
+			winStart: "02:00", winEnd: "04:00", jitter: "3600",
+			now:  at(2, 3, 30),
+			want: at(2, 4, 0),
+		},
+		"jitter capped at the window end past midnight": {
+			winStart: "22:00", winEnd: "02:00", jitter: "7200",
+			now:  at(3, 1, 15),
+			want: at(3, 2, 0),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := schedule.Parse(tt.runAt, tt.winStart, tt.winEnd, tt.winDays, tt.jitter)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := s.Next(tt.now, maxJitter); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextWithoutJitterDoesNotCallJitter(t *testing.T) {
+	s, err := schedule.Parse("", "02:00", "04:00", "", "")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	s.Next(at(2, 3, 0), func(time.Duration) time.Duration {
+		t.Error("jitter called without a jitter setting")
+		return 0
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		runAt, winStart, winEnd, winDays, jitter string
+	}{
+		"run at is not RFC3339":      {runAt: "2025-06-03 08:30"},
+		"window without an end":      {winStart: "02:00"},
+		"window without a start":     {winEnd: "04:00"},
+		"window days without window": {winDays: "mon"},
+		"invalid start":              {winStart: "2am", winEnd: "04:00"},
+		"invalid end":                {winStart: "02:00", winEnd: "25:00"},
+		"empty window":               {winStart: "02:00", winEnd: "02:00"},
+		"invalid day":                {winStart: "02:00", winEnd: "04:00", winDays: "mon,someday"},
+		"negative jitter":            {jitter: "-1"},
+		"jitter is not a number":     {jitter: "30s"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := schedule.Parse(tt.runAt, tt.winStart, tt.winEnd, tt.winDays, tt.jitter); err == nil {
+				t.Error("Parse() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestHasRunTime(t *testing.T) {
+	tests := map[string]struct {
+		runAt, winStart, winEnd, jitter string
+		wantZero, wantRunTime           bool
+	}{
+		"empty":       {wantZero: true},
+		"run at":      {runAt: "2025-06-03T08:30:00Z", wantRunTime: true},
+		"window":      {winStart: "02:00", winEnd: "04:00", wantRunTime: true},
+		"jitter only": {jitter: "60"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := schedule.Parse(tt.runAt, tt.winStart, tt.winEnd, "", tt.jitter)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if s.IsZero() != tt.wantZero || s.HasRunTime() != tt.wantRunTime {
+				t.Errorf("IsZero(), HasRunTime() = %v, %v, want %v, %v", s.IsZero(), s.HasRunTime(), tt.wantZero, tt.wantRunTime)
+			}
+		})
+	}
+}
+
+// fakeClock is a Clock at a fixed time whose After records the duration and fires at once.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.slept = append(c.slept, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func TestSleepUntil(t *testing.T) {
+	clock := &fakeClock{now: at(2, 10, 0)}
+	if err := schedule.SleepUntil(context.Background(), clock, at(2, 9, 0)); err != nil || len(clock.slept) != 0 {
+		t.Errorf("SleepUntil(past) = %v after sleeping %v, want nil without sleeping", err, clock.slept)
+	}
+	if err := schedule.SleepUntil(context.Background(), clock, at(2, 10, 30)); err != nil || len(clock.slept) != 1 || clock.slept[0] != 30*time.Minute {
+		t.Errorf("SleepUntil(future) = %v after sleeping %v, want nil after 30m", err, clock.slept)
+	}
+}
+
+func TestSleepUntilCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The system clock never fires within the test, so only ctx can end the sleep.
+	if err := schedule.SleepUntil(ctx, schedule.SystemClock{}, time.Now().Add(time.Hour)); !errors.Is(err, context.Canceled) {
+		t.Errorf("SleepUntil() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRandomJitter(t *testing.T) {
+	const limit = 10 * time.Millisecond
+	for range 1000 {
+		if d := schedule.RandomJitter(limit); d < 0 || d >= limit {
+			t.Fatalf("RandomJitter(%s) = %s, want a duration in [0, %s)", limit, d, limit)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package waitfor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileExists reports whether path exists on the host filesystem.
+func fileExists(env Env, path string) func(context.Context) (bool, error) {
+	name := strings.TrimPrefix(path, "/")
+	return func(context.Context) (bool, error) {
+		_, err := fs.Stat(env.HostFS, name)
+		if err == nil {
+			return true, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking %q: %w", path, err)
+	}
+}
+
+// tcpOpen reports whether address accepts TCP connections. When open is false the result is inverted.
+func tcpOpen(env Env, address string, open bool) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		conn, err := env.Dial(ctx, "tcp", address)
+		if err != nil {
+			return !open, nil //nolint:nilerr // a failed dial is the answer, not an error.
+		}
+		_ = conn.Close()
+		return open, nil
+	}
+}
+
+// httpOK reports whether a GET request to url returns a 2xx status.
+func httpOK(env Env, url string) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := env.HTTPClient.Do(req)
+		if err != nil {
+			return false, nil //nolint:nilerr // an unreachable endpoint is not ready yet.
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode <= 299, nil
+	}
+}
+
+// processExited reports whether no process with the given name is running.
+// The name is matched against /proc/<pid>/comm, which the kernel truncates to 15 characters.
+func processExited(env Env, name string) func(context.Context) (bool, error) {
+	const maxComm = 15
+	if len(name) > maxComm {
+		name = name[:maxComm]
+	}
+	return func(context.Context) (bool, error) {
+		entries, err := fs.ReadDir(env.ProcFS, ".")
+		if err != nil {
+			return false, fmt.Errorf("listing processes: %w", err)
+		}
+		for _, e := range entries {
+			if _, err := strconv.Atoi(e.Name()); err != nil || !e.IsDir() {
+				continue
+			}
+			comm, err := fs.ReadFile(env.ProcFS, e.Name()+"/comm")
+			if err != nil {
+				// The process may have exited between listing and reading.
+				continue
+			}
+			if string(bytes.TrimSpace(comm)) == name {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// uptimeAbove reports whether the host uptime is greater than d.
+func uptimeAbove(env Env, d time.Duration) func(context.Context) (bool, error) {
+	return func(context.Context) (bool, error) {
+		b, err := fs.ReadFile(env.ProcFS, "uptime")
+		if err != nil {
+			return false, fmt.Errorf("reading uptime: %w", err)
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return false, errors.New("reading uptime: empty file")
+		}
+		secs, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return false, fmt.Errorf("parsing uptime %q: %w", fields[0], err)
+		}
+		return time.Duration(secs*float64(time.Second)) > d, nil
+	}
+}
@@ -0,0 +1,167 @@
+package waitfor_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jacobweinstock/waitdaemon/waitfor"
+)
+
+// pollInterval keeps the tests fast; the conditions with a short timeout are the ones expected to time out.
+const pollInterval = time.Millisecond
+
+// dialer returns a Dial function that connects only to the open addresses.
+func dialer(open ...string) func(context.Context, string, string) (net.Conn, error) {
+	return func(_ context.Context, _, address string) (net.Conn, error) {
+		for _, a := range open {
+			if a == address {
+				client, server := net.Pipe()
+				_ = server.Close()
+				return client, nil
+			}
+		}
+		return nil, errors.New("connection refused")
+	}
+}
+
+// testEnv returns an Env with a fake host filesystem, proc filesystem and network, and the
+// URL of a test HTTP server whose /healthz endpoint is ready.
+func testEnv(t *testing.T) (waitfor.Env, string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	env := waitfor.Env{
+		HostFS: fstest.MapFS{
+			"run/tink/done":           {Data: []byte{}},
+			"run/tink/done, (really)": {Data: []byte{}},
+		},
+		ProcFS: fstest.MapFS{
+			"uptime":    {Data: []byte("600.25 1200.50\n")},
+			"1/comm":    {Data: []byte("systemd\n")},
+			"42/comm":   {Data: []byte("tink-worker\n")},
+			"43/comm":   {Data: []byte("a-very-long-pro\n")},
+			"44/status": {Data: []byte("Name: exited\n")},
+			"self/comm": {Data: []byte("tink-agent\n")},
+		},
+		Dial:         dialer("127.0.0.1:8080"),
+		HTTPClient:   srv.Client(),
+		PollInterval: pollInterval,
+	}
+	return env, srv.URL
+}
+
+func TestConditions(t *testing.T) {
+	tests := map[string]struct {
+		expr    string
+		wantErr error
+	}{
+		"file exists":                 {expr: "file(/run/tink/done)"},
+		"file missing":                {expr: "file(/run/tink/missing, 20ms)", wantErr: waitfor.ErrTimeout},
+		"tcp-open open":               {expr: "tcp-open(127.0.0.1:8080)"},
+		"tcp-open closed":             {expr: "tcp-open(127.0.0.1:9090, 20ms)", wantErr: waitfor.ErrTimeout},
+		"tcp-closed closed":           {expr: "tcp-closed(127.0.0.1:9090)"},
+		"tcp-closed open":             {expr: "tcp-closed(127.0.0.1:8080, 20ms)", wantErr: waitfor.ErrTimeout},
+		"http ok":                     {expr: "http($TEST_HTTP_URL/healthz)"},
+		"http quoted":                 {expr: `http("$TEST_HTTP_URL/healthz?a=1,2&b=(x)")`},
+		"file quoted":                 {expr: `file("/run/tink/done, (really)")`},
+		"http unavailable":            {expr: "http($TEST_HTTP_URL/ready, 20ms)", wantErr: waitfor.ErrTimeout},
+		"http unreachable":            {expr: "http(http://127.0.0.1:1/healthz, 20ms)", wantErr: waitfor.ErrTimeout},
+		"process-exited not running":  {expr: "process-exited(tink-agent)"},
+		"process-exited running":      {expr: "process-exited(tink-worker, 20ms)", wantErr: waitfor.ErrTimeout},
+		"process-exited long name":    {expr: "process-exited(a-very-long-process-name, 20ms)", wantErr: waitfor.ErrTimeout},
+		"uptime above":                {expr: "uptime(10m)"},
+		"uptime below":                {expr: "uptime(1h, 20ms)", wantErr: waitfor.ErrTimeout},
+		"all met":                     {expr: "all(file(/run/tink/done), tcp-open(127.0.0.1:8080), uptime(1m))"},
+		"all with one unmet":          {expr: "all(file(/run/tink/done), file(/missing, 20ms))", wantErr: waitfor.ErrTimeout},
+		"any with one met":            {expr: "any(file(/missing, 1h), tcp-closed(127.0.0.1:9090))"},
+		"any with none met":           {expr: "any(file(/missing, 20ms), uptime(1h, 20ms))", wantErr: waitfor.ErrTimeout},
+		"nested":                      {expr: "all(any(file(/missing, 1h), uptime(1m)), process-exited(tink-agent))"},
+		"nested with an inner unmet":  {expr: "any(all(file(/run/tink/done), file(/missing, 20ms)), uptime(1h, 30ms))", wantErr: waitfor.ErrTimeout},
+		"timeout of the inner leaves": {expr: "all(file(/missing, 20ms))", wantErr: waitfor.ErrTimeout},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			env, url := testEnv(t)
+			c, err := waitfor.Parse(strings.ReplaceAll(tt.expr, "$TEST_HTTP_URL", url), env)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = c.Wait(ctx)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("Wait() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUptimeInvalid(t *testing.T) {
+	env := waitfor.Env{
+		ProcFS:       fstest.MapFS{"uptime": {Data: []byte("soon\n")}},
+		PollInterval: pollInterval,
+	}
+	c, err := waitfor.Parse("uptime(1m, 1h)", env)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	// A check that fails is an error right away rather than a timeout.
+	err = c.Wait(context.Background())
+	if err == nil || errors.Is(err, waitfor.ErrTimeout) {
+		t.Errorf("Wait() error = %v, want a parse error", err)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	env, _ := testEnv(t)
+	c, err := waitfor.Parse("any(file(/missing), tcp-open(127.0.0.1:9090))", env)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// The parent context ending is not the condition's own timeout.
+	err = c.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, waitfor.ErrTimeout) {
+		t.Errorf("Wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWaitBecomesMet(t *testing.T) {
+	// The port opens on the third check.
+	const openAfter = 3
+	env, _ := testEnv(t)
+	var dials int
+	env.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		if dials < openAfter {
+			return nil, errors.New("connection refused")
+		}
+		return dialer(address)(ctx, network, address)
+	}
+	c, err := waitfor.Parse("tcp-open(127.0.0.1:8080, 1m)", env)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if err := c.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	if dials != openAfter {
+		t.Errorf("dialed %d times, want %d", dials, openAfter)
+	}
+}
@@ -0,0 +1,164 @@
+package waitfor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse parses a condition expression. The conditions are checked against env.
+func Parse(expr string, env Env) (Condition, error) {
+	env = env.withDefaults()
+	c, rest, err := parseExpr(strings.TrimSpace(expr), env)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected %q after condition", rest)
+	}
+	return c, nil
+}
+
+// parseExpr parses a single name(args...) call from the start of s and returns the unparsed remainder.
+func parseExpr(s string, env Env) (Condition, string, error) {
+	open := strings.IndexByte(s, '(')
+	if open <= 0 {
+		return nil, "", fmt.Errorf("expected name(...) in %q", s)
+	}
+	name := strings.TrimSpace(s[:open])
+	args, rest, err := splitArgs(s[open+1:])
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	switch name {
+	case "all", "any":
+		if len(args) == 0 {
+			return nil, "", fmt.Errorf("%s: at least one condition is required", name)
+		}
+		g := &group{all: name == "all"}
+		for _, a := range args {
+			c, err := Parse(a, env)
+			if err != nil {
+				return nil, "", err
+			}
+			g.conditions = append(g.conditions, c)
+		}
+		return g, rest, nil
+	}
+
+	l, err := parseLeaf(name, args, env)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, rest, nil
+}
+
+// parseLeaf builds a leaf condition from its name and arguments.
+func parseLeaf(name string, args []string, env Env) (*leaf, error) {
+	expr := name + "(" + strings.Join(args, ", ") + ")"
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("%s: expected an argument and an optional timeout", expr)
+	}
+	for i, a := range args {
+		u, err := unquote(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", expr, err)
+		}
+		args[i] = u
+	}
+	if args[0] == "" {
+		return nil, fmt.Errorf("%s: expected an argument and an optional timeout", expr)
+	}
+	l := &leaf{expr: expr, timeout: DefaultTimeout, interval: env.PollInterval}
+	if len(args) == 2 { //nolint:mnd // the optional timeout is present.
+		t, err := time.ParseDuration(args[1])
+		if err != nil || t <= 0 {
+			return nil, fmt.Errorf("%s: invalid timeout %q", expr, args[1])
+		}
+		l.timeout = t
+	}
+
+	arg := args[0]
+	switch name {
+	case "file":
+		l.check = fileExists(env, arg)
+	case "tcp-open", "tcp-closed":
+		l.check = tcpOpen(env, arg, name == "tcp-open")
+	case "http":
+		l.check = httpOK(env, arg)
+	case "process-exited":
+		l.check = processExited(env, arg)
+	case "uptime":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid duration %q", expr, arg)
+		}
+		l.check = uptimeAbove(env, d)
+	default:
+		return nil, fmt.Errorf("unknown condition %q", name)
+	}
+	return l, nil
+}
+
+// unquote returns arg without its double quotes when it is quoted.
+// Quoted arguments use Go string syntax, so a quote inside one is written as \".
+func unquote(arg string) (string, error) {
+	if !strings.HasPrefix(arg, `"`) {
+		return arg, nil
+	}
+	u, err := strconv.Unquote(arg)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted argument %s", arg)
+	}
+	return u, nil
+}
+
+// splitArgs splits the comma separated arguments of a call up to its closing parenthesis.
+// Commas inside nested calls and double quoted arguments are not split on, and parentheses
+// inside double quoted arguments are not counted. The arguments keep their quotes.
+// It returns the text after the closing parenthesis.
+func splitArgs(s string) ([]string, string, error) {
+	var args []string
+	depth, start := 0, 0
+	quoted, escaped := false, false
+	for i, r := range s {
+		if quoted {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				quoted = false
+			}
+			continue
+		}
+		switch r {
+		case '"':
+			quoted = true
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if last := strings.TrimSpace(s[start:i]); last != "" || len(args) > 0 {
+				args = append(args, last)
+			}
+			return args, s[i+1:], nil
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if quoted {
+		return nil, "", errors.New("missing closing quote")
+	}
+	return nil, "", errors.New("missing closing parenthesis")
+}
@@ -0,0 +1,78 @@
+package waitfor_test
+
+import (
+	"testing"
+
+	"github.com/jacobweinstock/waitdaemon/waitfor"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		expr string
+		want string
+	}{
+		"file":                  {expr: "file(/run/tink/done)", want: "file(/run/tink/done)"},
+		"timeout":               {expr: "file(/run/done, 30s)", want: "file(/run/done, 30s)"},
+		"whitespace":            {expr: "  tcp-open( 127.0.0.1:8080 ,  1m )  ", want: "tcp-open(127.0.0.1:8080, 1m)"},
+		"tcp-closed":            {expr: "tcp-closed(127.0.0.1:42113)", want: "tcp-closed(127.0.0.1:42113)"},
+		"http with query":       {expr: "http(http://127.0.0.1:8080/healthz?ready=1)", want: "http(http://127.0.0.1:8080/healthz?ready=1)"},
+		"process-exited":        {expr: "process-exited(tink-worker)", want: "process-exited(tink-worker)"},
+		"uptime":                {expr: "uptime(5m, 10m)", want: "uptime(5m, 10m)"},
+		"all":                   {expr: "all(file(/a), uptime(1m))", want: "all(file(/a), uptime(1m))"},
+		"any with one":          {expr: "any(file(/a))", want: "any(file(/a))"},
+		"nested":                {expr: "all(file(/a, 5s), any(tcp-open(10.0.0.1:80, 10s), http(http://10.0.0.1/)), uptime(2m))", want: "all(file(/a, 5s), any(tcp-open(10.0.0.1:80, 10s), http(http://10.0.0.1/)), uptime(2m))"},
+		"nested commas in args": {expr: "any(all(file(/a), file(/b)), all(file(/c), file(/d)))", want: "any(all(file(/a), file(/b)), all(file(/c), file(/d)))"},
+		"quoted":                {expr: `http("http://10.0.0.1/healthz?a=1,2&b=(x)", 30s)`, want: `http("http://10.0.0.1/healthz?a=1,2&b=(x)", 30s)`},
+		"quoted timeout":        {expr: `file(/a, "30s")`, want: `file(/a, "30s")`},
+		"quoted escapes":        {expr: `file("/a \"b\"")`, want: `file("/a \"b\"")`},
+		"quoted in a group":     {expr: `any(http("http://10.0.0.1/?a=1,2)"), file(/a))`, want: `any(http("http://10.0.0.1/?a=1,2)"), file(/a))`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := waitfor.Parse(tt.expr, waitfor.Env{})
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.expr, err)
+			}
+			if got := c.String(); got != tt.want {
+				t.Errorf("Parse(%q).String() = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":                 "",
+		"no call":               "file",
+		"no name":               "(/a)",
+		"no argument":           "file()",
+		"empty argument":        "file(, 5s)",
+		"too many arguments":    "file(/a, 5s, 10s)",
+		"trailing comma":        "file(/a,)",
+		"unclosed":              "file(/a",
+		"unclosed nested":       "all(file(/a), file(/b)",
+		"trailing text":         "file(/a) file(/b)",
+		"unknown condition":     "exists(/a)",
+		"invalid timeout":       "file(/a, soon)",
+		"zero timeout":          "file(/a, 0s)",
+		"negative timeout":      "file(/a, -1s)",
+		"invalid uptime":        "uptime(a while)",
+		"empty group":           "all()",
+		"bad condition in any":  "any(file(/a), nope(/b))",
+		"bad nested condition":  "all(any(file(/a, never)))",
+		"unexpected close":      "file(/a))",
+		"group with a timeout":  "all(file(/a), 5s)",
+		"comma separated roots": "file(/a), file(/b)",
+		"unclosed quote":        `file("/a)`,
+		"empty quoted argument": `file("")`,
+		"text after a quote":    `file("/a"b)`,
+		"invalid escape":        `file("/a\q")`,
+	}
+	for name, expr := range tests {
+		t.Run(name, func(t *testing.T) {
+			if c, err := waitfor.Parse(expr, waitfor.Env{}); err == nil {
+				t.Errorf("Parse(%q) = %v, want an error", expr, c)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Package waitfor provides conditions the second fork can wait on before running the user image.
+//
+// Conditions are written as function calls and can be composed:
+//
+//	file(/run/tink/done)                       a file exists on the host
+//	tcp-open(127.0.0.1:8080)                   a TCP port accepts connections
+//	tcp-closed(127.0.0.1:42113)                a TCP port no longer accepts connections
+//	http(http://127.0.0.1:8080/healthz)        an HTTP endpoint returns a 2xx status
+//	process-exited(tink-worker)                no host process with the given name is running
+//	uptime(5m)                                 the host uptime is greater than the given duration
+//	all(cond, cond, ...)                       every condition is met
+//	any(cond, cond, ...)                       at least one condition is met
+//
+// Every leaf condition takes an optional timeout as its last argument, e.g. file(/run/done, 30s).
+// When no timeout is given, DefaultTimeout is used. Arguments that contain commas or parentheses
+// are double quoted, e.g. http("http://10.0.0.1/ready?checks=disk,net").
+package waitfor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the timeout of a leaf condition that does not specify one.
+	DefaultTimeout = 5 * time.Minute
+	// DefaultPollInterval is how often leaf conditions are checked.
+	DefaultPollInterval = time.Second
+)
+
+// ErrTimeout is returned when a condition is not met before its timeout.
+var ErrTimeout = errors.New("timed out")
+
+// Condition is something the second fork can wait on.
+type Condition interface {
+	// Wait blocks until the condition is met, its timeout expires or ctx is done.
+	Wait(ctx context.Context) error
+	// String returns the condition expression.
+	String() string
+}
+
+// Env is the environment conditions are checked against.
+// The zero value of each field is replaced by the real host implementation,
+// so tests can fake only what they need.
+type Env struct {
+	// HostFS is the host root filesystem used by file().
+	// Default is /proc/1/root, which is the host's root when running with pid: host.
+	HostFS fs.FS
+	// ProcFS is the host proc filesystem used by process-exited() and uptime().
+	// Default is /proc, which is the host's when running with pid: host.
+	ProcFS fs.FS
+	// Dial opens TCP connections for tcp-open() and tcp-closed().
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// HTTPClient sends the requests for http().
+	HTTPClient *http.Client
+	// PollInterval is how often leaf conditions are checked.
+	PollInterval time.Duration
+}
+
+func (e Env) withDefaults() Env {
+	if e.HostFS == nil {
+		e.HostFS = os.DirFS("/proc/1/root")
+	}
+	if e.ProcFS == nil {
+		e.ProcFS = os.DirFS("/proc")
+	}
+	if e.Dial == nil {
+		var d net.Dialer
+		e.Dial = d.DialContext
+	}
+	if e.HTTPClient == nil {
+		e.HTTPClient = &http.Client{Timeout: 5 * time.Second} //nolint:mnd // a single probe should not take longer.
+	}
+	if e.PollInterval <= 0 {
+		e.PollInterval = DefaultPollInterval
+	}
+	return e
+}
+
+// leaf is a single polled condition with its own timeout.
+type leaf struct {
+	expr     string
+	timeout  time.Duration
+	interval time.Duration
+	check    func(ctx context.Context) (bool, error)
+}
+
+func (l *leaf) String() string {
+	return l.expr
+}
+
+// Wait polls the check until it reports true or the timeout expires.
+// A deadline of ctx itself is not the condition's timeout and returns ctx.Err().
+func (l *leaf) Wait(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		ok, err := l.check(timeoutCtx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.expr, err)
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-timeoutCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s: %w after %s", l.expr, ErrTimeout, l.timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// group composes conditions. When all is true every condition must be met,
+// otherwise the first condition met satisfies the group.
+type group struct {
+	all        bool
+	conditions []Condition
+}
+
+func (g *group) String() string {
+	parts := make([]string, 0, len(g.conditions))
+	for _, c := range g.conditions {
+		parts = append(parts, c.String())
+	}
+	name := "any"
+	if g.all {
+		name = "all"
+	}
+	return name + "(" + strings.Join(parts, ", ") + ")"
+}
+
+// Wait waits on all conditions concurrently.
+func (g *group) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(g.conditions))
+	for _, c := range g.conditions {
+		go func() { errs <- c.Wait(ctx) }()
+	}
+
+	var failures []error
+	for range g.conditions {
+		err := <-errs
+		switch {
+		case err == nil && !g.all:
+			return nil
+		case err != nil && g.all:
+			return err
+		case err != nil:
+			failures = append(failures, err)
+		}
+	}
+	if g.all {
+		return nil
+	}
+	return fmt.Errorf("no condition met: %w", errors.Join(failures...))
+}